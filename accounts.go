@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Portal roles. Admins see and manage everything; owners manage the agents of
+// their workspaces; viewers only see their workspaces.
+const (
+	roleAdmin  = "admin"
+	roleOwner  = "owner"
+	roleViewer = "viewer"
+)
+
+var roles = map[string]bool{roleAdmin: true, roleOwner: true, roleViewer: true}
+
+var errAccountNotFound = errors.New("account not found")
+
+// Account is a person allowed to use the portal. Only a hash of its bearer
+// token is stored.
+type Account struct {
+	Name       string    `json:"name"`
+	Role       string    `json:"role"`
+	Workspaces []string  `json:"workspaces,omitempty"`
+	SlackUser  string    `json:"slack_user,omitempty"`
+	TokenHash  string    `json:"token_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// actor names the account in the audit log.
+func (a *Account) actor() string {
+	return "account:" + a.Name
+}
+
+func (a *Account) canView(workspace string) bool {
+	if a.Role == roleAdmin {
+		return true
+	}
+	for _, ws := range a.Workspaces {
+		if ws == workspace {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Account) canManage(workspace string) bool {
+	return a.Role == roleAdmin || (a.Role == roleOwner && a.canView(workspace))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadAccount(tr ReadTx, name string) (*Account, error) {
+	value, err := tr.Get(ks.accounts.Pack(tuple.Tuple{name}))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var account Account
+	if err := json.Unmarshal(value, &account); err != nil {
+		return nil, fmt.Errorf("error unmarshaling account %s: %v", name, err)
+	}
+	return &account, nil
+}
+
+// saveAccount creates or replaces the account with a new random token, which
+// is returned as the only copy of it.
+func saveAccount(db Store, account Account) (string, error) {
+	if !roles[account.Role] {
+		return "", fmt.Errorf("unknown role %q, use admin, owner or viewer", account.Role)
+	}
+	if account.Role != roleAdmin && len(account.Workspaces) == 0 {
+		return "", fmt.Errorf("a %s account needs at least one workspace", account.Role)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("error generating token: %v", err)
+	}
+	token := hex.EncodeToString(secret)
+	account.TokenHash = hashToken(token)
+	account.CreatedAt = time.Now().UTC()
+
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		previous, err := loadAccount(tr, account.Name)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			tr.Clear(ks.accountTokens.Pack(tuple.Tuple{previous.TokenHash}))
+			account.CreatedAt = previous.CreatedAt
+		}
+		value, err := json.Marshal(account)
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.accounts.Pack(tuple.Tuple{account.Name}), value)
+		tr.Set(ks.accountTokens.Pack(tuple.Tuple{account.TokenHash}), []byte(account.Name))
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func deleteAccount(db Store, name string) error {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		account, err := loadAccount(tr, name)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
+			return nil, errAccountNotFound
+		}
+		tr.Clear(ks.accountTokens.Pack(tuple.Tuple{account.TokenHash}))
+		tr.Clear(ks.accounts.Pack(tuple.Tuple{name}))
+		return nil, nil
+	})
+	return err
+}
+
+// authenticate returns the account whose token the request carries as
+// "Authorization: Bearer <token>", or nil if there is none or it is unknown.
+func authenticate(db Store, r *http.Request) (*Account, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, nil
+	}
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		name, err := tr.Get(ks.accountTokens.Pack(tuple.Tuple{hashToken(token)}))
+		if err != nil || name == nil {
+			return (*Account)(nil), err
+		}
+		return loadAccount(tr, string(name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Account), nil
+}
+
+// withAccount only calls next for requests from a known account.
+func withAccount(db Store, next func(http.ResponseWriter, *http.Request, *Account)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, err := authenticate(db, r)
+		if err != nil {
+			log.Printf("\033[1;31mError authenticating request: %v\033[0m", err)
+			http.Error(w, "Error authenticating request", http.StatusInternalServerError)
+			return
+		}
+		if account == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r, account)
+	}
+}
+
+func addAccountCommand(db Store, args []string) error {
+	flags := flag.NewFlagSet("add-account", flag.ContinueOnError)
+	slackUser := flags.String("slack-user", "", "Slack user ID of the account, used as the owner of agents it invites")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return fmt.Errorf("usage: add-account [-slack-user U…] <name> <admin|owner|viewer> [workspace...]")
+	}
+	account := Account{
+		Name:       flags.Arg(0),
+		Role:       flags.Arg(1),
+		Workspaces: flags.Args()[2:],
+		SlackUser:  *slackUser,
+	}
+	token, err := saveAccount(db, account)
+	if err != nil {
+		return err
+	}
+	recordAudit(db, AuditEntry{
+		Actor:   actorCLI,
+		Action:  auditAccountSave,
+		Target:  account.Name,
+		Details: map[string]string{"role": account.Role, "workspaces": strings.Join(account.Workspaces, ",")},
+	})
+	fmt.Printf("Saved %s account %s; its token, shown only once:\n%s\n", account.Role, account.Name, token)
+	return nil
+}
+
+func deleteAccountCommand(db Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: delete-account <name>")
+	}
+	if err := deleteAccount(db, args[0]); err != nil {
+		return err
+	}
+	recordAudit(db, AuditEntry{Actor: actorCLI, Action: auditAccountDelete, Target: args[0]})
+	fmt.Printf("Deleted account %s\n", args[0])
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestAccount saves an account and returns its bearer token.
+func newTestAccount(t *testing.T, db Store, name, role string, workspaces ...string) string {
+	t.Helper()
+	token, err := saveAccount(db, Account{Name: name, Role: role, Workspaces: workspaces})
+	if err != nil {
+		t.Fatalf("saving account %s: %v", name, err)
+	}
+	return token
+}
+
+func TestPortalAccess(t *testing.T) {
+	db := newTestStore(t)
+	admin := newTestAccount(t, db, "root", roleAdmin)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	viewer := newTestAccount(t, db, "vic", roleViewer, "cats")
+	storeUserCredentials(db, UserCredential{Email: "cat@example.com", APIToken: "xoxp-cat", Workspace: "cats"}, "T1")
+	storeUserCredentials(db, UserCredential{Email: "dog@example.com", APIToken: "xoxp-dog", Workspace: "dogs"}, "T2")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/invite", slackInviteHandler(db))
+	mux.HandleFunc("DELETE /agents/{email}", deleteAgentHandler(db, nil))
+	mux.HandleFunc("GET /status", statusHandler(db, newAgentRunner()))
+	mux.HandleFunc("GET /workspaces", listWorkspacesHandler(db))
+	mux.HandleFunc("GET /workspaces/{name}/agents", workspaceAgentsHandler(db))
+	mux.HandleFunc("GET /audit", auditHandler(db))
+
+	do := func(token, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	invite := func(workspace string) SlackInvite {
+		return SlackInvite{Workspace: workspace, InviteCode: "zt-1", Name: "Agent", Appearance: "robot", System: "Be nice.", Team: "T0DOGSTEAM", PrimaryUser: "U0DOGOWNER"}
+	}
+
+	tests := []struct {
+		name, token, method, path string
+		body                      interface{}
+		want                      int
+	}{
+		{"no token", "", "GET", "/workspaces", nil, http.StatusUnauthorized},
+		{"unknown token", "nope", "GET", "/workspaces", nil, http.StatusUnauthorized},
+		{"owner invites elsewhere", owner, "POST", "/invite", invite("dogs"), http.StatusForbidden},
+		{"viewer invites", viewer, "POST", "/invite", invite("cats"), http.StatusForbidden},
+		{"owner lists other agents", owner, "GET", "/workspaces/dogs/agents", nil, http.StatusNotFound},
+		{"viewer lists agents", viewer, "GET", "/workspaces/cats/agents", nil, http.StatusOK},
+		{"owner deletes other agent", owner, "DELETE", "/agents/dog@example.com", nil, http.StatusNotFound},
+		{"viewer deletes agent", viewer, "DELETE", "/agents/cat@example.com", nil, http.StatusForbidden},
+		{"owner reads whole audit log", owner, "GET", "/audit", nil, http.StatusForbidden},
+		{"owner reads own audit log", owner, "GET", "/audit?workspace=cats", nil, http.StatusOK},
+		{"admin reads whole audit log", admin, "GET", "/audit", nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		if rec := do(test.token, test.method, test.path, test.body); rec.Code != test.want {
+			t.Errorf("%s: %s %s = %d %q, want %d", test.name, test.method, test.path, rec.Code, rec.Body, test.want)
+		}
+	}
+
+	visible := func(token string) string {
+		var workspaces []WorkspaceSummary
+		json.NewDecoder(do(token, "GET", "/workspaces", nil).Body).Decode(&workspaces)
+		var names []string
+		for _, workspace := range workspaces {
+			names = append(names, workspace.Name)
+		}
+		var status struct{ Agents []AgentStatus }
+		json.NewDecoder(do(token, "GET", "/status", nil).Body).Decode(&status)
+		return fmt.Sprintf("%v %d", names, len(status.Agents))
+	}
+	if got := visible(admin); got != "[cats dogs] 2" {
+		t.Errorf("admin sees %s", got)
+	}
+	if got := visible(owner); got != "[cats] 1" {
+		t.Errorf("owner sees %s", got)
+	}
+
+	// A new token replaces the old one
+	rotated := newTestAccount(t, db, "olive", roleOwner, "cats")
+	if rec := do(owner, "GET", "/workspaces", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old token after rotation = %d, want 401", rec.Code)
+	}
+	if rec := do(rotated, "GET", "/workspaces", nil); rec.Code != http.StatusOK {
+		t.Errorf("new token after rotation = %d, want 200", rec.Code)
+	}
+	if err := deleteAccount(db, "olive"); err != nil {
+		t.Fatalf("deleting account: %v", err)
+	}
+	if rec := do(rotated, "GET", "/workspaces", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token of a deleted account = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+var (
+	errAgentNotFound   = errors.New("agent not found")
+	errTokenNotRevoked = errors.New("token not revoked")
+)
+
+// agentRunner keeps track of the message handlers running in this process so
+// that a single agent can be stopped without restarting the server.
+type agentRunner struct {
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newAgentRunner() *agentRunner {
+	return &agentRunner{running: make(map[string]context.CancelFunc)}
+}
+
+// start runs the message handler for user in the background, replacing any
+// handler already running for the same agent.
+func (r *agentRunner) start(db Store, user UserCredential) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r.mu.Lock()
+	if previous, ok := r.running[user.Email]; ok {
+		previous()
+	}
+	r.running[user.Email] = cancel
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer r.finished(ctx, user.Email)
+		handleUserMessages(ctx, db, user)
+	}()
+}
+
+// finished forgets the handler that ran with ctx once it has returned, unless
+// it has already been replaced.
+func (r *agentRunner) finished(ctx context.Context, email string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ctx.Err() == nil {
+		r.running[email]()
+		delete(r.running, email)
+	}
+}
+
+// stop cancels the handler of the agent with email and reports whether one
+// was running.
+func (r *agentRunner) stop(email string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cancel, ok := r.running[email]
+	if ok {
+		cancel()
+		delete(r.running, email)
+	}
+	return ok
+}
+
+func (r *agentRunner) isRunning(email string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.running[email]
+	return ok
+}
+
+// wait blocks until every started handler has returned.
+func (r *agentRunner) wait() {
+	r.wg.Wait()
+}
+
+// shutdown stops every running handler and waits for them to return. The
+// runner is done with afterwards.
+func (r *agentRunner) shutdown() {
+	r.mu.Lock()
+	for email, cancel := range r.running {
+		cancel()
+		delete(r.running, email)
+	}
+	r.mu.Unlock()
+	r.wait()
+}
+
+// ArchivedAgent is what is kept of an agent after it has been offboarded.
+type ArchivedAgent struct {
+	Email     string    `json:"email"`
+	Name      string    `json:"name,omitempty"`
+	Workspace string    `json:"workspace"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by"`
+}
+
+// offboardAgent retires the agent with email: its token is revoked, its
+// handler stopped, and its records replaced by an entry in the archive. A
+// failed revoke is reported as errTokenNotRevoked. The runner may be nil
+// when no handlers run in this process.
+func offboardAgent(ctx context.Context, db Store, runner *agentRunner, email, actor string) error {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadUser(tr, email)
+	})
+	if err != nil {
+		return err
+	}
+	user := result.(*UserCredential)
+	if user == nil {
+		return errAgentNotFound
+	}
+
+	// An agent whose token cannot be revoked stays as it is, answering
+	if err := revokeToken(ctx, user); err != nil {
+		return fmt.Errorf("%w: %v", errTokenNotRevoked, err)
+	}
+
+	if runner != nil && runner.stop(email) {
+		log.Printf("\033[1;33mStopped message handling for user: %s\033[0m", email)
+	}
+
+	_, err = db.Transact(func(tr Tx) (interface{}, error) {
+		archived, err := json.Marshal(ArchivedAgent{
+			Email:     user.Email,
+			Name:      user.Name,
+			Workspace: user.Workspace,
+			DeletedAt: time.Now().UTC(),
+			DeletedBy: actor,
+		})
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.archive.Pack(tuple.Tuple{email}), archived)
+		tr.Clear(ks.users.Pack(tuple.Tuple{email}))
+		tr.ClearRange(ks.conversations.Sub(email))
+		tr.ClearRange(ks.prompts.Sub(email))
+		tr.ClearRange(ks.queue.Sub(email))
+		if err := deleteAgentJobs(tr, email); err != nil {
+			return nil, err
+		}
+		if err := deleteAgentDocuments(tr, user.Workspace, email); err != nil {
+			return nil, err
+		}
+		return nil, removeWorkspaceAgent(tr, user.Workspace, email)
+	})
+	if err != nil {
+		return fmt.Errorf("error removing records: %v", err)
+	}
+
+	recordAudit(db, AuditEntry{Actor: actor, Action: auditAgentDelete, Workspace: user.Workspace, Target: email})
+	return nil
+}
+
+// revokeToken calls auth.revoke for the agent's token. A token Slack no
+// longer accepts is as good as revoked.
+func revokeToken(ctx context.Context, user *UserCredential) error {
+	data := url.Values{}
+	data.Set("token", user.APIToken)
+	resp, err := newSlackSession(user.Workspace).post(ctx, "auth.revoke", data)
+	if err != nil {
+		return fmt.Errorf("error revoking token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error parsing auth.revoke response: %v", err)
+	}
+	switch {
+	case result.OK:
+		log.Printf("\033[1;32mRevoked token for user: %s\033[0m", user.Email)
+	case result.Error == "invalid_auth" || result.Error == "token_revoked" || result.Error == "account_inactive":
+		log.Printf("\033[1;33mToken for user %s already unusable: %s\033[0m", user.Email, result.Error)
+	default:
+		return fmt.Errorf("auth.revoke failed: %s", result.Error)
+	}
+	return nil
+}
+
+// requestAgent loads the agent named by the request's {email} for account,
+// which needs to be able to manage its workspace if manage is set. When it
+// cannot, the error has been written and nil is returned. Agents of other
+// workspaces are not found rather than forbidden, so their existence does
+// not leak.
+func requestAgent(w http.ResponseWriter, r *http.Request, db Store, account *Account, manage bool) *UserCredential {
+	email := r.PathValue("email")
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadUser(tr, email)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading agent: %v", err), http.StatusInternalServerError)
+		return nil
+	}
+	user := result.(*UserCredential)
+	if user == nil || !account.canView(user.Workspace) {
+		http.Error(w, fmt.Sprintf("Agent '%s' not found", email), http.StatusNotFound)
+		return nil
+	}
+	if manage && !account.canManage(user.Workspace) {
+		http.Error(w, fmt.Sprintf("Account '%s' cannot change agents of workspace '%s'", account.Name, user.Workspace), http.StatusForbidden)
+		return nil
+	}
+	return user
+}
+
+func deleteAgentHandler(db Store, runner *agentRunner) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, true)
+		if user == nil {
+			return
+		}
+		email := user.Email
+		err := offboardAgent(r.Context(), db, runner, email, account.actor())
+		if errors.Is(err, errAgentNotFound) {
+			http.Error(w, fmt.Sprintf("Agent '%s' not found", email), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("\033[1;31mError deleting agent %s: %v\033[0m", email, err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, errTokenNotRevoked) {
+				status = http.StatusBadGateway
+			}
+			http.Error(w, fmt.Sprintf("Error deleting agent: %v", err), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func deleteAgentCommand(db Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: delete-agent <email>")
+	}
+	if err := offboardAgent(context.Background(), db, nil, args[0], actorCLI); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted agent %s; a running server drops it once Slack closes its connection\n", args[0])
+	return nil
+}
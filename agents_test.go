@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeleteAgentRevokeFails(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	token := newTestAccount(t, db, "olive", roleOwner, "cats")
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats"}, "T1")
+	runner := newAgentRunner()
+	runner.running["marvin@example.com"] = func() {}
+
+	// Slack cannot be reached to revoke the token
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	cfg.SlackWorkspaceURL = gone.URL
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /agents/{email}", deleteAgentHandler(db, runner))
+	req := httptest.NewRequest(http.MethodDelete, "/agents/marvin@example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("DELETE /agents without Slack = %d, want 502", rec.Code)
+	}
+	if !runner.isRunning("marvin@example.com") {
+		t.Errorf("agent stopped although its token was not revoked")
+	}
+	if users := retrieveAllUsers(db); len(users) != 1 {
+		t.Errorf("agents after a failed delete = %+v, want it kept", users)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// AuditEntry records who did what to which workspace or agent, and when.
+type AuditEntry struct {
+	ID        string            `json:"id"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor"`
+	Action    string            `json:"action"`
+	Workspace string            `json:"workspace,omitempty"`
+	Target    string            `json:"target,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Audited actions.
+const (
+	auditInviteSubmit      = "invite.submit"
+	auditAgentCreate       = "agent.create"
+	auditAgentCreateFailed = "agent.create_failed"
+	auditAgentDelete       = "agent.delete"
+	auditTokenInvalid      = "agent.token_invalid"
+	auditTokenValid        = "agent.token_valid"
+	auditStoreMigrate      = "store.migrate"
+	auditAccountSave       = "account.save"
+	auditAccountDelete     = "account.delete"
+	auditAvatarUpload      = "avatar.upload"
+	auditPromptUpdate      = "agent.prompt_update"
+	auditAvatarRegenerate  = "agent.avatar_regenerate"
+	auditConfigUpdate      = "workspace.config_update"
+	auditScheduleUpdate    = "agent.schedule_update"
+	auditJobCreate         = "agent.job_create"
+	auditJobDelete         = "agent.job_delete"
+	auditKnowledgeUpload   = "knowledge.upload"
+	auditKnowledgeDelete   = "knowledge.delete"
+)
+
+// Actors for actions not taken through the API.
+const (
+	actorCLI          = "cli"
+	actorConsole      = "console"
+	actorTokenChecker = "token-checker"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Keys in the audit directory. Each entry is written once under its commit
+// versionstamp, which makes the log append-only and ordered, together with
+// one index key per way it can be looked up:
+//
+//	("log", versionstamp)                        -> AuditEntry JSON
+//	("actor", actor, versionstamp)               -> ""
+//	("workspace", workspace, versionstamp)       -> ""
+//	("time", unix nanos, versionstamp)           -> ""
+func auditKeys(entry AuditEntry) []tuple.Tuple {
+	keys := []tuple.Tuple{
+		{"actor", entry.Actor},
+		{"time", entry.Time.UnixNano()},
+	}
+	if entry.Workspace != "" {
+		keys = append(keys, tuple.Tuple{"workspace", entry.Workspace})
+	}
+	return keys
+}
+
+// recordAudit appends entry to the audit log. Failing to audit does not undo
+// the action, so errors are only logged.
+func recordAudit(db Store, entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	log.Printf("\033[1;35m[AUDIT]\033[0m actor=%s action=%s workspace=%s target=%s", entry.Actor, entry.Action, entry.Workspace, entry.Target)
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedKey(versionstampedKey(ks.audit, tuple.Tuple{"log"}, 0), value)
+		for _, prefix := range auditKeys(entry) {
+			tr.SetVersionstampedKey(versionstampedKey(ks.audit, prefix, 0), []byte{})
+		}
+		return nil, nil
+	})
+	if err != nil {
+		log.Printf("\033[1;31mError recording audit entry %s by %s: %v\033[0m", entry.Action, entry.Actor, err)
+	}
+}
+
+// AuditQuery selects audit entries. Zero fields match everything; Since is
+// inclusive and Until exclusive.
+type AuditQuery struct {
+	Actor     string
+	Workspace string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	return (q.Actor == "" || entry.Actor == q.Actor) &&
+		(q.Workspace == "" || entry.Workspace == q.Workspace) &&
+		(q.Since.IsZero() || !entry.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.Time.Before(q.Until))
+}
+
+// queryAudit returns the entries matching q, newest first. It walks the most
+// selective index and filters the entries it points at by the rest of q.
+func queryAudit(db Store, q AuditQuery) ([]AuditEntry, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditLimit
+	}
+
+	// When the index alone decides what matches, the range read can stop at
+	// the limit
+	var index fdb.ExactRange
+	options := fdb.RangeOptions{Reverse: true}
+	switch {
+	case q.Actor != "":
+		index = ks.audit.Sub("actor", q.Actor)
+		if q.Workspace == "" && q.Since.IsZero() && q.Until.IsZero() {
+			options.Limit = q.Limit
+		}
+	case q.Workspace != "":
+		index = ks.audit.Sub("workspace", q.Workspace)
+		if q.Since.IsZero() && q.Until.IsZero() {
+			options.Limit = q.Limit
+		}
+	default:
+		options.Limit = q.Limit
+		begin, end := int64(0), int64(1<<63-1)
+		if !q.Since.IsZero() {
+			begin = q.Since.UnixNano()
+		}
+		if !q.Until.IsZero() {
+			end = q.Until.UnixNano()
+		}
+		index = fdb.KeyRange{
+			Begin: ks.audit.Pack(tuple.Tuple{"time", begin}),
+			End:   ks.audit.Pack(tuple.Tuple{"time", end}),
+		}
+	}
+
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		kvs, err := tr.GetRange(index, options)
+		if err != nil {
+			return nil, err
+		}
+		entries := []AuditEntry{}
+		for _, kv := range kvs {
+			if len(entries) == q.Limit {
+				break
+			}
+			t, err := ks.audit.Unpack(kv.Key)
+			if err != nil {
+				return nil, fmt.Errorf("error unpacking audit index key: %v", err)
+			}
+			stamp, ok := t[len(t)-1].(tuple.Versionstamp)
+			if !ok {
+				return nil, fmt.Errorf("audit index key without versionstamp: %v", t)
+			}
+			value, err := tr.Get(ks.audit.Pack(tuple.Tuple{"log", stamp}))
+			if err != nil {
+				return nil, err
+			}
+			if value == nil {
+				continue
+			}
+			var entry AuditEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				log.Printf("\033[1;31mError unmarshaling audit entry: %v\033[0m", err)
+				continue
+			}
+			entry.ID = hex.EncodeToString(stamp.Bytes())
+			if q.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]AuditEntry), nil
+}
+
+// auditHandler serves GET /audit?actor=&workspace=&since=&until=&limit=,
+// with since and until in RFC 3339.
+//
+// Only admins can read the whole log; everyone else has to ask for one of
+// their workspaces.
+func auditHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		params := r.URL.Query()
+		q := AuditQuery{Actor: params.Get("actor"), Workspace: params.Get("workspace")}
+		if account.Role != roleAdmin && (q.Workspace == "" || !account.canView(q.Workspace)) {
+			http.Error(w, "Query the audit log of one of your workspaces", http.StatusForbidden)
+			return
+		}
+		for _, bound := range []struct {
+			name string
+			t    *time.Time
+		}{{"since", &q.Since}, {"until", &q.Until}} {
+			if value := params.Get(bound.name); value != "" {
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Invalid '%s': %v", bound.name, err), http.StatusBadRequest)
+					return
+				}
+				*bound.t = t
+			}
+		}
+		if value := params.Get("limit"); value != "" {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit <= 0 || limit > maxAuditLimit {
+				http.Error(w, fmt.Sprintf("Invalid 'limit': must be between 1 and %d", maxAuditLimit), http.StatusBadRequest)
+				return
+			}
+			q.Limit = limit
+		}
+
+		entries, err := queryAudit(db, q)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying audit log: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuditQuery(t *testing.T) {
+	db := newTestStore(t)
+	token := newTestAccount(t, db, "auditor", roleAdmin)
+	recordAudit(db, AuditEntry{Actor: "alice", Action: auditInviteSubmit, Workspace: "cats", Target: "Tom"})
+	recordAudit(db, AuditEntry{Actor: "bob", Action: auditAgentCreate, Workspace: "dogs", Target: "a@example.com"})
+	middle := time.Now()
+	recordAudit(db, AuditEntry{Actor: "alice", Action: auditAgentDelete, Workspace: "dogs", Target: "a@example.com"})
+	recordAudit(db, AuditEntry{Actor: actorTokenChecker, Action: auditTokenInvalid, Workspace: "cats", Target: "b@example.com"})
+
+	actions := func(query string) []string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/audit?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		auditHandler(db)(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /audit?%s = %d %s", query, rec.Code, rec.Body)
+		}
+		var entries []AuditEntry
+		if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+			t.Fatalf("decoding audit entries: %v", err)
+		}
+		var got []string
+		for _, entry := range entries {
+			if entry.ID == "" {
+				t.Errorf("entry %+v has no ID", entry)
+			}
+			got = append(got, entry.Action)
+		}
+		return got
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "[agent.token_invalid agent.delete agent.create invite.submit]"},
+		{"limit=2", "[agent.token_invalid agent.delete]"},
+		{"actor=alice", "[agent.delete invite.submit]"},
+		{"workspace=cats", "[agent.token_invalid invite.submit]"},
+		{"actor=alice&workspace=dogs", "[agent.delete]"},
+		{"since=" + middle.UTC().Format(time.RFC3339Nano), "[agent.token_invalid agent.delete]"},
+		{"workspace=dogs&until=" + middle.UTC().Format(time.RFC3339Nano), "[agent.create]"},
+		{"actor=nobody", "[]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(actions(test.query)); got != test.want {
+			t.Errorf("GET /audit?%s = %s, want %s", test.query, got, test.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/audit?since=yesterday", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	auditHandler(db)(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /audit with a bad since = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Slack wants square profile photos of at least 512 pixels; larger ones are
+// scaled down on its side anyway.
+const (
+	avatarSize       = 512
+	minAvatarSize    = 128
+	maxAvatarUpload  = 10 << 20
+	avatarChunkBytes = 90_000 // below FoundationDB's 100kB value limit
+)
+
+var errAvatarNotFound = errors.New("avatar not found")
+
+// Avatar describes an uploaded profile image. The normalised PNG itself is
+// stored next to it in chunks.
+type Avatar struct {
+	ID         string    `json:"id"`
+	Workspace  string    `json:"workspace"`
+	Size       int       `json:"size"`
+	Chunks     int       `json:"chunks"`
+	UploadedBy string    `json:"uploaded_by"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// normalizeAvatar validates an uploaded PNG, JPEG or GIF and turns it into a
+// square avatarSize PNG, cropping the longer side around the centre.
+func normalizeAvatar(data []byte) ([]byte, error) {
+	if len(data) > maxAvatarUpload {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxAvatarUpload)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not a PNG, JPEG or GIF image: %v", err)
+	}
+	if config.Width < minAvatarSize || config.Height < minAvatarSize {
+		return nil, fmt.Errorf("image is %dx%d, needs to be at least %dx%d", config.Width, config.Height, minAvatarSize, minAvatarSize)
+	}
+	if config.Width*config.Height > 50_000_000 {
+		return nil, fmt.Errorf("image is %dx%d, too many pixels", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s image: %v", format, err)
+	}
+
+	bounds := img.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+	square := image.Rect(x0, y0, x0+side, y0+side)
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, resample(img, square, avatarSize)); err != nil {
+		return nil, fmt.Errorf("error encoding avatar: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// resample scales the square src region of img to size x size pixels,
+// averaging every source pixel a destination pixel covers.
+func resample(img image.Image, src image.Rectangle, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	side := src.Dx()
+	for y := 0; y < size; y++ {
+		sy0 := src.Min.Y + y*side/size
+		sy1 := max(src.Min.Y+(y+1)*side/size, sy0+1)
+		for x := 0; x < size; x++ {
+			sx0 := src.Min.X + x*side/size
+			sx1 := max(src.Min.X+(x+1)*side/size, sx0+1)
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
+
+// saveAvatar normalises and stores an image for workspace.
+func saveAvatar(db Store, workspace, uploadedBy string, data []byte) (*Avatar, error) {
+	normalized, err := normalizeAvatar(data)
+	if err != nil {
+		return nil, err
+	}
+	return storeAvatar(db, workspace, uploadedBy, normalized)
+}
+
+// storeAvatar stores a normalised image for workspace. The same image
+// uploaded twice for a workspace is stored once; the ID covers the workspace
+// so that another workspace's upload of it is stored apart.
+func storeAvatar(db Store, workspace, uploadedBy string, normalized []byte) (*Avatar, error) {
+	hash := sha256.New()
+	hash.Write([]byte(workspace + "\x00"))
+	hash.Write(normalized)
+	sum := hash.Sum(nil)
+	avatar := &Avatar{
+		ID:         hex.EncodeToString(sum[:16]),
+		Workspace:  workspace,
+		Size:       len(normalized),
+		Chunks:     (len(normalized) + avatarChunkBytes - 1) / avatarChunkBytes,
+		UploadedBy: uploadedBy,
+		UploadedAt: time.Now().UTC(),
+	}
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		meta, err := json.Marshal(avatar)
+		if err != nil {
+			return nil, err
+		}
+		tr.ClearRange(ks.avatars.Sub(avatar.ID))
+		tr.Set(ks.avatars.Pack(tuple.Tuple{avatar.ID, "meta"}), meta)
+		for i := 0; i < avatar.Chunks; i++ {
+			chunk := normalized[i*avatarChunkBytes : min((i+1)*avatarChunkBytes, len(normalized))]
+			tr.Set(ks.avatars.Pack(tuple.Tuple{avatar.ID, "chunk", i}), chunk)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error storing avatar: %v", err)
+	}
+	return avatar, nil
+}
+
+func loadAvatarMeta(tr ReadTx, id string) (*Avatar, error) {
+	value, err := tr.Get(ks.avatars.Pack(tuple.Tuple{id, "meta"}))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var avatar Avatar
+	if err := json.Unmarshal(value, &avatar); err != nil {
+		return nil, fmt.Errorf("error unmarshaling avatar %s: %v", id, err)
+	}
+	return &avatar, nil
+}
+
+// loadAvatar returns the metadata and PNG of the avatar with id.
+func loadAvatar(db Store, id string) (*Avatar, []byte, error) {
+	type loaded struct {
+		avatar *Avatar
+		data   []byte
+	}
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		avatar, err := loadAvatarMeta(tr, id)
+		if err != nil {
+			return nil, err
+		}
+		if avatar == nil {
+			return nil, errAvatarNotFound
+		}
+		kvs, err := tr.GetRange(ks.avatars.Sub(id, "chunk"), fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if len(kvs) != avatar.Chunks {
+			return nil, fmt.Errorf("avatar %s has %d of %d chunks", id, len(kvs), avatar.Chunks)
+		}
+		data := make([]byte, 0, avatar.Size)
+		for _, kv := range kvs {
+			data = append(data, kv.Value...)
+		}
+		return loaded{avatar, data}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	l := result.(loaded)
+	return l.avatar, l.data, nil
+}
+
+// avatarImage returns the profile photo for a new agent: the avatar with
+// avatarID, as signupAvatar picked it, else one fetched from cfg.AvatarURL if
+// that is set. It returns nil when there is none.
+func avatarImage(ctx context.Context, db Store, avatarID string) ([]byte, error) {
+	if avatarID != "" {
+		_, data, err := loadAvatar(db, avatarID)
+		return data, err
+	}
+	if cfg.AvatarURL == "" {
+		return nil, nil
+	}
+
+	log.Printf("\033[1;33mGetting profile picture from %s\033[0m", cfg.AvatarURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.AvatarURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error getting profile picture: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarUpload+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading profile picture data: %v", err)
+	}
+	return normalizeAvatar(data)
+}
+
+// uploadAvatarHandler stores the multipart "image" for the workspace in the
+// query and, with default=true, makes it the workspace's default avatar.
+func uploadAvatarHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		workspace := r.URL.Query().Get("workspace")
+		if workspace == "" {
+			http.Error(w, "Mandatory parameter 'workspace' is missing", http.StatusBadRequest)
+			return
+		}
+		if !account.canManage(workspace) {
+			http.Error(w, fmt.Sprintf("Account '%s' cannot upload avatars for workspace '%s'", account.Name, workspace), http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxAvatarUpload+1<<20)
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Missing 'image' file: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading image: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		normalized, err := normalizeAvatar(data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid avatar: %v", err), http.StatusBadRequest)
+			return
+		}
+		avatar, err := storeAvatar(db, workspace, account.actor(), normalized)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("default") == "true" {
+			_, err = db.Transact(func(tr Tx) (interface{}, error) {
+				ws, err := upsertWorkspace(tr, workspace, "", "", "")
+				if err != nil {
+					return nil, err
+				}
+				ws.DefaultAvatar = avatar.ID
+				return nil, saveWorkspace(tr, ws)
+			})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error setting default avatar: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditAvatarUpload,
+			Workspace: workspace,
+			Target:    avatar.ID,
+			Details:   map[string]string{"default": fmt.Sprint(r.URL.Query().Get("default") == "true")},
+		})
+		writeJSON(w, avatar)
+	})
+}
+
+func getAvatarHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		id := r.PathValue("id")
+		avatar, data, err := loadAvatar(db, id)
+		if errors.Is(err, errAvatarNotFound) || (err == nil && !account.canView(avatar.Workspace)) {
+			http.Error(w, fmt.Sprintf("Avatar '%s' not found", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading avatar: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeAvatar(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		return buf.Bytes()
+	}
+
+	out, err := normalizeAvatar(encode(testImage(900, 300)))
+	if err != nil {
+		t.Fatalf("normalizing a wide image: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decoding normalized avatar: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != avatarSize || b.Dy() != avatarSize {
+		t.Errorf("normalized avatar is %v, want %dx%d", b, avatarSize, avatarSize)
+	}
+	// The centre third of the gradient is kept: red runs from x=300 (44 as
+	// a byte) to x=599 (87)
+	if r, _, _, _ := img.At(0, avatarSize/2).RGBA(); r>>8 != 44 {
+		t.Errorf("left edge red = %d, want the crop to start at x=300", r>>8)
+	}
+
+	for name, data := range map[string][]byte{
+		"too small": encode(testImage(100, 400)),
+		"not image": []byte("GIF89a but not really"),
+	} {
+		if _, err := normalizeAvatar(data); err == nil {
+			t.Errorf("%s: normalizeAvatar accepted it", name)
+		}
+	}
+}
+
+func TestUploadAvatar(t *testing.T) {
+	db := newTestStore(t)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	other := newTestAccount(t, db, "otto", roleOwner, "dogs")
+
+	// Noise does not compress, so the PNG needs several chunks
+	noise := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+	for i := 3; i < len(noise.Pix); i += 4 {
+		noise.Pix[i] = 255
+	}
+	var upload bytes.Buffer
+	writer := multipart.NewWriter(&upload)
+	part, _ := writer.CreateFormFile("image", "noise.png")
+	png.Encode(part, noise)
+	writer.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /avatars", uploadAvatarHandler(db))
+	mux.HandleFunc("GET /avatars/{id}", getAvatarHandler(db))
+	do := func(token string, req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/avatars?workspace=cats&default=true", bytes.NewReader(upload.Bytes()))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := do(owner, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /avatars = %d %s", rec.Code, rec.Body)
+	}
+	var avatar Avatar
+	json.NewDecoder(rec.Body).Decode(&avatar)
+	if avatar.Chunks < 2 {
+		t.Errorf("avatar stored in %d chunks, want several", avatar.Chunks)
+	}
+
+	rec = do(owner, httptest.NewRequest(http.MethodGet, "/avatars/"+avatar.ID, nil))
+	if img, err := png.Decode(rec.Body); err != nil || !bytes.Equal(rgba(img).Pix, noise.Pix) {
+		t.Errorf("GET /avatars/%s did not return the uploaded image: %v", avatar.ID, err)
+	}
+	if rec := do(other, httptest.NewRequest(http.MethodGet, "/avatars/"+avatar.ID, nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /avatars/%s from another workspace = %d, want 404", avatar.ID, rec.Code)
+	}
+
+	// The same image uploaded for another workspace leaves this one's alone
+	req = httptest.NewRequest(http.MethodPost, "/avatars?workspace=dogs", bytes.NewReader(upload.Bytes()))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec = do(other, req)
+	var theirs Avatar
+	json.NewDecoder(rec.Body).Decode(&theirs)
+	if rec.Code != http.StatusOK || theirs.ID == avatar.ID {
+		t.Errorf("POST /avatars for dogs = %d, id %q, want a new avatar", rec.Code, theirs.ID)
+	}
+	if rec := do(owner, httptest.NewRequest(http.MethodGet, "/avatars/"+avatar.ID, nil)); rec.Code != http.StatusOK {
+		t.Errorf("GET /avatars/%s after another workspace's upload = %d, want 200", avatar.ID, rec.Code)
+	}
+
+	if id := signupAvatar(context.Background(), db, agentSignup{Workspace: "cats"}); id != avatar.ID {
+		t.Errorf("default avatar for cats = %q, want the upload %q", id, avatar.ID)
+	}
+}
+
+func rgba(img image.Image) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands are the administrative subcommands, run as "go run . <name> ...".
+var commands = map[string]struct {
+	usage string
+	run   func(db Store, args []string) error
+}{
+	"migrate":        {"migrate", migrateCommand},
+	"delete-agent":   {"delete-agent <email>", deleteAgentCommand},
+	"add-account":    {"add-account [-slack-user U…] <name> <admin|owner|viewer> [workspace...]", addAccountCommand},
+	"delete-account": {"delete-account <name>", deleteAccountCommand},
+}
+
+// runCommand runs the subcommand named by args[0].
+func runCommand(db Store, args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		var usages []string
+		for _, c := range commands {
+			usages = append(usages, "  "+c.usage)
+		}
+		sort.Strings(usages)
+		return fmt.Errorf("unknown command %q, available commands:\n%s", args[0], strings.Join(usages, "\n"))
+	}
+	return command.run(db, args[1:])
+}
+
+func migrateCommand(db Store, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: migrate")
+	}
+	if err := migrate(db); err != nil {
+		return err
+	}
+	recordAudit(db, AuditEntry{Actor: actorCLI, Action: auditStoreMigrate, Details: map[string]string{"version": fmt.Sprint(schemaVersion)}})
+	fmt.Printf("Store is at schema version %d\n", schemaVersion)
+	return nil
+}
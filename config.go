@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the endpoints and timeouts the server talks to. Every URL can
+// be overridden from the environment so the whole flow can be pointed at local
+// stand-ins instead of slack.com and the LLM provider.
+type config struct {
+	// SlackWorkspaceURL is the base of a workspace's own host; "{workspace}"
+	// is replaced by the workspace name.
+	SlackWorkspaceURL string
+	// SlackAPIURL is the base of the team-independent Web API.
+	SlackAPIURL string
+	// LLMBaseURL is the base of the OpenAI compatible chat completions API.
+	LLMBaseURL string
+	// LLMModel is the chat completions model of workspaces that do not pick
+	// their own.
+	LLMModel string
+	// LLMMaxTokens caps the length of a reply; long ones are split into
+	// several Slack messages.
+	LLMMaxTokens int
+	// AvatarURL, if set, serves an image used as the profile picture of new
+	// agents that have no uploaded avatar.
+	AvatarURL string
+	// ImageGeneratorURL, if set, is the image service agents' avatars are
+	// generated with from their appearance, see httpImageGenerator. Without
+	// it they get identicons.
+	ImageGeneratorURL string
+	// ProfileTitle, ProfileStatusText and ProfileStatusEmoji are set on every
+	// agent's profile so members can tell it is not a person.
+	ProfileTitle       string
+	ProfileStatusText  string
+	ProfileStatusEmoji string
+	// NameTemplate names agents when neither the invite nor the workspace
+	// give one, see NameData.
+	NameTemplate string
+	// OnboardingWebhookURL, if set, is sent every failed onboarding as JSON,
+	// see notifyOnboardingFailed.
+	OnboardingWebhookURL string
+	// HistoryMessages and HistoryChars bound the channel history sent with
+	// a reply, unless the workspace config sets its own.
+	HistoryMessages int
+	HistoryChars    int
+	// EmbeddingURL, if set, is the base of the OpenAI compatible embeddings
+	// API knowledge base documents are embedded with, using EmbeddingModel.
+	// Without it they are embedded by feature hashing.
+	EmbeddingURL   string
+	EmbeddingModel string
+	// KnowledgeResults is how many knowledge base excerpts a reply is given,
+	// unless the workspace config sets its own.
+	KnowledgeResults int
+	// AgentTimezone is the time zone of agents that were not given one.
+	AgentTimezone string
+	// UserCacheTTL is how long display names looked up with users.info are
+	// reused.
+	UserCacheTTL time.Duration
+	// RequestTimeout bounds every outgoing HTTP request.
+	RequestTimeout time.Duration
+	// VerificationTimeout bounds how long signup waits for the emailed code.
+	VerificationTimeout time.Duration
+	// TokenCheckInterval is how often every stored token is validated.
+	TokenCheckInterval time.Duration
+	// QueueCheckInterval is how often each agent looks for messages it
+	// queued outside working hours.
+	QueueCheckInterval time.Duration
+	// SchedulerInterval is how often due scheduled jobs are looked for, and
+	// JobLease how long a replica may take to run one before another may.
+	SchedulerInterval time.Duration
+	JobLease          time.Duration
+}
+
+var cfg = loadConfig()
+
+func loadConfig() config {
+	return config{
+		SlackWorkspaceURL:    getenv("SLACK_WORKSPACE_URL", "https://{workspace}.slack.com"),
+		SlackAPIURL:          getenv("SLACK_API_URL", "https://slack.com/api"),
+		LLMBaseURL:           getenv("LLM_BASE_URL", "https://api.groq.com/openai/v1"),
+		LLMModel:             getenv("LLM_MODEL", "mixtral-8x7b-32768"),
+		LLMMaxTokens:         getenvInt("LLM_MAX_TOKENS", 1024),
+		AvatarURL:            getenv("AVATAR_URL", ""),
+		ImageGeneratorURL:    getenv("IMAGE_GENERATOR_URL", ""),
+		ProfileTitle:         getenv("PROFILE_TITLE", "AI assistant"),
+		ProfileStatusText:    getenv("PROFILE_STATUS_TEXT", "AI assistant, replies are generated"),
+		ProfileStatusEmoji:   getenv("PROFILE_STATUS_EMOJI", ":robot_face:"),
+		NameTemplate:         getenv("NAME_TEMPLATE", "{{with .Owner}}{{.}}'s assistant{{else}}Assistant {{.Number}}{{end}}"),
+		OnboardingWebhookURL: getenv("ONBOARDING_WEBHOOK_URL", ""),
+		HistoryMessages:      getenvInt("HISTORY_MESSAGES", 10),
+		HistoryChars:         getenvInt("HISTORY_CHARS", 4000),
+		EmbeddingURL:         getenv("EMBEDDING_URL", ""),
+		EmbeddingModel:       getenv("EMBEDDING_MODEL", "text-embedding-3-small"),
+		KnowledgeResults:     getenvInt("KNOWLEDGE_RESULTS", 3),
+		AgentTimezone:        getenv("AGENT_TIMEZONE", "America/Los_Angeles"),
+		UserCacheTTL:         getenvDuration("USER_CACHE_TTL", time.Hour),
+		RequestTimeout:       getenvDuration("HTTP_TIMEOUT", 30*time.Second),
+		VerificationTimeout:  getenvDuration("VERIFICATION_TIMEOUT", 10*time.Minute),
+		TokenCheckInterval:   getenvDuration("TOKEN_CHECK_INTERVAL", time.Hour),
+		QueueCheckInterval:   getenvDuration("QUEUE_CHECK_INTERVAL", time.Minute),
+		SchedulerInterval:    getenvDuration("SCHEDULER_INTERVAL", 30*time.Second),
+		JobLease:             getenvDuration("JOB_LEASE", 5*time.Minute),
+	}
+}
+
+// workspaceAPIURL returns the Web API base for requests that must be sent to
+// the workspace's own host, such as the signup calls.
+func (c config) workspaceAPIURL(workspace string) string {
+	return strings.TrimSuffix(strings.ReplaceAll(c.SlackWorkspaceURL, "{workspace}", workspace), "/") + "/api"
+}
+
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getenvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("\033[1;31mInvalid number %q for %s, using %d\033[0m", value, key, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("\033[1;31mInvalid duration %q for %s, using %s: %v\033[0m", value, key, fallback, err)
+		return fallback
+	}
+	return d
+}
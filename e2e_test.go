@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInviteToAgentReply(t *testing.T) {
+	db := newTestStore(t)
+
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.llmReply = "The answer is **42**."
+	fake.rateLimit["chat.postMessage"] = 1
+	fake.events = []map[string]interface{}{
+		{"type": "message", "channel": "C0001", "user": "U9000", "text": "not a DM"},
+		{"type": "message", "subtype": "message_changed", "channel": "D0001", "user": "U9000", "text": "edited"},
+		{"type": "message", "channel": "D0001", "user": "U9000", "text": "What is the answer?", "ts": "1700000001.000200", "thread_ts": "1700000000.000100"},
+		{"type": "message", "channel": "C0000CATS", "user": "U9000", "text": "<@U0001> and the question?", "ts": "1700000002.000300"},
+		{"type": "message", "channel": "C0000CATS", "user": "U9000", "text": "no mention here", "ts": "1700000003.000400"},
+	}
+	// What was said in the channel before the mention
+	fake.history["C0000CATS"] = []map[string]interface{}{
+		{"type": "message", "user": "U9000", "text": "What's six times seven?", "ts": "1700000000.000900"},
+		{"type": "message", "user": "U9000", "text": "<@U0001> and the question?", "ts": "1700000002.000300"},
+	}
+	fake.names["U9000"] = "Arthur"
+
+	token := newTestAccount(t, db, "owner", roleOwner, "e2e")
+	runner := newAgentRunner()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", webhookHandler)
+	mux.HandleFunc("/invite", slackInviteHandler(db))
+	mux.HandleFunc("DELETE /agents/{email}", deleteAgentHandler(db, runner))
+	mux.HandleFunc("PUT /workspaces/{name}/config", putConfigHandler(db))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Stand in for the email worker: forward the emailed code to the webhook
+	fake.onVerificationEmail = func(email, code string) {
+		body, _ := json.Marshal(VerificationCode{Email: email, Code: code})
+		resp, err := http.Post(server.URL+"/webhook", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("posting verification code: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	workspace := "e2e"
+	invite := SlackInvite{
+		InviteURL:  "https://join.slack.com/t/" + workspace + "/shared_invite/zt-test",
+		ClientURL:  "https://app.slack.com/client/T07Q4VBFFHP/U07PRIMARY",
+		Name:       "Test Agent",
+		Appearance: "a friendly robot",
+		System:     "Be helpful.",
+		OwnerField: "Xf0OWNER",
+		Timezone:   "Europe/Berlin",
+	}
+	body, _ := json.Marshal(invite)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/invite", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("posting invite: %v", err)
+	}
+	reply, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(string(reply), "New user created successfully") {
+		t.Fatalf("invite response = %d %q", resp.StatusCode, reply)
+	}
+
+	var agent UserCredential
+	for _, user := range retrieveAllUsers(db) {
+		if user.Workspace == workspace {
+			agent = user
+		}
+	}
+	if agent.APIToken == "" {
+		t.Fatalf("no credentials stored for workspace %s", workspace)
+	}
+
+	agents, err := listWorkspaceAgents(db, workspace)
+	if err != nil || len(agents) != 1 || agents[0].Email != agent.Email || agents[0].Name != "Test Agent" {
+		t.Errorf("workspace agents = %+v, %v", agents, err)
+	}
+	history, err := listOnboardingHistory(db, workspace)
+	if err != nil || len(history) != 2 || history[0].Status != onboardingRequested || history[1].Status != onboardingCreated {
+		t.Errorf("onboarding history = %+v, %v", history, err)
+	}
+
+	if got := fake.callCount("chat.postMessage"); got != 3 {
+		t.Errorf("chat.postMessage called %d times, want one throttled call, its retry and the owner's DM", got)
+	}
+	if posted := fake.postedMessages(); len(posted) != 2 || posted[0].Get("token") != agent.APIToken {
+		t.Errorf("initial messages not posted by the new agent: %v", posted)
+	} else {
+		if posted[0].Get("channel") != "C0GENERAL" || posted[0].Get("text") != "Hello, I'm Test Agent, a new assistant set up by <@U07PRIMARY>!" {
+			t.Errorf("welcome message = %v", posted[0])
+		}
+		if posted[1].Get("channel") != "D07PRIMARY" || !strings.HasPrefix(posted[1].Get("text"), "Hi <@U07PRIMARY>, I'm Test Agent and I'm ready in e2e.") {
+			t.Errorf("ready message = %v, want a DM to the owner", posted[1])
+		}
+	}
+	userID, _ := fake.userForToken(agent.APIToken)
+	profile := fake.profile(userID)
+	if profile["title"] != "AI assistant" || profile["status_emoji"] != ":robot_face:" {
+		t.Errorf("agent profile = %v, want it marked as an AI assistant", profile)
+	}
+	if owner, _ := json.Marshal(profile["fields"]); string(owner) != `{"Xf0OWNER":{"alt":"","value":"U07PRIMARY"}}` {
+		t.Errorf("owner field = %s", owner)
+	}
+	// The invite's owner field was for this agent, not the workspace
+	stored, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadWorkspace(tr, workspace)
+	})
+	if ws := stored.(*Workspace); ws == nil || ws.OwnerField != "" {
+		t.Errorf("invite settings stored on the workspace: %+v", ws)
+	}
+	if tz := fake.timezone(userID); tz != "Europe/Berlin" || agent.Timezone != tz || agent.Schedule != nil {
+		t.Errorf("agent time zone = %q, stored %q, schedule %+v, want the invite's and always available", tz, agent.Timezone, agent.Schedule)
+	}
+	if agent.Appearance != "a friendly robot" || agent.Avatar == "" {
+		t.Errorf("agent appearance = %q, avatar = %q, want one generated from the invite", agent.Appearance, agent.Avatar)
+	} else if _, data, err := loadAvatar(db, agent.Avatar); err != nil || !bytes.Equal(fake.photo(userID), data) {
+		t.Errorf("Slack photo is not the generated avatar: %v", err)
+	}
+	if joined := fake.joinedChannels(); len(joined) != 1 || joined[0] != "C0GENERAL" {
+		t.Errorf("agent joined %v, want the general channel", joined)
+	}
+
+	// The agent answers mentions in #cats with the workspace's model
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/workspaces/"+workspace+"/config", strings.NewReader(`{"allowed_channels": ["C0000CATS"], "model": "llama-3.1-8b-instant"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT config = %v, %v", resp, err)
+	}
+
+	runner.start(db, agent)
+
+	waitFor(t, 5*time.Second, "agent reply", func() bool { return len(fake.postedMessages()) > 3 })
+	time.Sleep(100 * time.Millisecond)
+	replies := fake.postedMessages()[2:]
+	if len(replies) != 2 {
+		t.Fatalf("agent posted %d replies, want a reply to the DM and the mention: %v", len(replies), replies)
+	}
+	if replies[0].Get("channel") != "D0001" || replies[0].Get("thread_ts") != "1700000000.000100" || replies[0].Get("text") != "The answer is *42*." {
+		t.Errorf("agent reply = %v", replies[0])
+	}
+	if replies[1].Get("channel") != "C0000CATS" || replies[1].Get("thread_ts") != "1700000002.000300" {
+		t.Errorf("agent reply to the mention = %v, want it in a thread on the message", replies[1])
+	}
+	if calls := fake.llmRequests(); len(calls) != 2 {
+		t.Errorf("LLM called %d times, want twice", len(calls))
+	} else {
+		if system := calls[0]["messages"].([]interface{})[0].(map[string]interface{}); system["content"] != "Be helpful." {
+			t.Errorf("LLM system message = %v, want the invite's prompt", system)
+		}
+		messages := calls[1]["messages"].([]interface{})
+		if user := messages[len(messages)-1].(map[string]interface{}); user["content"] != "and the question?" || calls[1]["model"] != "llama-3.1-8b-instant" {
+			t.Errorf("LLM request for the mention = %v, want the mention removed and the workspace's model", calls[1])
+		}
+		if len(messages) != 3 || messages[1].(map[string]interface{})["content"] != "Arthur: What's six times seven?" {
+			t.Errorf("LLM request for the mention = %v, want the earlier channel message as context", messages)
+		}
+		if len(calls[0]["messages"].([]interface{})) != 2 {
+			t.Errorf("LLM request for the DM = %v, want no channel history", calls[0])
+		}
+	}
+	if frames := fake.rtmFrames(); len(frames) != 0 {
+		t.Errorf("agent wrote to the RTM socket instead of using chat.postMessage: %v", frames)
+	}
+
+	// Offboard the agent again
+	req, _ = http.NewRequest(http.MethodDelete, server.URL+"/agents/"+agent.Email, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("deleting agent: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /agents status = %d", resp.StatusCode)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		runner.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message handler did not stop after the agent was deleted")
+	}
+	if _, ok := fake.userForToken(agent.APIToken); ok {
+		t.Error("agent token was not revoked")
+	}
+	if users := retrieveAllUsers(db); len(users) != 0 {
+		t.Errorf("users left after delete: %+v", users)
+	}
+	if agents, _ := listWorkspaceAgents(db, workspace); len(agents) != 0 {
+		t.Errorf("workspace still lists agents after delete: %+v", agents)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeSlack is a local stand-in for the parts of the Slack Web API, the RTM
+// websocket and the LLM endpoint that the server talks to. Point cfg at its
+// URL with useFakeSlack and it will record what the code under test sent.
+type fakeSlack struct {
+	t      *testing.T
+	server *httptest.Server
+
+	// onVerificationEmail is called with the address and code whenever the
+	// fake would have emailed a confirmation code.
+	onVerificationEmail func(email, code string)
+	// events are written to every RTM websocket right after it connects.
+	events []map[string]interface{}
+	// llmReply is the content returned for every chat completion, after
+	// llmDelay.
+	llmReply string
+	llmDelay time.Duration
+	// rateLimit holds the number of times each method answers 429 before
+	// succeeding.
+	rateLimit map[string]int
+	// channels are listed by conversations.list, one per page.
+	channels []map[string]interface{}
+	// history holds the messages of each channel, oldest first, for
+	// conversations.history and conversations.replies.
+	history map[string][]map[string]interface{}
+	// names are the display names users.info knows, by user ID.
+	names map[string]string
+
+	mu       sync.Mutex
+	codes    map[string]string
+	tokens   map[string]string
+	calls    map[string]int
+	posted   []url.Values
+	joined   []string
+	profiles map[string]map[string]interface{}
+	photos   map[string][]byte
+	zones    map[string]string
+	rtmSent  []map[string]interface{}
+	llmCalls []map[string]interface{}
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{
+		t:         t,
+		llmReply:  "Don't panic.",
+		rateLimit: make(map[string]int),
+		codes:     make(map[string]string),
+		tokens:    make(map[string]string),
+		calls:     make(map[string]int),
+		profiles:  make(map[string]map[string]interface{}),
+		photos:    make(map[string][]byte),
+		zones:     make(map[string]string),
+		history:   make(map[string][]map[string]interface{}),
+		names:     make(map[string]string),
+		channels: []map[string]interface{}{
+			{"id": "C0000CATS", "name": "cats"},
+			{"id": "C0GENERAL", "name": "general", "is_general": true},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/signup.checkEmail", f.checkEmail)
+	mux.HandleFunc("/api/signup.confirmEmail", f.confirmEmail)
+	mux.HandleFunc("/api/signin.confirmCode", f.confirmCode)
+	mux.HandleFunc("/api/signup.createUser", f.createUser)
+	mux.HandleFunc("/api/users.setPhoto", f.setPhoto)
+	mux.HandleFunc("/api/users.profile.set", f.setProfile)
+	mux.HandleFunc("/api/chat.postMessage", f.postMessage)
+	mux.HandleFunc("/api/conversations.list", f.conversationsList)
+	mux.HandleFunc("/api/conversations.join", f.conversationsJoin)
+	mux.HandleFunc("/api/conversations.open", f.conversationsOpen)
+	mux.HandleFunc("/api/conversations.history", f.conversationsHistory)
+	mux.HandleFunc("/api/conversations.replies", f.conversationsReplies)
+	mux.HandleFunc("/api/users.info", f.usersInfo)
+	mux.HandleFunc("/api/rtm.connect", f.rtmConnect)
+	mux.HandleFunc("/api/auth.revoke", f.authRevoke)
+	mux.HandleFunc("/api/auth.test", f.authTest)
+	mux.HandleFunc("/rtm", f.rtm)
+	mux.HandleFunc("/llm/chat/completions", f.chatCompletions)
+	mux.HandleFunc("/avatar", f.avatar)
+
+	f.server = httptest.NewServer(f.counting(mux))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// useFakeSlack points every configured endpoint at f for the rest of the test.
+func useFakeSlack(t *testing.T, f *fakeSlack) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	// A new fake is a new Slack: forget the names and rate limits of the last.
+	userNames = &userNameCache{names: make(map[string]cachedName)}
+	defaultSlackClient = newSlackClient()
+
+	cfg.SlackWorkspaceURL = f.server.URL
+	cfg.SlackAPIURL = f.server.URL + "/api"
+	cfg.LLMBaseURL = f.server.URL + "/llm"
+	cfg.AvatarURL = f.server.URL + "/avatar"
+	t.Setenv("GROQ_API_KEY", "test-key")
+}
+
+func (f *fakeSlack) counting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/api/")
+
+		f.mu.Lock()
+		f.calls[method]++
+		limited := f.rateLimit[method] > 0
+		if limited {
+			f.rateLimit[method]--
+		}
+		f.mu.Unlock()
+
+		if limited {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *fakeSlack) reply(w http.ResponseWriter, result map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeSlack) fail(w http.ResponseWriter, slackError string) {
+	f.reply(w, map[string]interface{}{"ok": false, "error": slackError})
+}
+
+// requireSignupCookie checks that the cookie handed out by checkEmail is
+// carried through the rest of the signup.
+func (f *fakeSlack) requireSignupCookie(w http.ResponseWriter, r *http.Request) bool {
+	if _, err := r.Cookie("b"); err != nil {
+		f.fail(w, "missing_cookie")
+		return false
+	}
+	return true
+}
+
+func (f *fakeSlack) checkEmail(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "b", Value: "browser", Path: "/"})
+	f.reply(w, map[string]interface{}{"ok": true})
+}
+
+func (f *fakeSlack) confirmEmail(w http.ResponseWriter, r *http.Request) {
+	if !f.requireSignupCookie(w, r) {
+		return
+	}
+	email := r.FormValue("email")
+	code := fmt.Sprintf("%03d-%03d", len(email), time.Now().Nanosecond()%1000)
+
+	f.mu.Lock()
+	f.codes[email] = strings.ReplaceAll(code, "-", "")
+	f.mu.Unlock()
+
+	if f.onVerificationEmail != nil {
+		go f.onVerificationEmail(email, code)
+	}
+	f.reply(w, map[string]interface{}{"ok": true})
+}
+
+func (f *fakeSlack) confirmCode(w http.ResponseWriter, r *http.Request) {
+	if !f.requireSignupCookie(w, r) {
+		return
+	}
+	f.mu.Lock()
+	want, ok := f.codes[r.FormValue("email")]
+	f.mu.Unlock()
+	if !ok || want != r.FormValue("code") {
+		f.fail(w, "invalid_code")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "x", Value: "confirmed", Path: "/"})
+	f.reply(w, map[string]interface{}{"ok": true})
+}
+
+func (f *fakeSlack) createUser(w http.ResponseWriter, r *http.Request) {
+	if !f.requireSignupCookie(w, r) {
+		return
+	}
+	if _, err := r.Cookie("x"); err != nil {
+		f.fail(w, "not_confirmed")
+		return
+	}
+
+	f.mu.Lock()
+	userID := fmt.Sprintf("U%04d", len(f.tokens)+1)
+	token := "xoxp-" + userID
+	f.tokens[token] = userID
+	f.zones[userID] = r.FormValue("tz")
+	f.mu.Unlock()
+
+	f.reply(w, map[string]interface{}{"ok": true, "user_id": userID, "api_token": token})
+}
+
+// timezone returns the tz the user with userID signed up with.
+func (f *fakeSlack) timezone(userID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.zones[userID]
+}
+
+func (f *fakeSlack) userForToken(token string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	userID, ok := f.tokens[token]
+	return userID, ok
+}
+
+func (f *fakeSlack) setPhoto(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		f.fail(w, "invalid_form_data")
+		return
+	}
+	userID, ok := f.userForToken(r.FormValue("token"))
+	if !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		f.fail(w, "no_image")
+		return
+	}
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	f.mu.Lock()
+	f.photos[userID] = data
+	f.mu.Unlock()
+	f.reply(w, map[string]interface{}{"ok": true})
+}
+
+// photo returns the image last set with users.setPhoto for userID.
+func (f *fakeSlack) photo(userID string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.photos[userID]
+}
+
+func (f *fakeSlack) setProfile(w http.ResponseWriter, r *http.Request) {
+	userID, ok := f.userForToken(r.FormValue("token"))
+	if !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	var profile map[string]interface{}
+	if err := json.Unmarshal([]byte(r.FormValue("profile")), &profile); err != nil {
+		f.fail(w, "invalid_profile")
+		return
+	}
+	f.mu.Lock()
+	f.profiles[userID] = profile
+	f.mu.Unlock()
+	f.reply(w, map[string]interface{}{"ok": true, "profile": profile})
+}
+
+func (f *fakeSlack) profile(userID string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.profiles[userID]
+}
+
+func (f *fakeSlack) postMessage(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if _, ok := f.userForToken(r.FormValue("token")); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	f.mu.Lock()
+	f.posted = append(f.posted, r.PostForm)
+	f.mu.Unlock()
+	f.reply(w, map[string]interface{}{"ok": true, "channel": r.FormValue("channel"), "ts": "1700000000.000100"})
+}
+
+func (f *fakeSlack) conversationsList(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.userForToken(r.FormValue("token")); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	page, _ := strconv.Atoi(r.FormValue("cursor"))
+	next := ""
+	if page+1 < len(f.channels) {
+		next = strconv.Itoa(page + 1)
+	}
+	f.reply(w, map[string]interface{}{
+		"ok":                true,
+		"channels":          f.channels[page : page+1],
+		"response_metadata": map[string]interface{}{"next_cursor": next},
+	})
+}
+
+func (f *fakeSlack) conversationsJoin(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.userForToken(r.FormValue("token")); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	f.mu.Lock()
+	f.joined = append(f.joined, r.FormValue("channel"))
+	f.mu.Unlock()
+	f.reply(w, map[string]interface{}{"ok": true, "channel": map[string]interface{}{"id": r.FormValue("channel")}})
+}
+
+// conversationsOpen answers with D<rest of the user ID> as the DM channel.
+func (f *fakeSlack) conversationsOpen(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.userForToken(r.FormValue("token")); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	users := r.FormValue("users")
+	if users == "" || strings.Contains(users, ",") {
+		f.fail(w, "user_not_found")
+		return
+	}
+	f.reply(w, map[string]interface{}{"ok": true, "channel": map[string]interface{}{"id": "D" + users[1:]}})
+}
+
+// conversationsHistory answers with the top-level messages of a channel
+// before latest, newest first, like Slack.
+func (f *fakeSlack) conversationsHistory(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.userForToken(r.FormValue("token")); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	latest, limit := r.FormValue("latest"), 100
+	if n, err := strconv.Atoi(r.FormValue("limit")); err == nil {
+		limit = n
+	}
+	messages := []map[string]interface{}{}
+	history := f.history[r.FormValue("channel")]
+	for i := len(history) - 1; i >= 0 && len(messages) < limit; i-- {
+		m := history[i]
+		if thread, ok := m["thread_ts"]; ok && thread != m["ts"] {
+			continue
+		}
+		if latest == "" || m["ts"].(string) < latest {
+			messages = append(messages, m)
+		}
+	}
+	f.reply(w, map[string]interface{}{"ok": true, "messages": messages})
+}
+
+// conversationsReplies answers with the parent and replies of the thread
+// ts, oldest first.
+func (f *fakeSlack) conversationsReplies(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.userForToken(r.FormValue("token")); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	ts := r.FormValue("ts")
+	messages := []map[string]interface{}{}
+	for _, m := range f.history[r.FormValue("channel")] {
+		if m["ts"] == ts || m["thread_ts"] == ts {
+			messages = append(messages, m)
+		}
+	}
+	f.reply(w, map[string]interface{}{"ok": true, "messages": messages})
+}
+
+func (f *fakeSlack) usersInfo(w http.ResponseWriter, r *http.Request) {
+	if _, ok := f.userForToken(r.FormValue("token")); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	name, ok := f.names[r.FormValue("user")]
+	if !ok {
+		f.fail(w, "user_not_found")
+		return
+	}
+	f.reply(w, map[string]interface{}{"ok": true, "user": map[string]interface{}{
+		"id":      r.FormValue("user"),
+		"name":    strings.ToLower(name),
+		"profile": map[string]interface{}{"display_name": name},
+	}})
+}
+
+func (f *fakeSlack) joinedChannels() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.joined...)
+}
+
+func (f *fakeSlack) rtmConnect(w http.ResponseWriter, r *http.Request) {
+	userID, ok := f.userForToken(r.FormValue("token"))
+	if !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	wsURL := "ws" + strings.TrimPrefix(f.server.URL, "http") + "/rtm"
+	f.reply(w, map[string]interface{}{
+		"ok":   true,
+		"url":  wsURL,
+		"self": map[string]interface{}{"id": userID},
+	})
+}
+
+func (f *fakeSlack) authTest(w http.ResponseWriter, r *http.Request) {
+	userID, ok := f.userForToken(r.FormValue("token"))
+	if !ok {
+		f.fail(w, "token_revoked")
+		return
+	}
+	f.reply(w, map[string]interface{}{"ok": true, "user_id": userID})
+}
+
+func (f *fakeSlack) authRevoke(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if _, ok := f.userForToken(token); !ok {
+		f.fail(w, "invalid_auth")
+		return
+	}
+	f.mu.Lock()
+	delete(f.tokens, token)
+	f.mu.Unlock()
+	f.reply(w, map[string]interface{}{"ok": true, "revoked": true})
+}
+
+func (f *fakeSlack) rtm(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		f.t.Errorf("fake rtm upgrade: %v", err)
+		return
+	}
+	defer c.Close()
+
+	c.WriteJSON(map[string]interface{}{"type": "hello"})
+	for _, event := range f.events {
+		if err := c.WriteJSON(event); err != nil {
+			return
+		}
+	}
+
+	for {
+		var frame map[string]interface{}
+		if err := c.ReadJSON(&frame); err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.rtmSent = append(f.rtmSent, frame)
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeSlack) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer test-key" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var payload map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.llmCalls = append(f.llmCalls, payload)
+	f.mu.Unlock()
+	time.Sleep(f.llmDelay)
+
+	f.reply(w, map[string]interface{}{
+		"choices": []interface{}{
+			map[string]interface{}{
+				"message": map[string]interface{}{"role": "assistant", "content": f.llmReply},
+			},
+		},
+	})
+}
+
+func (f *fakeSlack) avatar(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, testImage(300, 200))
+}
+
+// testImage returns a width x height gradient.
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	return img
+}
+
+func (f *fakeSlack) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeSlack) postedMessages() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.posted...)
+}
+
+func (f *fakeSlack) llmRequests() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]interface{}(nil), f.llmCalls...)
+}
+
+func (f *fakeSlack) rtmFrames() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]interface{}(nil), f.rtmSent...)
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Upper bounds for History, whatever a workspace asks for.
+const (
+	maxHistoryMessages = 100
+	maxHistoryChars    = 32000
+	// maxThreadReplies is how much of a thread one conversations.replies
+	// page brings back; longer threads are seen from their start
+	maxThreadReplies = 200
+)
+
+// History bounds the earlier messages of a channel or thread that are sent
+// to the LLM with each channel reply.
+type History struct {
+	// Messages is how many are included; 0 uses HISTORY_MESSAGES.
+	Messages int `json:"messages,omitempty"`
+	// MaxChars caps their total length, dropping the oldest first; 0 uses
+	// HISTORY_CHARS.
+	MaxChars int `json:"max_chars,omitempty"`
+	// Disabled sends the triggering message alone.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+func (h History) messages() int {
+	if h.Messages > 0 {
+		return h.Messages
+	}
+	return cfg.HistoryMessages
+}
+
+func (h History) maxChars() int {
+	if h.MaxChars > 0 {
+		return h.MaxChars
+	}
+	return cfg.HistoryChars
+}
+
+// slackMessage is a message as conversations.history and
+// conversations.replies return it.
+type slackMessage struct {
+	User     string `json:"user"`
+	Username string `json:"username"`
+	BotID    string `json:"bot_id"`
+	Subtype  string `json:"subtype"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+}
+
+// conversational reports whether the message is something someone said,
+// rather than a join, topic change or the like.
+func (m slackMessage) conversational() bool {
+	return m.Subtype == "" || m.Subtype == "bot_message" || m.Subtype == "thread_broadcast"
+}
+
+// before reports whether ts sorts before the Slack timestamp other; an
+// empty other is the present.
+func before(ts, other string) bool {
+	if other == "" {
+		return true
+	}
+	a, err1 := strconv.ParseFloat(ts, 64)
+	b, err2 := strconv.ParseFloat(other, 64)
+	return err1 == nil && err2 == nil && a < b
+}
+
+// fetchMessages calls conversations.history or conversations.replies.
+func fetchMessages(ctx context.Context, session *slackSession, method string, data url.Values) ([]slackMessage, error) {
+	resp, err := session.post(ctx, method, data)
+	if err != nil {
+		return nil, fmt.Errorf("error calling %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK       bool           `json:"ok"`
+		Error    string         `json:"error"`
+		Messages []slackMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing %s response: %v", method, err)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("%s failed: %s", method, result.Error)
+	}
+	return result.Messages, nil
+}
+
+// recentMessages returns up to limit messages posted before message in its
+// thread, or in its channel if it is not in one, oldest first.
+func recentMessages(ctx context.Context, session *slackSession, token string, message QueuedMessage, limit int) ([]slackMessage, error) {
+	data := url.Values{}
+	data.Set("token", token)
+	data.Set("channel", message.Channel)
+	var found []slackMessage
+	if message.ThreadTS != "" && message.ThreadTS != message.TS {
+		// Replies come oldest first, starting with the thread's parent
+		data.Set("ts", message.ThreadTS)
+		data.Set("limit", strconv.Itoa(maxThreadReplies))
+		replies, err := fetchMessages(ctx, session, "conversations.replies", data)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range replies {
+			if m.conversational() && before(m.TS, message.TS) {
+				found = append(found, m)
+			}
+		}
+	} else {
+		// History comes newest first and excludes latest itself
+		if message.TS != "" {
+			data.Set("latest", message.TS)
+		}
+		data.Set("limit", strconv.Itoa(limit))
+		history, err := fetchMessages(ctx, session, "conversations.history", data)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].conversational() {
+				found = append(found, history[i])
+			}
+		}
+	}
+	if len(found) > limit {
+		found = found[len(found)-limit:]
+	}
+	return found, nil
+}
+
+// userNameCache remembers display names looked up with users.info for
+// cfg.UserCacheTTL, so busy channels do not cost a call per message.
+type userNameCache struct {
+	mu    sync.Mutex
+	names map[string]cachedName
+}
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+var userNames = &userNameCache{names: make(map[string]cachedName)}
+
+// name returns how the user with userID shows up in the session's
+// workspace, their ID if it cannot be looked up.
+func (c *userNameCache) name(ctx context.Context, session *slackSession, token, userID string) string {
+	key := session.workspace + "/" + userID
+	c.mu.Lock()
+	cached, ok := c.names[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.name
+	}
+
+	name, err := lookupUserName(ctx, session, token, userID)
+	if err != nil {
+		log.Printf("\033[1;31mError looking up user %s: %v\033[0m", userID, err)
+		return userID
+	}
+	c.mu.Lock()
+	c.names[key] = cachedName{name: name, expires: time.Now().Add(cfg.UserCacheTTL)}
+	c.mu.Unlock()
+	return name
+}
+
+// lookupUserName calls users.info, preferring the display name the way the
+// Slack client does.
+func lookupUserName(ctx context.Context, session *slackSession, token, userID string) (string, error) {
+	data := url.Values{}
+	data.Set("token", token)
+	data.Set("user", userID)
+	resp, err := session.post(ctx, "users.info", data)
+	if err != nil {
+		return "", fmt.Errorf("error calling users.info: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		User  struct {
+			Name     string `json:"name"`
+			RealName string `json:"real_name"`
+			Profile  struct {
+				DisplayName string `json:"display_name"`
+				RealName    string `json:"real_name"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error parsing users.info response: %v", err)
+	}
+	if !result.OK {
+		return "", fmt.Errorf("users.info failed: %s", result.Error)
+	}
+	for _, name := range []string{result.User.Profile.DisplayName, result.User.Profile.RealName, result.User.RealName, result.User.Name} {
+		if name != "" {
+			return name, nil
+		}
+	}
+	return userID, nil
+}
+
+var mentionPattern = regexp.MustCompile(`<@([UW][A-Z0-9]+)(?:\|[^>]*)?>`)
+
+// channelHistory returns the messages before message as chat messages,
+// bounded by config: the agent's own as the assistant's, everyone else's as
+// the user's prefixed with their name, and mentions spelled out as @name.
+func channelHistory(ctx context.Context, session *slackSession, user *UserCredential, config *WorkspaceConfig, message QueuedMessage) ([]chatMessage, error) {
+	messages, err := recentMessages(ctx, session, user.APIToken, message, config.History.messages())
+	if err != nil {
+		return nil, err
+	}
+	var history []chatMessage
+	for _, m := range messages {
+		text := mentionPattern.ReplaceAllStringFunc(m.Text, func(mention string) string {
+			return "@" + userNames.name(ctx, session, user.APIToken, mentionPattern.FindStringSubmatch(mention)[1])
+		})
+		switch {
+		case m.User != "" && m.User == user.SlackID:
+			history = append(history, chatMessage{Role: "assistant", Content: text})
+		case m.User != "":
+			history = append(history, chatMessage{Role: "user", Content: userNames.name(ctx, session, user.APIToken, m.User) + ": " + text})
+		default:
+			name := m.Username
+			if name == "" {
+				name = "bot " + m.BotID
+			}
+			history = append(history, chatMessage{Role: "user", Content: name + ": " + text})
+		}
+	}
+
+	// Keep the newest that fit
+	total, limit := 0, config.History.maxChars()
+	for i := len(history) - 1; i >= 0; i-- {
+		total += len(history[i].Content)
+		if total > limit {
+			return history[i+1:], nil
+		}
+	}
+	return history, nil
+}
+
+// rememberSlackID stores the agent's own Slack user ID, which its messages
+// in a channel's history are told apart by.
+func rememberSlackID(db Store, email, slackID string) error {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		user, err := loadUser(tr, email)
+		if err != nil || user == nil || user.SlackID == slackID {
+			return nil, err
+		}
+		user.SlackID = slackID
+		value, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.users.Pack(tuple.Tuple{email}), value)
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error storing Slack ID of user %s: %v", email, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestChannelHistory(t *testing.T) {
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	fake.names["U07ALICE0"] = "Alice"
+	fake.names["U07BOB000"] = "Bob"
+	fake.history["C0000CATS"] = []map[string]interface{}{
+		{"user": "U07ALICE0", "subtype": "channel_join", "text": "<@U07ALICE0> has joined the channel", "ts": "1700000000.000100"},
+		{"user": "U07ALICE0", "text": "Has anyone seen <@U07BOB000>?", "ts": "1700000001.000100"},
+		{"user": "U0001", "text": "Not today, sorry.", "ts": "1700000002.000100"},
+		{"subtype": "bot_message", "username": "CI", "bot_id": "B01", "text": "Build failed", "ts": "1700000003.000100"},
+		{"user": "U07BOB000", "text": "Why did the build fail?", "ts": "1700000004.000100"},
+		{"user": "U07ALICE0", "text": "A flaky test", "ts": "1700000005.000100", "thread_ts": "1700000004.000100"},
+		{"user": "U07BOB000", "text": "<@U0001> which one?", "ts": "1700000006.000100", "thread_ts": "1700000004.000100"},
+		{"user": "U07ALICE0", "text": "Later message", "ts": "1700000007.000100"},
+	}
+	user := &UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", SlackID: "U0001"}
+	session := newSlackSession("cats")
+	config := &WorkspaceConfig{}
+	format := func(history []chatMessage) string {
+		return fmt.Sprint(history)
+	}
+
+	// A channel message sees what was posted before it, but not thread replies
+	history, err := channelHistory(context.Background(), session, user, config, QueuedMessage{Channel: "C0000CATS", TS: "1700000007.000100"})
+	want := "[{user Alice: Has anyone seen @Bob?} {assistant Not today, sorry.} {user CI: Build failed} {user Bob: Why did the build fail?}]"
+	if err != nil || format(history) != want {
+		t.Errorf("channel history = %v, %v, want %s", format(history), err, want)
+	}
+	if n := fake.callCount("users.info"); n != 2 {
+		t.Errorf("users.info called %d times, want once per user", n)
+	}
+
+	// A thread reply sees the thread
+	history, err = channelHistory(context.Background(), session, user, config, QueuedMessage{Channel: "C0000CATS", ThreadTS: "1700000004.000100", TS: "1700000006.000100"})
+	want = "[{user Bob: Why did the build fail?} {user Alice: A flaky test}]"
+	if err != nil || format(history) != want {
+		t.Errorf("thread history = %v, %v, want %s", format(history), err, want)
+	}
+
+	// Bounded by count, then by length, dropping the oldest
+	config.History = History{Messages: 2}
+	history, _ = channelHistory(context.Background(), session, user, config, QueuedMessage{Channel: "C0000CATS", TS: "1700000007.000100"})
+	if want := "[{user CI: Build failed} {user Bob: Why did the build fail?}]"; format(history) != want {
+		t.Errorf("history of 2 = %v, want %s", format(history), want)
+	}
+	config.History = History{MaxChars: len("CI: Build failed") + len("Bob: Why did the build fail?")}
+	history, _ = channelHistory(context.Background(), session, user, config, QueuedMessage{Channel: "C0000CATS", TS: "1700000007.000100"})
+	if want := "[{user CI: Build failed} {user Bob: Why did the build fail?}]"; format(history) != want {
+		t.Errorf("history of %d characters = %v, want %s", config.History.MaxChars, format(history), want)
+	}
+	if fake.callCount("users.info") != 2 {
+		t.Errorf("names were looked up again instead of cached")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header, which becomes
+// part of a key.
+const maxIdempotencyKeyLength = 200
+
+// claimMargin is how long past VERIFICATION_TIMEOUT a claim may stay
+// requested, for the rest of signup, before it counts as abandoned: the
+// process provisioning it died without finishing it.
+const claimMargin = 10 * time.Minute
+
+// InviteClaim records that an invite is being, or has been, turned into an
+// agent, so that submitting it again does not create a second one. Status is
+// one of the onboarding statuses.
+type InviteClaim struct {
+	Key       string    `json:"key"`
+	Workspace string    `json:"workspace"`
+	Email     string    `json:"email"`
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// inviteKey returns the idempotency key of an invite: the Idempotency-Key
+// header if the client sent one, else one derived from the workspace, the
+// owner and the requested name, so that the same form submitted twice
+// yields the same key.
+func inviteKey(r *http.Request, invite *SlackInvite) (string, error) {
+	if key := strings.TrimSpace(r.Header.Get("Idempotency-Key")); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			return "", fmt.Errorf("Idempotency-Key is longer than %d bytes", maxIdempotencyKeyLength)
+		}
+		return key, nil
+	}
+	name := strings.ToLower(strings.Join(strings.Fields(invite.Name), " "))
+	sum := sha256.Sum256([]byte(invite.Workspace + "\x00" + invite.PrimaryUser + "\x00" + name))
+	return "derived-" + hex.EncodeToString(sum[:16]), nil
+}
+
+// liveClaim returns the claim on key in workspace unless there is none, it
+// failed, it was abandoned while requested, or the agent it created has been
+// offboarded since; such keys can be claimed again.
+func liveClaim(tr ReadTx, workspace, key string) (*InviteClaim, error) {
+	value, err := tr.Get(ks.inviteKeys.Pack(tuple.Tuple{workspace, key}))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var claim InviteClaim
+	if err := json.Unmarshal(value, &claim); err != nil {
+		return nil, fmt.Errorf("error unmarshaling invite claim %s: %v", key, err)
+	}
+	switch claim.Status {
+	case onboardingFailed:
+		return nil, nil
+	case onboardingRequested:
+		if time.Since(claim.UpdatedAt) > cfg.VerificationTimeout+claimMargin {
+			return nil, nil
+		}
+	case onboardingCreated:
+		user, err := loadUser(tr, claim.Email)
+		if err != nil || user == nil {
+			return nil, err
+		}
+	}
+	return &claim, nil
+}
+
+// lookupInvite returns the live claim on key in workspace, if any.
+func lookupInvite(db Store, workspace, key string) (*InviteClaim, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return liveClaim(tr, workspace, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*InviteClaim), nil
+}
+
+// claimInvite claims key in workspace for a new agent with email. If another
+// invite got there first its claim is returned instead, and nothing is
+// written.
+func claimInvite(db Store, workspace, key, email string) (*InviteClaim, bool, error) {
+	type claimed struct {
+		claim *InviteClaim
+		fresh bool
+	}
+	result, err := db.Transact(func(tr Tx) (interface{}, error) {
+		existing, err := liveClaim(tr, workspace, key)
+		if err != nil || existing != nil {
+			return claimed{existing, false}, err
+		}
+		claim := &InviteClaim{Key: key, Workspace: workspace, Email: email, Status: onboardingRequested}
+		return claimed{claim, true}, saveClaim(tr, claim)
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("error claiming invite: %v", err)
+	}
+	c := result.(claimed)
+	return c.claim, c.fresh, nil
+}
+
+// finishInvite records how provisioning for the claim on key ended; email is
+// the agent it ended up with.
+func finishInvite(db Store, workspace, key, email, status string) error {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		return nil, saveClaim(tr, &InviteClaim{Key: key, Workspace: workspace, Email: email, Status: status})
+	})
+	if err != nil {
+		return fmt.Errorf("error updating invite claim: %v", err)
+	}
+	return nil
+}
+
+func saveClaim(tr Tx, claim *InviteClaim) error {
+	claim.UpdatedAt = time.Now().UTC()
+	value, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	tr.Set(ks.inviteKeys.Pack(tuple.Tuple{claim.Workspace, claim.Key}), value)
+	return nil
+}
+
+// findAgent returns the agent of workspace that owner already has under
+// name, compared ignoring case, or nil.
+func findAgent(db Store, workspace, owner, name string) (*UserCredential, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		ws, err := loadWorkspace(tr, workspace)
+		if err != nil || ws == nil {
+			return (*UserCredential)(nil), err
+		}
+		for _, email := range ws.Agents {
+			user, err := loadUser(tr, email)
+			if err != nil {
+				return nil, err
+			}
+			if user != nil && user.Owner == owner && strings.EqualFold(user.Name, name) {
+				return user, nil
+			}
+		}
+		return (*UserCredential)(nil), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*UserCredential), nil
+}
+
+// ExistingAgent is the response to an invite that had already been
+// submitted: the agent it created, or the one still being created.
+type ExistingAgent struct {
+	Status string       `json:"status"`
+	Key    string       `json:"idempotency_key"`
+	Agent  AgentSummary `json:"agent"`
+}
+
+// writeExistingAgent answers a repeated invite with the agent of claim,
+// with 409 Conflict while it is still being provisioned.
+func writeExistingAgent(w http.ResponseWriter, db Store, claim *InviteClaim) {
+	existing := ExistingAgent{Status: claim.Status, Key: claim.Key, Agent: AgentSummary{Email: claim.Email, Workspace: claim.Workspace}}
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadUser(tr, claim.Email)
+	})
+	if err == nil && result.(*UserCredential) != nil {
+		existing.Agent.Name = result.(*UserCredential).Name
+	}
+	if claim.Status == onboardingRequested {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(existing)
+		return
+	}
+	writeJSON(w, existing)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+func TestInviteKey(t *testing.T) {
+	key := func(header string, invite SlackInvite) string {
+		r := httptest.NewRequest(http.MethodPost, "/invite", nil)
+		if header != "" {
+			r.Header.Set("Idempotency-Key", header)
+		}
+		k, err := inviteKey(r, &invite)
+		if err != nil {
+			t.Fatalf("inviteKey: %v", err)
+		}
+		return k
+	}
+	marvin := SlackInvite{Workspace: "cats", PrimaryUser: "U07PRIMARY", Name: "Marvin"}
+	if key("", marvin) != key("", SlackInvite{Workspace: "cats", PrimaryUser: "U07PRIMARY", Name: "  marvin "}) {
+		t.Errorf("the same form got different keys")
+	}
+	if key("", marvin) == key("", SlackInvite{Workspace: "cats", PrimaryUser: "U07OTHER00", Name: "Marvin"}) {
+		t.Errorf("another owner got the same key")
+	}
+	if key("form-1", marvin) != "form-1" {
+		t.Errorf("the Idempotency-Key header was not used")
+	}
+	r := httptest.NewRequest(http.MethodPost, "/invite", nil)
+	r.Header.Set("Idempotency-Key", strings.Repeat("k", maxIdempotencyKeyLength+1))
+	if _, err := inviteKey(r, &marvin); err == nil {
+		t.Errorf("inviteKey accepted a too long header")
+	}
+}
+
+func TestInviteClaims(t *testing.T) {
+	db := newTestStore(t)
+
+	if _, fresh, err := claimInvite(db, "cats", "k", "a@example.com"); err != nil || !fresh {
+		t.Fatalf("first claim: fresh %v, %v", fresh, err)
+	}
+	claim, fresh, err := claimInvite(db, "cats", "k", "b@example.com")
+	if err != nil || fresh || claim.Email != "a@example.com" || claim.Status != onboardingRequested {
+		t.Errorf("second claim = %+v, fresh %v, %v, want the pending first one", claim, fresh, err)
+	}
+
+	// A failed invite can be tried again
+	finishInvite(db, "cats", "k", "a@example.com", onboardingFailed)
+	if claim, err := lookupInvite(db, "cats", "k"); err != nil || claim != nil {
+		t.Errorf("failed claim is still live: %+v, %v", claim, err)
+	}
+
+	// and one left requested by a process that died while signing up
+	claimInvite(db, "cats", "stale", "lost@example.com")
+	db.Transact(func(tr Tx) (interface{}, error) {
+		value, _ := json.Marshal(InviteClaim{Key: "stale", Workspace: "cats", Email: "lost@example.com", Status: onboardingRequested,
+			UpdatedAt: time.Now().UTC().Add(-cfg.VerificationTimeout - claimMargin - time.Minute)})
+		tr.Set(ks.inviteKeys.Pack(tuple.Tuple{"cats", "stale"}), value)
+		return nil, nil
+	})
+	if claim, fresh, err := claimInvite(db, "cats", "stale", "again@example.com"); err != nil || !fresh || claim.Email != "again@example.com" {
+		t.Errorf("claim over an abandoned one = %+v, fresh %v, %v, want a fresh claim", claim, fresh, err)
+	}
+
+	// So can one whose agent has been offboarded since
+	finishInvite(db, "cats", "k", "gone@example.com", onboardingCreated)
+	if claim, err := lookupInvite(db, "cats", "k"); err != nil || claim != nil {
+		t.Errorf("claim of a deleted agent is still live: %+v, %v", claim, err)
+	}
+	storeUserCredentials(db, UserCredential{Email: "gone@example.com", Workspace: "cats"}, "T1")
+	if claim, err := lookupInvite(db, "cats", "k"); err != nil || claim == nil || claim.Status != onboardingCreated {
+		t.Errorf("claim of an existing agent = %+v, %v", claim, err)
+	}
+}
+
+func TestRepeatedInvite(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	token := newTestAccount(t, db, "olive", roleOwner, "cats")
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", Workspace: "cats", Name: "Marvin", Owner: "U07PRIMARY"}, "T07Q4VBFFHP")
+
+	invite := func(key string, name string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(SlackInvite{
+			InviteURL:  "https://join.slack.com/t/cats/shared_invite/zt-1",
+			ClientURL:  "https://app.slack.com/client/T07Q4VBFFHP/U07PRIMARY",
+			Name:       name,
+			Appearance: "a paranoid android",
+			System:     "Sigh.",
+		})
+		req := httptest.NewRequest(http.MethodPost, "/invite", strings.NewReader(string(body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		slackInviteHandler(db)(rec, req)
+		return rec
+	}
+
+	// An agent with the same owner and name is returned rather than duplicated
+	rec := invite("", "MARVIN")
+	var existing ExistingAgent
+	if err := json.NewDecoder(rec.Body).Decode(&existing); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("repeated invite = %d, %v", rec.Code, err)
+	}
+	if existing.Status != onboardingCreated || existing.Agent != (AgentSummary{Email: "marvin@example.com", Name: "Marvin", Workspace: "cats"}) {
+		t.Errorf("repeated invite answered %+v", existing)
+	}
+	// without taking over the workspace's invite
+	ws, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadWorkspace(tr, "cats")
+	})
+	if ws := ws.(*Workspace); ws.InviteCode != "" || ws.PrimaryUser != "" {
+		t.Errorf("repeated invite changed the workspace to %+v", ws)
+	}
+	// and the derived key now leads straight to it
+	if claim, _ := lookupInvite(db, "cats", existing.Key); claim == nil || claim.Email != "marvin@example.com" {
+		t.Errorf("claim for %s = %+v", existing.Key, claim)
+	}
+
+	// An invite still being provisioned under the same key is a conflict
+	claimInvite(db, "cats", "form-7", "pending@example.com")
+	rec = invite("form-7", "Trillian")
+	existing = ExistingAgent{}
+	json.NewDecoder(rec.Body).Decode(&existing)
+	if rec.Code != http.StatusConflict || existing.Status != onboardingRequested || existing.Agent.Email != "pending@example.com" {
+		t.Errorf("invite with a pending key = %d %+v, want 409 and the pending agent", rec.Code, existing)
+	}
+
+	if got := fake.callCount("signup.checkEmail"); got != 0 {
+		t.Errorf("repeated invites started %d signups", got)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// maxAppearanceLength bounds the description sent to the image generator.
+const maxAppearanceLength = 1000
+
+// ImageGenerator turns the description of an agent's appearance into a
+// profile image, in any format normalizeAvatar accepts.
+type ImageGenerator interface {
+	Generate(ctx context.Context, req ImageRequest) ([]byte, error)
+}
+
+// ImageRequest is what an image is generated from.
+type ImageRequest struct {
+	Name       string `json:"name"`
+	Appearance string `json:"prompt"`
+	// Seed varies the image between regenerations of the same appearance
+	Seed int64 `json:"seed"`
+}
+
+// imageGenerator makes every generated avatar: the service at
+// cfg.ImageGeneratorURL if one is configured, else an offline identicon.
+var imageGenerator = newImageGenerator(cfg.ImageGeneratorURL)
+
+func newImageGenerator(url string) ImageGenerator {
+	if url == "" {
+		return identiconGenerator{}
+	}
+	return httpImageGenerator{url: url}
+}
+
+// validateAppearance trims an appearance description and checks its length.
+func validateAppearance(appearance string) (string, error) {
+	appearance = strings.TrimSpace(appearance)
+	if appearance == "" {
+		return "", fmt.Errorf("appearance is empty")
+	}
+	if n := utf8.RuneCountInString(appearance); n > maxAppearanceLength {
+		return "", fmt.Errorf("appearance has %d characters, at most %d are allowed", n, maxAppearanceLength)
+	}
+	return appearance, nil
+}
+
+// httpImageGenerator POSTs the request as JSON to an image service, which
+// answers with the image itself.
+type httpImageGenerator struct {
+	url string
+}
+
+func (g httpImageGenerator) Generate(ctx context.Context, req ImageRequest) ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	log.Printf("\033[1;33mGenerating avatar at %s\033[0m", g.url)
+	resp, err := defaultHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("error generating avatar: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarUpload+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading generated avatar: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image generator returned %s: %s", resp.Status, bytes.TrimSpace(data[:min(len(data), 200)]))
+	}
+	return data, nil
+}
+
+// identiconGenerator draws a symmetric 5x5 pattern whose cells and colour
+// are taken from a hash of the appearance, so agents get distinct avatars
+// without any image service.
+type identiconGenerator struct{}
+
+func (identiconGenerator) Generate(ctx context.Context, req ImageRequest) ([]byte, error) {
+	seed := make([]byte, 8)
+	binary.BigEndian.PutUint64(seed, uint64(req.Seed))
+	sum := sha256.Sum256(append([]byte(req.Appearance+"\x00"+req.Name+"\x00"), seed...))
+
+	img := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0xf2, 0xf2, 0xf2, 0xff}}, image.Point{}, draw.Src)
+	fg := &image.Uniform{hueColor(sum[0])}
+
+	const cells = 5
+	cell := avatarSize / (cells + 1)
+	margin := (avatarSize - cells*cell) / 2
+	for y := 0; y < cells; y++ {
+		// Only the left half and middle column are chosen, the rest mirrors them
+		for x := 0; x <= cells/2; x++ {
+			if sum[1+y*3+x]%2 == 0 {
+				continue
+			}
+			for _, cx := range []int{x, cells - 1 - x} {
+				r := image.Rect(margin+cx*cell, margin+y*cell, margin+(cx+1)*cell, margin+(y+1)*cell)
+				draw.Draw(img, r, fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, fmt.Errorf("error encoding identicon: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// hueColor returns a saturated colour with hue h/256 of the way around the
+// colour wheel.
+func hueColor(h byte) color.RGBA {
+	const lo, hi = 0x40, 0xd0
+	f := int(h) * 6 % 256 * (hi - lo) / 256
+	switch int(h) * 6 / 256 {
+	case 0:
+		return color.RGBA{hi, uint8(lo + f), lo, 0xff}
+	case 1:
+		return color.RGBA{uint8(hi - f), hi, lo, 0xff}
+	case 2:
+		return color.RGBA{lo, hi, uint8(lo + f), 0xff}
+	case 3:
+		return color.RGBA{lo, uint8(hi - f), hi, 0xff}
+	case 4:
+		return color.RGBA{uint8(lo + f), lo, hi, 0xff}
+	default:
+		return color.RGBA{hi, lo, uint8(hi - f), 0xff}
+	}
+}
+
+// generateAvatar generates an image for req with imageGenerator and stores it
+// as an avatar of workspace.
+func generateAvatar(ctx context.Context, db Store, workspace, actor string, req ImageRequest) (*Avatar, error) {
+	data, err := imageGenerator.Generate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	avatar, err := saveAvatar(db, workspace, actor, data)
+	if err != nil {
+		return nil, fmt.Errorf("error storing generated avatar: %v", err)
+	}
+	log.Printf("\033[1;32mGenerated avatar %s for %q\033[0m", avatar.ID, req.Appearance)
+	return avatar, nil
+}
+
+// signupAvatar returns the ID of the avatar a new agent gets: the one its
+// invite picked, else its workspace's default, else one generated from its
+// appearance. It returns "" when there is none.
+func signupAvatar(ctx context.Context, db Store, signup agentSignup) string {
+	if signup.Avatar != "" {
+		return signup.Avatar
+	}
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadWorkspace(tr, signup.Workspace)
+	})
+	if err != nil {
+		log.Printf("\033[1;31mError loading workspace %s: %v\033[0m", signup.Workspace, err)
+	} else if ws := result.(*Workspace); ws != nil && ws.DefaultAvatar != "" {
+		return ws.DefaultAvatar
+	}
+	if signup.Appearance == "" {
+		return ""
+	}
+	req := ImageRequest{Name: signup.Name, Appearance: signup.Appearance}
+	avatar, err := generateAvatar(ctx, db, signup.Workspace, signup.RequestedBy, req)
+	if err != nil {
+		log.Printf("\033[1;31mError generating avatar for user %s: %v\033[0m", signup.Email, err)
+		return ""
+	}
+	return avatar.ID
+}
+
+// regenerateAvatarHandler generates a new avatar for an agent from its stored
+// appearance, or from {"appearance": ...} which then replaces it, and sets it
+// as the agent's Slack photo.
+func regenerateAvatarHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, true)
+		if user == nil {
+			return
+		}
+		var body struct {
+			Appearance string `json:"appearance"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		appearance := user.Appearance
+		if body.Appearance != "" {
+			appearance = body.Appearance
+		}
+		appearance, err := validateAppearance(appearance)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'appearance': %v", err), http.StatusBadRequest)
+			return
+		}
+
+		req := ImageRequest{Name: user.Name, Appearance: appearance, Seed: time.Now().UnixNano()}
+		avatar, err := generateAvatar(r.Context(), db, user.Workspace, account.actor(), req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error generating avatar: %v", err), http.StatusBadGateway)
+			return
+		}
+		_, data, err := loadAvatar(db, avatar.ID)
+		if err == nil {
+			err = setPhoto(r.Context(), newSlackSession(user.Workspace), user.APIToken, data)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error setting profile picture: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		_, err = db.Transact(func(tr Tx) (interface{}, error) {
+			current, err := loadUser(tr, user.Email)
+			if err != nil || current == nil {
+				// Deleted while we were generating
+				return nil, err
+			}
+			current.Avatar, current.Appearance = avatar.ID, appearance
+			value, err := json.Marshal(current)
+			if err != nil {
+				return nil, err
+			}
+			tr.Set(ks.users.Pack(tuple.Tuple{user.Email}), value)
+			return nil, nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error storing avatar: %v", err), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditAvatarRegenerate,
+			Workspace: user.Workspace,
+			Target:    user.Email,
+			Details:   map[string]string{"avatar": avatar.ID},
+		})
+		writeJSON(w, avatar)
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdenticon(t *testing.T) {
+	generate := func(req ImageRequest) []byte {
+		data, err := identiconGenerator{}.Generate(context.Background(), req)
+		if err != nil {
+			t.Fatalf("generating %+v: %v", req, err)
+		}
+		return data
+	}
+
+	robot := generate(ImageRequest{Name: "Marvin", Appearance: "a paranoid android"})
+	img, err := png.Decode(bytes.NewReader(robot))
+	if err != nil {
+		t.Fatalf("decoding identicon: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != avatarSize || b.Dy() != avatarSize {
+		t.Errorf("identicon is %v, want %dx%d", b, avatarSize, avatarSize)
+	}
+	for y := 0; y < avatarSize; y += 7 {
+		for x := 0; x < avatarSize/2; x += 7 {
+			if img.At(x, y) != img.At(avatarSize-1-x, y) {
+				t.Fatalf("identicon is not mirrored at (%d, %d)", x, y)
+			}
+		}
+	}
+
+	if !bytes.Equal(robot, generate(ImageRequest{Name: "Marvin", Appearance: "a paranoid android"})) {
+		t.Errorf("the same appearance gave different identicons")
+	}
+	if bytes.Equal(robot, generate(ImageRequest{Name: "Marvin", Appearance: "a paranoid android", Seed: 1})) {
+		t.Errorf("a new seed gave the same identicon")
+	}
+	if _, err := normalizeAvatar(robot); err != nil {
+		t.Errorf("identicon is not a valid avatar: %v", err)
+	}
+}
+
+func TestHTTPImageGenerator(t *testing.T) {
+	var got ImageRequest
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		if got.Appearance == "broken" {
+			http.Error(w, "model overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		png.Encode(w, testImage(avatarSize, avatarSize))
+	}))
+	defer service.Close()
+
+	generator := newImageGenerator(service.URL)
+	data, err := generator.Generate(context.Background(), ImageRequest{Name: "Marvin", Appearance: "a paranoid android", Seed: 42})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if got != (ImageRequest{Name: "Marvin", Appearance: "a paranoid android", Seed: 42}) {
+		t.Errorf("image service received %+v", got)
+	}
+	if _, err := normalizeAvatar(data); err != nil {
+		t.Errorf("generated image is not a valid avatar: %v", err)
+	}
+	if _, err := generator.Generate(context.Background(), ImageRequest{Appearance: "broken"}); err == nil || !strings.Contains(err.Error(), "model overloaded") {
+		t.Errorf("Generate with a failing service = %v", err)
+	}
+}
+
+func TestRegenerateAvatar(t *testing.T) {
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	db := newTestStore(t)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	viewer := newTestAccount(t, db, "vera", roleViewer, "cats")
+
+	fake.tokens["xoxp-U0042"] = "U0042"
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0042", Workspace: "cats", Name: "Marvin", Appearance: "a paranoid android"}, "T1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /agents/{email}/avatar", regenerateAvatarHandler(db))
+	regenerate := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/agents/marvin@example.com/avatar", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := regenerate(viewer, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("regenerating as a viewer = %d, want 403", rec.Code)
+	}
+
+	var first, second Avatar
+	rec := regenerate(owner, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("regenerating = %d %s", rec.Code, rec.Body)
+	}
+	json.NewDecoder(rec.Body).Decode(&first)
+	rec = regenerate(owner, `{"appearance": "a cheerful toaster"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("regenerating with a new appearance = %d %s", rec.Code, rec.Body)
+	}
+	json.NewDecoder(rec.Body).Decode(&second)
+	if first.ID == second.ID {
+		t.Errorf("regenerating gave the same avatar %s twice", first.ID)
+	}
+
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadUser(tr, "marvin@example.com")
+	})
+	user := result.(*UserCredential)
+	if user.Avatar != second.ID || user.Appearance != "a cheerful toaster" {
+		t.Errorf("stored agent has avatar %s and appearance %q", user.Avatar, user.Appearance)
+	}
+	if _, data, err := loadAvatar(db, second.ID); err != nil || !bytes.Equal(fake.photo("U0042"), data) {
+		t.Errorf("Slack photo is not the regenerated avatar: %v", err)
+	}
+
+	if rec := regenerate(owner, `{"appearance": "`+strings.Repeat("x", maxAppearanceLength+1)+`"}`); rec.Code != http.StatusBadRequest {
+		body, _ := io.ReadAll(rec.Body)
+		t.Errorf("regenerating with a too long appearance = %d %s, want 400", rec.Code, body)
+	}
+}
+
+func TestSignupAvatar(t *testing.T) {
+	db := newTestStore(t)
+	signup := agentSignup{Email: "marvin@example.com", Workspace: "cats", Name: "Marvin", Appearance: "a paranoid android"}
+
+	// Without a default the appearance is drawn
+	generated := signupAvatar(context.Background(), db, signup)
+	if avatar, _, err := loadAvatar(db, generated); err != nil || avatar.Workspace != "cats" {
+		t.Errorf("signupAvatar without a default = %q, %v, want a generated avatar", generated, err)
+	}
+
+	// The workspace default wins over drawing one
+	db.Transact(func(tr Tx) (interface{}, error) {
+		ws, err := upsertWorkspace(tr, "cats", "", "", "")
+		if err != nil {
+			return nil, err
+		}
+		ws.DefaultAvatar = "default"
+		return nil, saveWorkspace(tr, ws)
+	})
+	if got := signupAvatar(context.Background(), db, signup); got != "default" {
+		t.Errorf("signupAvatar with a workspace default = %q, want it", got)
+	}
+	// and the invite's own upload over both
+	signup.Avatar = "uploaded"
+	if got := signupAvatar(context.Background(), db, signup); got != "uploaded" {
+		t.Errorf("signupAvatar with an upload = %q, want it", got)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// schemaVersion is the layout of the keyspace this build reads and writes.
+// Bump it together with a step in migrate whenever the layout changes.
+const schemaVersion = 1
+
+// keyspaceRoot is the directory every record of this application lives under.
+var keyspaceRoot = []string{"slack"}
+
+// keyspace holds the directory subspaces records live in. Keys inside each
+// are tuple encoded:
+//
+//	meta          ("schema_version")            -> (version)
+//	users         (email)                       -> UserCredential JSON
+//	workspaces    (name)                        -> workspace JSON
+//	invites       (workspace, unix nanos)       -> OnboardingEvent JSON
+//	conversations (email, ...)                  -> conversation history
+//	events        reserved for event records
+//	archive       (email)                       -> ArchivedAgent JSON
+//	audit         see auditKeys
+//	prompts       (email, version)              -> PromptVersion JSON
+//	avatars       (id, "meta")                  -> Avatar JSON
+//	              (id, "chunk", n)              -> nth chunk of the PNG
+//	accounts      (name)                        -> Account JSON
+//	account_tokens (sha256 of token)            -> account name
+//	invite_keys   (workspace, idempotency key)  -> InviteClaim JSON
+//	usage         (workspace, "2006-01-02")     -> (LLM requests that day)
+//	              (workspace, "2006-01-02", "notice", channel) -> "" once told
+//	queue         (email, versionstamp)         -> QueuedMessage JSON
+//	jobs          see saveJob
+//	knowledge     see saveDocument
+type keyspace struct {
+	meta          subspace.Subspace
+	users         subspace.Subspace
+	workspaces    subspace.Subspace
+	invites       subspace.Subspace
+	conversations subspace.Subspace
+	events        subspace.Subspace
+	archive       subspace.Subspace
+	audit         subspace.Subspace
+	prompts       subspace.Subspace
+	avatars       subspace.Subspace
+	accounts      subspace.Subspace
+	accountTokens subspace.Subspace
+	inviteKeys    subspace.Subspace
+	usage         subspace.Subspace
+	queue         subspace.Subspace
+	jobs          subspace.Subspace
+	knowledge     subspace.Subspace
+}
+
+// ks is the keyspace of the store the process opened, set by useKeyspace.
+var ks keyspace
+
+// openKeyspace creates or opens every directory of the keyspace in db.
+func openKeyspace(db Store) (keyspace, error) {
+	var k keyspace
+	dirs := []struct {
+		name string
+		sub  *subspace.Subspace
+	}{
+		{"meta", &k.meta},
+		{"users", &k.users},
+		{"workspaces", &k.workspaces},
+		{"invites", &k.invites},
+		{"conversations", &k.conversations},
+		{"events", &k.events},
+		{"archive", &k.archive},
+		{"audit", &k.audit},
+		{"prompts", &k.prompts},
+		{"avatars", &k.avatars},
+		{"accounts", &k.accounts},
+		{"account_tokens", &k.accountTokens},
+		{"invite_keys", &k.inviteKeys},
+		{"usage", &k.usage},
+		{"queue", &k.queue},
+		{"jobs", &k.jobs},
+		{"knowledge", &k.knowledge},
+	}
+	for _, dir := range dirs {
+		sub, err := db.Directory(append(append([]string{}, keyspaceRoot...), dir.name))
+		if err != nil {
+			return keyspace{}, fmt.Errorf("error opening directory %s: %v", dir.name, err)
+		}
+		*dir.sub = sub
+	}
+	return k, nil
+}
+
+// useKeyspace opens db's keyspace and makes it the one records are read from
+// and written to.
+func useKeyspace(db Store) error {
+	k, err := openKeyspace(db)
+	if err != nil {
+		return err
+	}
+	ks = k
+	return nil
+}
+
+// readSchemaVersion returns the stored schema version, or 0 for a store that
+// has never been written by a versioned build.
+func readSchemaVersion(tr ReadTx) (int64, error) {
+	value, err := tr.Get(ks.meta.Pack(tuple.Tuple{"schema_version"}))
+	if err != nil || value == nil {
+		return 0, err
+	}
+	t, err := tuple.Unpack(value)
+	if err != nil || len(t) != 1 {
+		return 0, fmt.Errorf("invalid schema version %q", value)
+	}
+	version, ok := t[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("invalid schema version %q", value)
+	}
+	return version, nil
+}
+
+func writeSchemaVersion(tr Tx, version int64) {
+	tr.Set(ks.meta.Pack(tuple.Tuple{"schema_version"}), tuple.Tuple{version}.Pack())
+}
+
+// Legacy keys written before the keyspace was versioned.
+var (
+	legacyUsers      = fdb.KeyRange{Begin: fdb.Key("user_"), End: fdb.Key("user_\xFF")}
+	legacyWorkspaces = fdb.KeyRange{Begin: fdb.Key("workspace_"), End: fdb.Key("workspace_\xFF")}
+)
+
+// checkSchema makes sure db can be used by this build. A fresh store is
+// stamped with the current version; a store holding legacy keys or written by
+// a newer build is refused.
+func checkSchema(db Store) error {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		version, err := readSchemaVersion(tr)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case version == schemaVersion:
+			return nil, nil
+		case version > schemaVersion:
+			return nil, fmt.Errorf("store has schema version %d, this build only knows version %d", version, schemaVersion)
+		case version > 0:
+			return nil, fmt.Errorf("store has schema version %d, run the migrate command", version)
+		}
+
+		for _, legacy := range []fdb.KeyRange{legacyUsers, legacyWorkspaces} {
+			kvs, err := tr.GetRange(legacy, fdb.RangeOptions{Limit: 1})
+			if err != nil {
+				return nil, err
+			}
+			if len(kvs) > 0 {
+				return nil, fmt.Errorf("store holds unversioned records, run the migrate command")
+			}
+		}
+		writeSchemaVersion(tr, schemaVersion)
+		return nil, nil
+	})
+	return err
+}
+
+// migrate brings db up to schemaVersion. Version 1 moves the ad-hoc
+// "user_<email>" and "workspace_<name>" records into the tuple encoded users
+// and workspaces directories. Running it again is a no-op.
+func migrate(db Store) error {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		version, err := readSchemaVersion(tr)
+		if err != nil {
+			return nil, err
+		}
+		if version > schemaVersion {
+			return nil, fmt.Errorf("store has schema version %d, this build only knows version %d", version, schemaVersion)
+		}
+		if version == schemaVersion {
+			log.Printf("\033[1;32mStore already at schema version %d\033[0m", version)
+			return nil, nil
+		}
+
+		users, err := tr.GetRange(legacyUsers, fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range users {
+			var user UserCredential
+			if err := json.Unmarshal(kv.Value, &user); err != nil {
+				return nil, fmt.Errorf("error unmarshaling %s: %v", kv.Key, err)
+			}
+			if user.Email == "" {
+				user.Email = strings.TrimPrefix(string(kv.Key), "user_")
+			}
+			tr.Set(ks.users.Pack(tuple.Tuple{user.Email}), kv.Value)
+			log.Printf("\033[1;36mMigrated user %s\033[0m", user.Email)
+		}
+
+		workspaces, err := tr.GetRange(legacyWorkspaces, fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range workspaces {
+			name := strings.TrimPrefix(string(kv.Key), "workspace_")
+			tr.Set(ks.workspaces.Pack(tuple.Tuple{name}), kv.Value)
+			log.Printf("\033[1;36mMigrated workspace %s\033[0m", name)
+		}
+
+		// Link every migrated agent to its workspace
+		for _, kv := range users {
+			var user UserCredential
+			json.Unmarshal(kv.Value, &user)
+			if user.Email == "" {
+				user.Email = strings.TrimPrefix(string(kv.Key), "user_")
+			}
+			if err := addWorkspaceAgent(tr, user.Workspace, "", user.Email); err != nil {
+				return nil, err
+			}
+		}
+
+		tr.ClearRange(legacyUsers)
+		tr.ClearRange(legacyWorkspaces)
+		writeSchemaVersion(tr, schemaVersion)
+		log.Printf("\033[1;32mMigrated %d users and %d workspaces to schema version %d\033[0m", len(users), len(workspaces), schemaVersion)
+		return nil, nil
+	})
+	return err
+}
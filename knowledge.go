@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Document formats, see Document.
+const (
+	formatMarkdown = "markdown"
+	formatText     = "text"
+	formatPDF      = "pdf"
+)
+
+// Limits of the knowledge base. A workspace's chunks are all scored for
+// every reply, so their number is what bounds the cost of retrieval.
+const (
+	maxKnowledgeUpload     = 10 << 20
+	maxDocumentChars       = 500_000
+	maxWorkspaceDocuments  = 100
+	maxWorkspaceChunks     = 5000
+	maxKnowledgeResults    = 10
+	chunkChars             = 1000
+	chunksPerTransaction   = 50
+	embeddingBatch         = 64
+	hashingDimensions      = 256
+	knowledgeExcerptsChars = 6000
+)
+
+// A passage scores the cosine similarity of its embedding to the query's
+// plus bm25/(bm25+bm25Half), so about 1 for a good match on either; below
+// minKnowledgeScore it is not retrieved.
+const (
+	bm25Half          = 2.0
+	minKnowledgeScore = 0.5
+)
+
+var errDocumentNotFound = errors.New("document not found")
+
+// Knowledge is how much of the workspace's documents a reply sees.
+type Knowledge struct {
+	// Results is how many excerpts are included at most; 0 uses
+	// KNOWLEDGE_RESULTS.
+	Results int `json:"results,omitempty"`
+	// Disabled answers from the model alone.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+func (k Knowledge) results() int {
+	if k.Results > 0 {
+		return k.Results
+	}
+	return cfg.KnowledgeResults
+}
+
+// Document is an uploaded file of a workspace's knowledge base, available to
+// all of its agents or, with Agent set, to that one only. Its text is stored
+// next to it in chunks, as uploaded under Upload.
+type Document struct {
+	ID        string `json:"id"`
+	Workspace string `json:"workspace"`
+	Agent     string `json:"agent,omitempty"`
+	Title     string `json:"title"`
+	Format    string `json:"format"`
+	// Chars is the length of the text extracted from the file.
+	Chars  int `json:"chars"`
+	Chunks int `json:"chunks"`
+	// Embedder is what the chunks' vectors were computed with; vectors of
+	// another embedder cannot be compared with a query's.
+	Embedder   string    `json:"embedder"`
+	Upload     string    `json:"upload"`
+	UploadedBy string    `json:"uploaded_by"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// documentID identifies the document titled title in a scope, so uploading
+// a new version under the same title replaces the old one.
+func documentID(workspace, agent, title string) string {
+	sum := sha256.Sum256([]byte(workspace + "\x00" + agent + "\x00" + strings.ToLower(title)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// KnowledgeChunk is a passage of a document, with the heading it is under.
+type KnowledgeChunk struct {
+	Section string    `json:"section,omitempty"`
+	Text    string    `json:"text"`
+	Vector  []float32 `json:"vector"`
+}
+
+// documentFormat tells the format of an uploaded file from its name, or its
+// content for names without a known extension.
+func documentFormat(filename string, data []byte) (string, error) {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".md", ".markdown":
+		return formatMarkdown, nil
+	case ".txt", ".text":
+		return formatText, nil
+	case ".pdf":
+		return formatPDF, nil
+	}
+	switch content := http.DetectContentType(data); {
+	case content == "application/pdf":
+		return formatPDF, nil
+	case strings.HasPrefix(content, "text/plain"):
+		return formatText, nil
+	}
+	return "", fmt.Errorf("%q is not a Markdown, text or PDF file", filename)
+}
+
+// documentText returns the text of an uploaded file in format.
+func documentText(format string, data []byte) (string, error) {
+	var text string
+	if format == formatPDF {
+		var err error
+		if text, err = pdfText(data); err != nil {
+			return "", err
+		}
+	} else {
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("text is not UTF-8")
+		}
+		text = strings.TrimSpace(strings.ReplaceAll(string(data), "\r\n", "\n"))
+	}
+	if text == "" {
+		return "", fmt.Errorf("document is empty")
+	}
+	if n := utf8.RuneCountInString(text); n > maxDocumentChars {
+		return "", fmt.Errorf("document has %d characters, at most %d are allowed", n, maxDocumentChars)
+	}
+	return text, nil
+}
+
+// chunkText splits text into passages of about chunkChars characters along
+// paragraphs. In Markdown every heading starts a new passage, which records
+// it as its section.
+func chunkText(format, text string) []KnowledgeChunk {
+	var chunks []KnowledgeChunk
+	var section string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, KnowledgeChunk{Section: section, Text: current.String()})
+			current.Reset()
+		}
+	}
+	add := func(paragraph string) {
+		if current.Len() > 0 && utf8.RuneCountInString(current.String())+utf8.RuneCountInString(paragraph) > chunkChars {
+			flush()
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(paragraph)
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		if format == formatMarkdown {
+			if m := mdHeading.FindStringSubmatch(strings.SplitN(paragraph, "\n", 2)[0]); m != nil {
+				flush()
+				section = strings.TrimSpace(strings.Trim(m[1], "*_ "))
+				rest := strings.SplitN(paragraph, "\n", 2)
+				if len(rest) == 1 {
+					continue
+				}
+				paragraph = strings.TrimSpace(rest[1])
+			}
+		}
+		for _, piece := range splitLong(paragraph, chunkChars) {
+			add(piece)
+		}
+	}
+	flush()
+	return chunks
+}
+
+// splitLong splits text into pieces of at most limit characters, at the last
+// space before the limit where there is one.
+func splitLong(text string, limit int) []string {
+	var pieces []string
+	for utf8.RuneCountInString(text) > limit {
+		runes := []rune(text)
+		cut := limit
+		for i := limit; i > limit/2; i-- {
+			if unicode.IsSpace(runes[i]) {
+				cut = i
+				break
+			}
+		}
+		pieces = append(pieces, strings.TrimSpace(string(runes[:cut])))
+		text = strings.TrimSpace(string(runes[cut:]))
+	}
+	return append(pieces, text)
+}
+
+// Embedder turns passages of text into vectors whose cosine similarity
+// reflects how related they are.
+type Embedder interface {
+	// Name identifies the embedder and its model; documents remember it.
+	Name() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// embedder computes every document and query vector: the embeddings API at
+// cfg.EmbeddingURL if one is configured, else feature hashing, which works
+// offline.
+var embedder = newEmbedder(cfg.EmbeddingURL, cfg.EmbeddingModel)
+
+func newEmbedder(url, model string) Embedder {
+	if url == "" {
+		return hashingEmbedder{dimensions: hashingDimensions}
+	}
+	return httpEmbedder{url: strings.TrimSuffix(url, "/"), model: model}
+}
+
+// httpEmbedder calls an OpenAI compatible embeddings API, authenticated with
+// EMBEDDING_API_KEY if it is set.
+type httpEmbedder struct {
+	url   string
+	model string
+}
+
+func (e httpEmbedder) Name() string {
+	return "api:" + e.model
+}
+
+func (e httpEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]interface{}{"model": e.model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := os.Getenv("EMBEDDING_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling embeddings API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return nil, fmt.Errorf("embeddings API returned %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing embeddings response: %v", err)
+	}
+	vectors := make([][]float32, len(texts))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("embeddings response has index %d for %d inputs", d.Index, len(texts))
+		}
+		vectors[d.Index] = normalize(d.Embedding)
+	}
+	for i, v := range vectors {
+		if v == nil {
+			return nil, fmt.Errorf("embeddings response has no vector for input %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+// hashingEmbedder hashes every term of a text into one of a fixed number of
+// dimensions, weighted by how often it occurs. Texts sharing words get
+// similar vectors, which is all retrieval without an embeddings API needs.
+type hashingEmbedder struct {
+	dimensions int
+}
+
+func (e hashingEmbedder) Name() string {
+	return fmt.Sprintf("hashing-%d", e.dimensions)
+}
+
+func (e hashingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, e.dimensions)
+		for term, n := range termCounts(text) {
+			h := fnv.New64a()
+			h.Write([]byte(term))
+			sum := h.Sum64()
+			weight := float32(1 + math.Log(float64(n)))
+			// The sign bit keeps colliding terms from adding up
+			if sum>>63 == 1 {
+				weight = -weight
+			}
+			vector[sum%uint64(e.dimensions)] += weight
+		}
+		vectors[i] = normalize(vector)
+	}
+	return vectors, nil
+}
+
+// normalize scales v to unit length, so cosine similarity is a dot product.
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+func dot(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// stopWords are left out of retrieval, they match every passage.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "can": true, "do": true, "does": true, "for": true, "from": true, "has": true,
+	"have": true, "how": true, "i": true, "if": true, "in": true, "is": true, "it": true, "me": true,
+	"my": true, "of": true, "on": true, "or": true, "our": true, "so": true, "that": true, "the": true,
+	"this": true, "to": true, "was": true, "we": true, "what": true, "when": true, "where": true,
+	"which": true, "who": true, "why": true, "will": true, "with": true, "you": true, "your": true,
+}
+
+// termCounts splits text into lower-case words, without stop words, and
+// counts them.
+func termCounts(text string) map[string]int {
+	counts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !stopWords[word] {
+			counts[word]++
+		}
+	}
+	return counts
+}
+
+// embedChunks fills in the vectors of chunks, in batches the embeddings API
+// accepts.
+func embedChunks(ctx context.Context, e Embedder, chunks []KnowledgeChunk) error {
+	for start := 0; start < len(chunks); start += embeddingBatch {
+		batch := chunks[start:min(start+embeddingBatch, len(chunks))]
+		texts := make([]string, len(batch))
+		for i, chunk := range batch {
+			texts[i] = strings.TrimSpace(chunk.Section + "\n" + chunk.Text)
+		}
+		vectors, err := e.Embed(ctx, texts)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			batch[i].Vector = vectors[i]
+		}
+	}
+	return nil
+}
+
+// Keys in the knowledge directory:
+//
+//	(workspace, "generation")                 -> random ID of the last change
+//	(workspace, "doc", id)                    -> Document JSON
+//	(workspace, "chunk", id, upload, n)       -> KnowledgeChunk JSON
+//
+// The generation tells cached copies of a workspace's chunks apart from the
+// stored ones.
+
+func bumpKnowledgeGeneration(tr Tx, workspace string) {
+	tr.Set(ks.knowledge.Pack(tuple.Tuple{workspace, "generation"}), []byte(newJobID()))
+}
+
+func knowledgeGeneration(tr ReadTx, workspace string) (string, error) {
+	value, err := tr.Get(ks.knowledge.Pack(tuple.Tuple{workspace, "generation"}))
+	return string(value), err
+}
+
+func loadDocument(tr ReadTx, workspace, id string) (*Document, error) {
+	value, err := tr.Get(ks.knowledge.Pack(tuple.Tuple{workspace, "doc", id}))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var doc Document
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return nil, fmt.Errorf("error unmarshaling document %s: %v", id, err)
+	}
+	return &doc, nil
+}
+
+// workspaceDocuments returns the documents of workspace, by ID.
+func workspaceDocuments(tr ReadTx, workspace string) ([]Document, error) {
+	kvs, err := tr.GetRange(ks.knowledge.Sub(workspace, "doc"), fdb.RangeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]Document, 0, len(kvs))
+	for _, kv := range kvs {
+		var doc Document
+		if err := json.Unmarshal(kv.Value, &doc); err != nil {
+			return nil, fmt.Errorf("error unmarshaling document %s: %v", kv.Key, err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// saveDocument stores doc with its embedded chunks, replacing a document of
+// the same title in the same scope. Chunks are written in several
+// transactions under a new upload, and only become visible, and the old
+// upload's chunks cleared, once the last one has committed.
+func saveDocument(db Store, doc *Document, chunks []KnowledgeChunk) error {
+	doc.ID = documentID(doc.Workspace, doc.Agent, doc.Title)
+	doc.Upload = newJobID()
+	doc.Chunks = len(chunks)
+
+	// Refuse before writing anything if the workspace has no room
+	if _, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return nil, checkKnowledgeRoom(tr, doc)
+	}); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(chunks); start += chunksPerTransaction {
+		_, err := db.Transact(func(tr Tx) (interface{}, error) {
+			for n := start; n < min(start+chunksPerTransaction, len(chunks)); n++ {
+				value, err := json.Marshal(chunks[n])
+				if err != nil {
+					return nil, err
+				}
+				tr.Set(ks.knowledge.Pack(tuple.Tuple{doc.Workspace, "chunk", doc.ID, doc.Upload, n}), value)
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error storing chunks of document %s: %v", doc.Title, err)
+		}
+	}
+
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		if err := checkKnowledgeRoom(tr, doc); err != nil {
+			tr.ClearRange(ks.knowledge.Sub(doc.Workspace, "chunk", doc.ID, doc.Upload))
+			return nil, err
+		}
+		previous, err := loadDocument(tr, doc.Workspace, doc.ID)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			tr.ClearRange(ks.knowledge.Sub(doc.Workspace, "chunk", doc.ID, previous.Upload))
+		}
+		value, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.knowledge.Pack(tuple.Tuple{doc.Workspace, "doc", doc.ID}), value)
+		bumpKnowledgeGeneration(tr, doc.Workspace)
+		return nil, nil
+	})
+	if errors.Is(err, errKnowledgeFull) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error storing document %s: %v", doc.Title, err)
+	}
+	return nil
+}
+
+var errKnowledgeFull = errors.New("knowledge base is full")
+
+// checkKnowledgeRoom returns errKnowledgeFull if storing doc would take its
+// workspace past maxWorkspaceDocuments or maxWorkspaceChunks. The document
+// it replaces does not count.
+func checkKnowledgeRoom(tr ReadTx, doc *Document) error {
+	docs, err := workspaceDocuments(tr, doc.Workspace)
+	if err != nil {
+		return err
+	}
+	count, chunks := 1, doc.Chunks
+	for _, other := range docs {
+		if other.ID != doc.ID {
+			count, chunks = count+1, chunks+other.Chunks
+		}
+	}
+	if count > maxWorkspaceDocuments {
+		return fmt.Errorf("%w: workspace %s has %d documents already", errKnowledgeFull, doc.Workspace, maxWorkspaceDocuments)
+	}
+	if chunks > maxWorkspaceChunks {
+		return fmt.Errorf("%w: workspace %s would have %d passages, at most %d are allowed", errKnowledgeFull, doc.Workspace, chunks, maxWorkspaceChunks)
+	}
+	return nil
+}
+
+// deleteDocument removes a document with all of its chunks.
+func deleteDocument(tr Tx, workspace, id string) {
+	tr.Clear(ks.knowledge.Pack(tuple.Tuple{workspace, "doc", id}))
+	tr.ClearRange(ks.knowledge.Sub(workspace, "chunk", id))
+	bumpKnowledgeGeneration(tr, workspace)
+}
+
+// deleteAgentDocuments removes the documents only the agent with email could
+// see.
+func deleteAgentDocuments(tr Tx, workspace, email string) error {
+	docs, err := workspaceDocuments(tr, workspace)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if doc.Agent == email {
+			deleteDocument(tr, workspace, doc.ID)
+		}
+	}
+	return nil
+}
+
+// storedChunk is a chunk as kept in memory for retrieval.
+type storedChunk struct {
+	KnowledgeChunk
+	doc    *Document
+	terms  map[string]int
+	length int
+}
+
+// knowledgeCache keeps every workspace's chunks in memory for as long as its
+// generation stays the same, so a reply costs one read instead of all of
+// them.
+type knowledgeCache struct {
+	mu         sync.Mutex
+	workspaces map[string]cachedKnowledge
+}
+
+type cachedKnowledge struct {
+	generation string
+	chunks     []storedChunk
+}
+
+var knowledgeChunks = &knowledgeCache{workspaces: make(map[string]cachedKnowledge)}
+
+// load returns the chunks of every document of workspace.
+func (c *knowledgeCache) load(db Store, workspace string) ([]storedChunk, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		generation, err := knowledgeGeneration(tr, workspace)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		cached, ok := c.workspaces[workspace]
+		c.mu.Unlock()
+		if ok && cached.generation == generation {
+			return cached, nil
+		}
+
+		docs, err := workspaceDocuments(tr, workspace)
+		if err != nil {
+			return nil, err
+		}
+		loaded := cachedKnowledge{generation: generation}
+		for i := range docs {
+			doc := &docs[i]
+			kvs, err := tr.GetRange(ks.knowledge.Sub(workspace, "chunk", doc.ID, doc.Upload), fdb.RangeOptions{})
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range kvs {
+				var chunk KnowledgeChunk
+				if err := json.Unmarshal(kv.Value, &chunk); err != nil {
+					return nil, fmt.Errorf("error unmarshaling chunk %s: %v", kv.Key, err)
+				}
+				terms := termCounts(chunk.Section + "\n" + chunk.Text)
+				length := 0
+				for _, n := range terms {
+					length += n
+				}
+				loaded.chunks = append(loaded.chunks, storedChunk{KnowledgeChunk: chunk, doc: doc, terms: terms, length: length})
+			}
+		}
+		return loaded, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading knowledge of workspace %s: %v", workspace, err)
+	}
+	loaded := result.(cachedKnowledge)
+	c.mu.Lock()
+	c.workspaces[workspace] = loaded
+	c.mu.Unlock()
+	return loaded.chunks, nil
+}
+
+// Excerpt is a passage retrieved for a message, numbered for citing.
+type Excerpt struct {
+	Number   int     `json:"number"`
+	Document string  `json:"document"`
+	Title    string  `json:"title"`
+	Section  string  `json:"section,omitempty"`
+	Text     string  `json:"text"`
+	Score    float64 `json:"score"`
+}
+
+// source names the excerpt's document and section for a citation.
+func (e Excerpt) source() string {
+	if e.Section == "" {
+		return e.Title
+	}
+	return e.Title + " › " + e.Section
+}
+
+// retrieve returns up to limit passages of the documents agent can see that
+// are most relevant to query, best first. Each passage scores the cosine
+// similarity of its vector to the query's, for documents embedded with the
+// same embedder, plus its saturated BM25 score; passages below
+// minKnowledgeScore are left out.
+func retrieve(ctx context.Context, db Store, e Embedder, workspace, agent, query string, limit int) ([]Excerpt, error) {
+	chunks, err := knowledgeChunks.load(db, workspace)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []storedChunk
+	for _, chunk := range chunks {
+		if chunk.doc.Agent == "" || chunk.doc.Agent == agent {
+			candidates = append(candidates, chunk)
+		}
+	}
+	terms := termCounts(query)
+	if len(candidates) == 0 || len(terms) == 0 {
+		return nil, nil
+	}
+	vectors, err := e.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("error embedding query: %v", err)
+	}
+
+	// BM25 with the usual k1 = 1.2 and b = 0.75
+	const k1, b = 1.2, 0.75
+	total := 0
+	df := make(map[string]int)
+	for _, chunk := range candidates {
+		total += chunk.length
+		for term := range terms {
+			if chunk.terms[term] > 0 {
+				df[term]++
+			}
+		}
+	}
+	n := float64(len(candidates))
+	avgLength := float64(total) / n
+	bm25 := make([]float64, len(candidates))
+	for i, chunk := range candidates {
+		for term := range terms {
+			tf := float64(chunk.terms[term])
+			if tf == 0 {
+				continue
+			}
+			idf := math.Log(1 + (n-float64(df[term])+0.5)/(float64(df[term])+0.5))
+			bm25[i] += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(chunk.length)/max(avgLength, 1)))
+		}
+	}
+
+	var excerpts []Excerpt
+	for i, chunk := range candidates {
+		score := 0.0
+		if chunk.doc.Embedder == e.Name() {
+			score = dot(vectors[0], chunk.Vector)
+		}
+		// Saturated rather than relative to the best passage, so that the
+		// threshold means the same however well anything else matches
+		score += bm25[i] / (bm25[i] + bm25Half)
+		if score < minKnowledgeScore {
+			continue
+		}
+		excerpts = append(excerpts, Excerpt{
+			Document: chunk.doc.ID,
+			Title:    chunk.doc.Title,
+			Section:  chunk.Section,
+			Text:     chunk.Text,
+			Score:    math.Round(score*1000) / 1000,
+		})
+	}
+	sort.SliceStable(excerpts, func(i, j int) bool {
+		return excerpts[i].Score > excerpts[j].Score
+	})
+	if len(excerpts) > limit {
+		excerpts = excerpts[:limit]
+	}
+	for i := range excerpts {
+		excerpts[i].Number = i + 1
+	}
+	return excerpts, nil
+}
+
+// knowledgeFor retrieves the excerpts a reply of user to text is given,
+// none when the workspace turned the knowledge base off.
+func knowledgeFor(ctx context.Context, db Store, user *UserCredential, config *WorkspaceConfig, text string) ([]Excerpt, error) {
+	if config.Knowledge.Disabled {
+		return nil, nil
+	}
+	return retrieve(ctx, db, embedder, user.Workspace, user.Email, text, config.Knowledge.results())
+}
+
+// withKnowledge appends numbered excerpts to a system prompt, as many as fit
+// in knowledgeExcerptsChars.
+func withKnowledge(system string, excerpts []Excerpt) string {
+	if len(excerpts) == 0 {
+		return system
+	}
+	var prompt strings.Builder
+	prompt.WriteString(system)
+	prompt.WriteString("\n\nThese excerpts from the workspace's documents may help. Cite the ones you use by number, like [1].")
+	used := 0
+	for _, e := range excerpts {
+		if used += len(e.Text); used > knowledgeExcerptsChars && e.Number > 1 {
+			break
+		}
+		fmt.Fprintf(&prompt, "\n\n[%d] %s\n%s", e.Number, e.source(), e.Text)
+	}
+	return prompt.String()
+}
+
+// citations returns the line listing the sources an answer given excerpts
+// cites by number, or "" if it cites none.
+func citations(answer string, excerpts []Excerpt) string {
+	var cited []Excerpt
+	for _, e := range excerpts {
+		if strings.Contains(answer, fmt.Sprintf("[%d]", e.Number)) {
+			cited = append(cited, e)
+		}
+	}
+	if len(cited) == 0 {
+		return ""
+	}
+	sources := make([]string, len(cited))
+	for i, e := range cited {
+		sources[i] = fmt.Sprintf("[%d] %s", e.Number, e.source())
+	}
+	return "\n\n_Sources: " + strings.Join(sources, "; ") + "_"
+}
+
+// listDocumentsHandler lists the documents of a workspace the account can
+// see, only those of one agent with ?agent=.
+func listDocumentsHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name := r.PathValue("name")
+		if !account.canView(name) {
+			http.Error(w, fmt.Sprintf("Workspace '%s' not found", name), http.StatusNotFound)
+			return
+		}
+		result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return workspaceDocuments(tr, name)
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing documents: %v", err), http.StatusInternalServerError)
+			return
+		}
+		docs := []Document{}
+		agent := r.URL.Query().Get("agent")
+		for _, doc := range result.([]Document) {
+			if agent == "" || doc.Agent == agent {
+				docs = append(docs, doc)
+			}
+		}
+		sort.Slice(docs, func(i, j int) bool {
+			return docs[i].Title < docs[j].Title
+		})
+		writeJSON(w, docs)
+	})
+}
+
+// uploadDocumentHandler adds the multipart "file" to a workspace's knowledge
+// base, titled "title" or after the file, for all its agents or only the one
+// in "agent".
+func uploadDocumentHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name := r.PathValue("name")
+		if !account.canManage(name) {
+			http.Error(w, fmt.Sprintf("Account '%s' cannot upload documents for workspace '%s'", account.Name, name), http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxKnowledgeUpload+1<<20)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Missing 'file': %v", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxKnowledgeUpload+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var problems []string
+		if len(data) > maxKnowledgeUpload {
+			problems = append(problems, fmt.Sprintf("Invalid 'file': larger than %d bytes", maxKnowledgeUpload))
+		}
+		format, err := documentFormat(header.Filename, data)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid 'file': %v", err))
+		}
+		title := strings.TrimSpace(r.FormValue("title"))
+		if title == "" {
+			title = strings.TrimSuffix(path.Base(header.Filename), path.Ext(header.Filename))
+		}
+		if title == "" || utf8.RuneCountInString(title) > 200 {
+			problems = append(problems, "Invalid 'title': must have between 1 and 200 characters")
+		}
+		agent := strings.TrimSpace(r.FormValue("agent"))
+		if agent != "" {
+			result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+				return loadUser(tr, agent)
+			})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error loading agent: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if user := result.(*UserCredential); user == nil || user.Workspace != name {
+				problems = append(problems, fmt.Sprintf("Invalid 'agent': no agent %s in workspace %s", agent, name))
+			}
+		}
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+			return
+		}
+		text, err := documentText(format, data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'file': %v", err), http.StatusBadRequest)
+			return
+		}
+
+		chunks := chunkText(format, text)
+		if err := embedChunks(r.Context(), embedder, chunks); err != nil {
+			http.Error(w, fmt.Sprintf("Error embedding document: %v", err), http.StatusBadGateway)
+			return
+		}
+		doc := &Document{
+			Workspace:  name,
+			Agent:      agent,
+			Title:      title,
+			Format:     format,
+			Chars:      utf8.RuneCountInString(text),
+			Embedder:   embedder.Name(),
+			UploadedBy: account.actor(),
+			UploadedAt: time.Now().UTC(),
+		}
+		if err := saveDocument(db, doc, chunks); errors.Is(err, errKnowledgeFull) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("\033[1;32mStored document %s of workspace %s in %d chunks\033[0m", doc.Title, name, doc.Chunks)
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditKnowledgeUpload,
+			Workspace: name,
+			Target:    doc.ID,
+			Details:   map[string]string{"title": doc.Title, "agent": doc.Agent, "chunks": fmt.Sprint(doc.Chunks)},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(doc)
+	})
+}
+
+// deleteDocumentHandler removes a document from a workspace's knowledge
+// base.
+func deleteDocumentHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name, id := r.PathValue("name"), r.PathValue("id")
+		if !account.canManage(name) {
+			http.Error(w, fmt.Sprintf("Account '%s' cannot delete documents of workspace '%s'", account.Name, name), http.StatusForbidden)
+			return
+		}
+		result, err := db.Transact(func(tr Tx) (interface{}, error) {
+			doc, err := loadDocument(tr, name, id)
+			if err != nil {
+				return nil, err
+			}
+			if doc == nil {
+				return nil, errDocumentNotFound
+			}
+			deleteDocument(tr, name, id)
+			return doc, nil
+		})
+		if errors.Is(err, errDocumentNotFound) {
+			http.Error(w, fmt.Sprintf("Document '%s' not found", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting document: %v", err), http.StatusInternalServerError)
+			return
+		}
+		doc := result.(*Document)
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditKnowledgeDelete,
+			Workspace: name,
+			Target:    id,
+			Details:   map[string]string{"title": doc.Title},
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// searchKnowledgeHandler returns the excerpts ?q= retrieves for ?agent=, or
+// from the workspace-wide documents alone, to see what replies would be
+// given.
+func searchKnowledgeHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name := r.PathValue("name")
+		if !account.canView(name) {
+			http.Error(w, fmt.Sprintf("Workspace '%s' not found", name), http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query().Get("q")
+		if strings.TrimSpace(query) == "" {
+			http.Error(w, "Mandatory parameter 'q' is missing", http.StatusBadRequest)
+			return
+		}
+		config, err := workspaceConfig(db, name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading workspace config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		excerpts, err := retrieve(r.Context(), db, embedder, name, r.URL.Query().Get("agent"), query, config.Knowledge.results())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error searching documents: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if excerpts == nil {
+			excerpts = []Excerpt{}
+		}
+		writeJSON(w, excerpts)
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const handbook = `# Handbook
+
+Welcome to the company.
+
+## Parental leave
+
+Parents get 16 weeks of paid leave, to be taken within a year of the birth.
+
+## Expenses
+
+Travel is booked through the travel desk. Receipts are due within 30 days.
+`
+
+func TestChunkText(t *testing.T) {
+	chunks := chunkText(formatMarkdown, handbook)
+	if len(chunks) != 3 || chunks[1].Section != "Parental leave" || !strings.HasPrefix(chunks[1].Text, "Parents get 16 weeks") {
+		t.Errorf("chunkText = %+v, want one chunk per section", chunks)
+	}
+
+	long := strings.Repeat("All work and no play makes Jack a dull boy. ", 50)
+	chunks = chunkText(formatText, "Short intro.\n\n"+long)
+	if len(chunks) != 4 || chunks[0].Text != "Short intro." || chunks[0].Section != "" {
+		t.Fatalf("chunkText of a long paragraph = %d chunks, want it split in 3 after the intro", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len(chunk.Text) > chunkChars || strings.HasSuffix(chunk.Text, " ") {
+			t.Errorf("chunk of %d characters %q", len(chunk.Text), chunk.Text[len(chunk.Text)-10:])
+		}
+	}
+}
+
+// testPDF returns a PDF showing its content stream, compressed, next to an
+// image that must be skipped.
+func testPDF(content string) []byte {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write([]byte(content))
+	w.Close()
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	fmt.Fprintf(&pdf, "4 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", compressed.Len())
+	pdf.Write(compressed.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n")
+	pdf.WriteString("5 0 obj\n<< /Type /XObject /Subtype /Image /Length 4 >>\nstream\n\x00\x01\x02\x03\nendstream\nendobj\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+func TestPDFText(t *testing.T) {
+	text, err := pdfText(testPDF(`BT /F1 12 Tf 72 700 Td (Parental leave \(paid\)) Tj 0 -14 Td [(Parents get)-300(16 weeks)] TJ T* <4F4B> Tj ET`))
+	if want := "Parental leave (paid)\nParents get 16 weeks\nOK"; err != nil || text != want {
+		t.Errorf("pdfText = %q, %v, want %q", text, err, want)
+	}
+	if _, err := pdfText(testPDF(`BT /F1 12 Tf <0012003400560078> Tj ET`)); err == nil {
+		t.Errorf("pdfText of glyph IDs succeeded, want an error")
+	}
+	if _, err := pdfText([]byte("hello")); err == nil {
+		t.Errorf("pdfText of text succeeded, want an error")
+	}
+	// Text is not collected past what a document may hold
+	if _, err := pdfText(testPDF("BT (" + strings.Repeat("word ", maxDocumentChars) + ") Tj ET")); err == nil || !strings.Contains(err.Error(), "characters") {
+		t.Errorf("pdfText of %d words = %v, want too many characters", maxDocumentChars, err)
+	}
+	// Arrays nested without end are given up on, not recursed into
+	if _, err := pdfText(testPDF(strings.Repeat("[", 9<<20))); err == nil {
+		t.Errorf("pdfText of deeply nested arrays succeeded, want an error")
+	}
+	lex := pdfLexer{data: []byte(strings.Repeat("[", maxPDFNesting) + "(deep)" + strings.Repeat("]", maxPDFNesting))}
+	if token, ok := lex.next(); !ok || fmt.Sprint(token) != strings.Repeat("[", maxPDFNesting)+"deep"+strings.Repeat("]", maxPDFNesting) {
+		t.Errorf("arrays nested %d deep = %v, %v", maxPDFNesting, token, ok)
+	}
+}
+
+func TestHTTPEmbedder(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		// Out of order, as the API is allowed to answer
+		w.Write([]byte(`{"data": [{"index": 1, "embedding": [0, 2]}, {"index": 0, "embedding": [3, 4]}]}`))
+	}))
+	defer server.Close()
+
+	e := newEmbedder(server.URL+"/v1/", "tiny")
+	vectors, err := e.Embed(context.Background(), []string{"first", "second"})
+	if err != nil || fmt.Sprint(vectors) != "[[0.6 0.8] [0 1]]" {
+		t.Errorf("Embed = %v, %v, want normalised vectors in input order", vectors, err)
+	}
+	if got["model"] != "tiny" || e.Name() != "api:tiny" {
+		t.Errorf("embeddings request = %v, name %s", got, e.Name())
+	}
+	if _, ok := newEmbedder("", "tiny").(hashingEmbedder); !ok {
+		t.Errorf("newEmbedder without a URL is not the offline embedder")
+	}
+}
+
+func TestKnowledgeAPI(t *testing.T) {
+	db := newTestStore(t)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	viewer := newTestAccount(t, db, "vera", roleViewer, "cats")
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", Workspace: "cats", Name: "Marvin"}, "T07Q4VBFFHP")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /workspaces/{name}/knowledge", listDocumentsHandler(db))
+	mux.HandleFunc("POST /workspaces/{name}/knowledge", uploadDocumentHandler(db))
+	mux.HandleFunc("GET /workspaces/{name}/knowledge/search", searchKnowledgeHandler(db))
+	mux.HandleFunc("DELETE /workspaces/{name}/knowledge/{id}", deleteDocumentHandler(db))
+	do := func(token string, req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	upload := func(token, filename string, data []byte, fields map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, _ := writer.CreateFormFile("file", filename)
+		part.Write(data)
+		for key, value := range fields {
+			writer.WriteField(key, value)
+		}
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/workspaces/cats/knowledge", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return do(token, req)
+	}
+	search := func(query, agent string) []Excerpt {
+		rec := do(viewer, httptest.NewRequest(http.MethodGet, "/workspaces/cats/knowledge/search?q="+query+"&agent="+agent, nil))
+		var excerpts []Excerpt
+		if err := json.Unmarshal(rec.Body.Bytes(), &excerpts); err != nil {
+			t.Fatalf("search %q = %d %s", query, rec.Code, rec.Body)
+		}
+		return excerpts
+	}
+
+	rec := upload(owner, "handbook.md", []byte(handbook), nil)
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"title":"handbook"`) || !strings.Contains(rec.Body.String(), `"chunks":3`) {
+		t.Fatalf("upload = %d %s", rec.Code, rec.Body)
+	}
+	var doc Document
+	json.Unmarshal(rec.Body.Bytes(), &doc)
+	rec = upload(owner, "notes.txt", []byte("Marvin's secret: the answer is 42."), map[string]string{"agent": "marvin@example.com", "title": "Notes"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload for an agent = %d %s", rec.Code, rec.Body)
+	}
+	if rec := upload(owner, "leave.pdf", testPDF(`BT (Sabbaticals last 3 months.) Tj ET`), nil); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"format":"pdf"`) {
+		t.Errorf("upload of a PDF = %d %s", rec.Code, rec.Body)
+	}
+
+	excerpts := search("how+many+weeks+of+parental+leave", "")
+	if len(excerpts) == 0 || excerpts[0].Section != "Parental leave" || excerpts[0].Number != 1 || excerpts[0].Title != "handbook" {
+		t.Errorf("search for leave = %+v, want the parental leave section first", excerpts)
+	}
+	for _, e := range search("expenses+receipts", "") {
+		if e.Section == "Parental leave" {
+			t.Errorf("search for receipts included %+v", e)
+		}
+	}
+	// A passage sharing a stray word is no match, even with nothing better
+	if excerpts := search("is+there+a+dress+code+for+the+office+party+this+year", ""); len(excerpts) != 0 {
+		t.Errorf("search for the dress code = %+v, want nothing", excerpts)
+	}
+	if excerpts := search("secret+answer", ""); len(excerpts) != 0 {
+		t.Errorf("workspace search found an agent's document: %+v", excerpts)
+	}
+	if excerpts := search("secret+answer", "marvin@example.com"); len(excerpts) != 1 || excerpts[0].Title != "Notes" {
+		t.Errorf("agent search = %+v, want its notes", excerpts)
+	}
+
+	// The same title replaces the document
+	rec = upload(owner, "handbook.md", []byte("# Handbook\n\nParental leave is now 20 weeks."), nil)
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"id":"`+doc.ID+`"`) {
+		t.Errorf("upload of a new version = %d %s", rec.Code, rec.Body)
+	}
+	if excerpts := search("parental+leave", ""); len(excerpts) != 1 || !strings.Contains(excerpts[0].Text, "20 weeks") {
+		t.Errorf("search after replacing = %+v, want only the new version", excerpts)
+	}
+	rec = do(viewer, httptest.NewRequest(http.MethodGet, "/workspaces/cats/knowledge", nil))
+	if rec.Code != http.StatusOK || strings.Count(rec.Body.String(), `"id"`) != 3 {
+		t.Errorf("GET knowledge = %d %s, want 3 documents", rec.Code, rec.Body)
+	}
+
+	if rec := upload(viewer, "handbook.md", []byte(handbook), nil); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer upload = %d, want 403", rec.Code)
+	}
+	if rec := upload(owner, "logo.png", []byte("\x89PNG\r\n\x1a\n"), map[string]string{"agent": "arthur@example.com"}); rec.Code != http.StatusBadRequest || strings.Count(rec.Body.String(), "Invalid") != 2 {
+		t.Errorf("invalid upload = %d %q, want both problems", rec.Code, rec.Body)
+	}
+	if rec := do(owner, httptest.NewRequest(http.MethodDelete, "/workspaces/cats/knowledge/"+doc.ID, nil)); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE document = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(owner, httptest.NewRequest(http.MethodDelete, "/workspaces/cats/knowledge/"+doc.ID, nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE deleted document = %d, want 404", rec.Code)
+	}
+	if excerpts := search("parental+leave", ""); len(excerpts) != 0 {
+		t.Errorf("search after deleting = %+v", excerpts)
+	}
+}
+
+func TestKnowledgeReply(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	user := &UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", Name: "Marvin"}
+	storeUserCredentials(db, *user, "T07Q4VBFFHP")
+	doc := &Document{Workspace: "cats", Title: "Handbook", Format: formatMarkdown, Embedder: embedder.Name()}
+	chunks := chunkText(formatMarkdown, handbook)
+	if err := embedChunks(context.Background(), embedder, chunks); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDocument(db, doc, chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	session := newSlackSession("cats")
+	fake.llmReply = "Sixteen weeks [1]."
+	message := QueuedMessage{Channel: "D0000CATS", Text: "How long is parental leave?"}
+	if err := answerMessage(context.Background(), db, session, user, message); err != nil {
+		t.Fatalf("answerMessage: %v", err)
+	}
+	requests := fake.llmRequests()
+	if len(requests) != 1 || !strings.Contains(chatText(requests[0]), `[1] Handbook › Parental leave\nParents get 16 weeks`) {
+		t.Errorf("LLM request = %s, want the parental leave excerpt", chatText(requests[0]))
+	}
+	posted := fake.postedMessages()
+	if len(posted) != 1 || posted[0].Get("text") != "Sixteen weeks [1].\n\n_Sources: [1] Handbook › Parental leave_" {
+		t.Errorf("reply = %v, want the source cited", posted)
+	}
+
+	// Unrelated questions go without
+	fake.llmReply = "Don't panic."
+	if err := answerMessage(context.Background(), db, session, user, QueuedMessage{Channel: "D0000CATS", Text: "Tell me a joke"}); err != nil {
+		t.Fatalf("answerMessage: %v", err)
+	}
+	if posted := fake.postedMessages(); posted[1].Get("text") != "Don't panic." {
+		t.Errorf("unrelated reply = %q, want no sources", posted[1].Get("text"))
+	}
+	excerpts, err := knowledgeFor(context.Background(), db, user, &WorkspaceConfig{Knowledge: Knowledge{Disabled: true}}, message.Text)
+	if err != nil || len(excerpts) != 0 {
+		t.Errorf("knowledge of a workspace that disabled it = %v, %v", excerpts, err)
+	}
+}
+
+func TestCitations(t *testing.T) {
+	excerpts := []Excerpt{{Number: 1, Title: "Handbook", Section: "Leave"}, {Number: 2, Title: "FAQ"}}
+	tests := []struct {
+		answer string
+		want   string
+	}{
+		{"It is 16 weeks [2].", "\n\n_Sources: [2] FAQ_"},
+		{"See [1] and [2].", "\n\n_Sources: [1] Handbook › Leave; [2] FAQ_"},
+		{"It is 16 weeks.", ""},
+		{"See [3].", ""},
+	}
+	for _, test := range tests {
+		if got := citations(test.answer, excerpts); got != test.want {
+			t.Errorf("citations(%q) = %q, want %q", test.answer, got, test.want)
+		}
+	}
+	if got := citations("Hi", nil); got != "" {
+		t.Errorf("citations without excerpts = %q", got)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,13 +13,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	// "regexp"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/gorilla/websocket"
 )
 
@@ -26,6 +30,23 @@ type UserCredential struct {
 	Email     string
 	APIToken  string
 	Workspace string
+	Name      string
+	// Avatar is the ID of the profile image, uploaded or generated.
+	Avatar string
+	// Appearance describes the agent; its avatar can be regenerated from it.
+	Appearance string
+	// Owner is the Slack user the agent was invited for.
+	Owner string
+	// SlackID is the agent's own Slack user ID, learned when it connects.
+	SlackID string
+	// Timezone is the IANA time zone the agent works in; Schedule, if set,
+	// is when it does.
+	Timezone string
+	Schedule *Schedule
+	// TokenError is the Slack error from the last failed token check, empty
+	// while the token is valid.
+	TokenError     string
+	TokenCheckedAt time.Time
 }
 
 type VerificationCode struct {
@@ -34,6 +55,10 @@ type VerificationCode struct {
 }
 
 type SlackInvite struct {
+	// InviteURL and ClientURL are the links as copied from Slack; the fields
+	// below that they contain are filled from them
+	InviteURL   string `json:"invite_url"`
+	ClientURL   string `json:"client_url"`
 	Workspace   string `json:"workspace"`
 	InviteCode  string `json:"invite_code"`
 	Name        string `json:"name"`
@@ -41,6 +66,55 @@ type SlackInvite struct {
 	System      string `json:"system"`
 	Team        string `json:"team"`
 	PrimaryUser string `json:"user"`
+	// Optional; the workspace's settings apply when they are empty. These
+	// and OwnerField and NameTemplate are for this agent only, the workspace
+	// defaults are set with PUT /workspaces/{name}/config
+	WelcomeChannel string `json:"welcome_channel"`
+	WelcomeMessage string `json:"welcome_message"`
+	// Avatar is the ID of an image uploaded to /avatars for this workspace
+	Avatar string `json:"avatar"`
+	// OwnerField is the ID of a custom profile field to set to PrimaryUser,
+	// the agent's owner
+	OwnerField string `json:"owner_field"`
+	// NameTemplate names agents invited without a Name, see NameData
+	NameTemplate string `json:"name_template"`
+	// Timezone defaults to AGENT_TIMEZONE; without a Schedule the agent
+	// answers around the clock
+	Timezone string    `json:"timezone"`
+	Schedule *Schedule `json:"schedule"`
+
+	// dm is the DM channel ClientURL pointed at, if it did
+	dm string
+}
+
+// agentSignup is everything needed to create an agent's Slack account.
+type agentSignup struct {
+	Email      string
+	Workspace  string
+	InviteCode string
+	Team       string
+	Name       string
+	Avatar     string
+	// Appearance is turned into an avatar when no Avatar was uploaded
+	Appearance string
+	// System is the agent's prompt; empty keeps defaultSystemPrompt
+	System string
+	// RequestedBy is the audit actor the agent is created for
+	RequestedBy string
+	// Owner is the Slack user ID of the agent's primary user, and DM the DM
+	// channel the invite's Slack URL pointed at, where the owner is told the
+	// agent is ready if Owner is not known
+	Owner string
+	DM    string
+	// WelcomeChannel, WelcomeMessage and OwnerField override the
+	// workspace's settings for this agent when set
+	WelcomeChannel string
+	WelcomeMessage string
+	OwnerField     string
+	// Timezone is set on the Slack account; it and Schedule decide when the
+	// agent works
+	Timezone string
+	Schedule *Schedule
 }
 
 var verificationCodes = make(map[string]string)
@@ -57,8 +131,121 @@ func init() {
 	log.SetOutput(logFile)
 }
 
-func slackInviteHandler(db fdb.Database) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// checkInvite fills the fields of invite that its URLs contain and returns
+// one line for each field that is missing or invalid.
+func checkInvite(invite *SlackInvite, account *Account) []string {
+	var problems []string
+	invalid := func(field string, err error) {
+		problems = append(problems, fmt.Sprintf("Invalid '%s': %v", field, err))
+	}
+	// fill sets *field to the value parsed from a URL, unless it was also
+	// given on its own and the two disagree
+	fill := func(field *string, name, parsed, from string) {
+		if *field != "" && *field != parsed {
+			invalid(name, fmt.Errorf("%q does not match %q from %s", *field, parsed, from))
+			return
+		}
+		*field = parsed
+	}
+
+	if invite.InviteURL != "" {
+		if workspace, code, err := parseInviteURL(invite.InviteURL); err != nil {
+			invalid("InviteURL", err)
+		} else {
+			fill(&invite.Workspace, "Workspace", workspace, "InviteURL")
+			fill(&invite.InviteCode, "InviteCode", code, "InviteURL")
+		}
+	}
+	if invite.ClientURL != "" {
+		if client, err := parseClientURL(invite.ClientURL); err != nil {
+			invalid("ClientURL", err)
+		} else {
+			fill(&invite.Team, "Team", client.Team, "ClientURL")
+			if client.User != "" {
+				fill(&invite.PrimaryUser, "PrimaryUser", client.User, "ClientURL")
+			}
+			invite.dm = client.DM
+		}
+	}
+	// The account submitting the form owns the agent unless it says otherwise
+	if invite.PrimaryUser == "" {
+		invite.PrimaryUser = account.SlackUser
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	mandatoryFields := []struct {
+		name  string
+		value string
+	}{
+		{"Workspace", invite.Workspace},
+		{"InviteCode", invite.InviteCode},
+		{"Appearance", invite.Appearance},
+		{"System", invite.System},
+		{"Team", invite.Team},
+		{"PrimaryUser", invite.PrimaryUser},
+	}
+	for _, field := range mandatoryFields {
+		if field.value == "" {
+			problems = append(problems, fmt.Sprintf("Mandatory field '%s' is missing", field.name))
+		}
+	}
+	if invite.PrimaryUser == "" && invite.dm != "" {
+		problems = append(problems, fmt.Sprintf("ClientURL points at the DM channel %s, not a user: open the owner's profile and copy that link, or give 'PrimaryUser'", invite.dm))
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	if err := validateWorkspaceName(invite.Workspace); err != nil {
+		invalid("Workspace", err)
+	}
+	if err := validateInviteCode(invite.InviteCode); err != nil {
+		invalid("InviteCode", err)
+	}
+	if err := expectSlackID(invite.Team, slackIDTeam); err != nil {
+		invalid("Team", err)
+	}
+	if err := expectSlackID(invite.PrimaryUser, slackIDUser); err != nil {
+		invalid("PrimaryUser", err)
+	}
+	if err := validateWelcome(invite.WelcomeMessage); err != nil {
+		invalid("WelcomeMessage", err)
+	}
+	if _, err := validatePrompt(invite.System); err != nil {
+		invalid("System", err)
+	}
+	var err error
+	if invite.Appearance, err = validateAppearance(invite.Appearance); err != nil {
+		invalid("Appearance", err)
+	}
+	if invite.Name != "" {
+		if _, err := validateDisplayName(invite.Name); err != nil {
+			invalid("Name", err)
+		}
+	}
+	if invite.NameTemplate != "" {
+		if _, err := renderName(invite.NameTemplate, NameData{Owner: account.Name, Workspace: invite.Workspace, Number: 1}); err != nil {
+			invalid("NameTemplate", err)
+		}
+	}
+	if invite.Timezone != "" {
+		if err := validateTimezone(invite.Timezone); err != nil {
+			invalid("Timezone", err)
+		}
+	}
+	if invite.Schedule != nil {
+		problems = append(problems, invite.Schedule.validate()...)
+	}
+	if invite.OwnerField != "" && !profileFieldIDPattern.MatchString(invite.OwnerField) {
+		invalid("OwnerField", fmt.Errorf("expected a profile field ID such as Xf01ABCDEF"))
+	}
+	return problems
+}
+
+func slackInviteHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -70,83 +257,226 @@ func slackInviteHandler(db fdb.Database) http.HandlerFunc {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
-		// Check if all mandatory fields are present
-		mandatoryFields := []struct {
-			name  string
-			value string
-		}{
-			{"Workspace", slackInvite.Workspace},
-			{"InviteCode", slackInvite.InviteCode},
-			{"Name", slackInvite.Name},
-			{"Appearance", slackInvite.Appearance},
-			{"System", slackInvite.System},
-			{"Team", slackInvite.Team},
-			{"PrimaryUser", slackInvite.PrimaryUser},
-		}
-
-		for _, field := range mandatoryFields {
-			if field.value == "" {
-				http.Error(w, fmt.Sprintf("Mandatory field '%s' is missing", field.name), http.StatusBadRequest)
+		if problems := checkInvite(&slackInvite, account); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+			return
+		}
+		if !account.canManage(slackInvite.Workspace) {
+			http.Error(w, fmt.Sprintf("Account '%s' cannot add agents to workspace '%s'", account.Name, slackInvite.Workspace), http.StatusForbidden)
+			return
+		}
+		if slackInvite.Avatar != "" {
+			avatar, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+				return loadAvatarMeta(tr, slackInvite.Avatar)
+			})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error loading avatar: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if a := avatar.(*Avatar); a == nil || a.Workspace != slackInvite.Workspace {
+				http.Error(w, fmt.Sprintf("Avatar '%s' was not uploaded for workspace '%s'", slackInvite.Avatar, slackInvite.Workspace), http.StatusBadRequest)
 				return
 			}
 		}
 
+		// The same invite submitted again gets the agent it already made
+		key, err := inviteKey(r, &slackInvite)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'Idempotency-Key': %v", err), http.StatusBadRequest)
+			return
+		}
+		claim, err := lookupInvite(db, slackInvite.Workspace, key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error looking up invite: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if claim != nil {
+			log.Printf("\033[1;33mInvite %s for workspace %s already submitted, agent %s is %s\033[0m", key, slackInvite.Workspace, claim.Email, claim.Status)
+			writeExistingAgent(w, db, claim)
+			return
+		}
+
 		// Log the entire Slack invite object
 		log.Printf("\033[1;34m[INFO]\033[0m Received Slack invite request: %+v\033[0m", slackInvite)
 
-		// Store the invite details in the database
-		_, err = db.Transact(func(tr fdb.Transaction) (interface{}, error) {
-			workspaceKey := fdb.Key(fmt.Sprintf("workspace_%s", slackInvite.Workspace))
-
-			// Create a new struct with only the required fields
-			inviteData := struct {
-				Workspace   string `json:"workspace"`
-				InviteCode  string `json:"invite_code"`
-				Team        string `json:"team"`
-				PrimaryUser string `json:"user"`
-			}{
-				Workspace:   slackInvite.Workspace,
-				InviteCode:  slackInvite.InviteCode,
-				Team:        slackInvite.Team,
-				PrimaryUser: slackInvite.PrimaryUser,
+		name, err := agentName(db, slackInvite.Workspace, slackInvite.Name, slackInvite.NameTemplate, account.Name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error naming agent: %v", err), http.StatusBadRequest)
+			return
+		}
+		existing, err := findAgent(db, slackInvite.Workspace, slackInvite.PrimaryUser, name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error looking for existing agents: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			log.Printf("\033[1;33m%s already has agent %s (%s) in workspace %s\033[0m", slackInvite.PrimaryUser, name, existing.Email, slackInvite.Workspace)
+			if err := finishInvite(db, slackInvite.Workspace, key, existing.Email, onboardingCreated); err != nil {
+				log.Printf("\033[1;31m%v\033[0m", err)
 			}
+			writeExistingAgent(w, db, &InviteClaim{Key: key, Workspace: slackInvite.Workspace, Email: existing.Email, Status: onboardingCreated})
+			return
+		}
+		email := fmt.Sprintf("users+%08d@tgopi.com", rand.Intn(100000000))
+		claim, fresh, err := claimInvite(db, slackInvite.Workspace, key, email)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !fresh {
+			writeExistingAgent(w, db, claim)
+			return
+		}
 
-			workspaceData, err := json.Marshal(inviteData)
+		// Store the invite details in the database, now that they make an agent
+		_, err = db.Transact(func(tr Tx) (interface{}, error) {
+			workspace, err := upsertWorkspace(tr, slackInvite.Workspace, slackInvite.Team, slackInvite.InviteCode, slackInvite.PrimaryUser)
 			if err != nil {
-				return nil, fmt.Errorf("error marshaling workspace data: %v", err)
+				return nil, err
 			}
-			tr.Set(workspaceKey, workspaceData)
-			return nil, nil
+			if slackInvite.dm != "" {
+				workspace.PrimaryDM = slackInvite.dm
+			}
+			return workspace, saveWorkspace(tr, workspace)
 		})
-
 		if err != nil {
+			if err := finishInvite(db, slackInvite.Workspace, key, email, onboardingFailed); err != nil {
+				log.Printf("\033[1;31m%v\033[0m", err)
+			}
 			http.Error(w, fmt.Sprintf("Error storing workspace data: %v", err), http.StatusInternalServerError)
 			return
 		}
-
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "Slack invite processed and stored successfully for workspace: %s", slackInvite.Workspace)
+		actor := account.actor()
+		recordAudit(db, AuditEntry{
+			Actor:     actor,
+			Action:    auditInviteSubmit,
+			Workspace: slackInvite.Workspace,
+			Target:    name,
+			Details:   map[string]string{"team": slackInvite.Team, "user": slackInvite.PrimaryUser},
+		})
 
 		// Call createNewUser function
-		email := fmt.Sprintf("users+%08d@tgopi.com", rand.Intn(100000000))
-		createNewUser(db, email, slackInvite.Workspace, slackInvite.InviteCode, slackInvite.Team, slackInvite.Name)
+		onboarding := OnboardingEvent{
+			Workspace:   slackInvite.Workspace,
+			Name:        name,
+			PrimaryUser: slackInvite.PrimaryUser,
+			Email:       email,
+			Status:      onboardingRequested,
+		}
+		recordOnboarding(db, onboarding)
+
+		signup := agentSignup{
+			Email:       email,
+			Workspace:   slackInvite.Workspace,
+			InviteCode:  slackInvite.InviteCode,
+			Team:        slackInvite.Team,
+			Name:        name,
+			Avatar:      slackInvite.Avatar,
+			Appearance:  slackInvite.Appearance,
+			System:      slackInvite.System,
+			RequestedBy: actor,
+			Owner:       slackInvite.PrimaryUser,
+			DM:          slackInvite.dm,
+			Timezone:    slackInvite.Timezone,
+			Schedule:    slackInvite.Schedule,
+
+			WelcomeChannel: slackInvite.WelcomeChannel,
+			WelcomeMessage: slackInvite.WelcomeMessage,
+			OwnerField:     slackInvite.OwnerField,
+		}
+		// Signup waits for the emailed code; finish it even if the submitter
+		// has gone away
+		ctx := context.WithoutCancel(r.Context())
+		if err := createNewUser(ctx, db, signup); err != nil {
+			log.Printf("\033[1;31mError creating user for workspace %s: %v\033[0m", slackInvite.Workspace, err)
+			onboarding.Status, onboarding.Error = onboardingFailed, err.Error()
+			recordOnboarding(db, onboarding)
+			recordAudit(db, AuditEntry{
+				Actor:     actor,
+				Action:    auditAgentCreateFailed,
+				Workspace: slackInvite.Workspace,
+				Target:    email,
+				Details:   map[string]string{"error": err.Error()},
+			})
+			notifyOnboardingFailed(ctx, onboarding)
+			// A failed invite can be submitted again
+			if err := finishInvite(db, slackInvite.Workspace, key, email, onboardingFailed); err != nil {
+				log.Printf("\033[1;31m%v\033[0m", err)
+			}
+			http.Error(w, fmt.Sprintf("Error creating user for workspace %s: %v", slackInvite.Workspace, err), http.StatusBadGateway)
+			return
+		}
+		onboarding.Status = onboardingCreated
+		recordOnboarding(db, onboarding)
+		if err := finishInvite(db, slackInvite.Workspace, key, email, onboardingCreated); err != nil {
+			log.Printf("\033[1;31m%v\033[0m", err)
+		}
+		recordAudit(db, AuditEntry{Actor: actor, Action: auditAgentCreate, Workspace: slackInvite.Workspace, Target: email})
 
+		w.WriteHeader(http.StatusCreated)
 		fmt.Fprintf(w, "New user created successfully for workspace: %s", slackInvite.Workspace)
-	}
+	})
 }
 
 func main() {
-	// Initialize FoundationDB
-	fdb.APIVersion(730)
-	db := fdb.MustOpenDefault()
+	// Initialize FoundationDB, or the in-memory store when STORE=memory
+	db := openStore()
+	if err := useKeyspace(db); err != nil {
+		log.Fatalf("\033[1;31mError opening keyspace: %v\033[0m", err)
+	}
+
+	// Administrative commands such as "migrate" run instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(db, os.Args[1:]); err != nil {
+			log.Printf("\033[1;31m%s failed: %v\033[0m", os.Args[1], err)
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := checkSchema(db); err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking schema: %v\n", err)
+		log.Fatalf("\033[1;31mError checking schema: %v\033[0m", err)
+	}
 
 	// Start the Hello World API
 	http.HandleFunc("/", helloHandler)
 	http.HandleFunc("/webhook", webhookHandler)
+	runner := newAgentRunner()
+
 	http.HandleFunc("/invite", slackInviteHandler(db))
+	http.HandleFunc("DELETE /agents/{email}", deleteAgentHandler(db, runner))
+	http.HandleFunc("GET /agents/{email}/prompts", promptsHandler(db))
+	http.HandleFunc("PUT /agents/{email}/prompt", updatePromptHandler(db))
+	http.HandleFunc("POST /agents/{email}/prompt/preview", previewPromptHandler(db))
+	http.HandleFunc("GET /status", statusHandler(db, runner))
+	http.HandleFunc("GET /workspaces", listWorkspacesHandler(db))
+	http.HandleFunc("GET /workspaces/{name}/agents", workspaceAgentsHandler(db))
+	http.HandleFunc("GET /workspaces/{name}/history", workspaceHistoryHandler(db))
+	http.HandleFunc("GET /workspaces/{name}/config", getConfigHandler(db))
+	http.HandleFunc("PUT /workspaces/{name}/config", putConfigHandler(db))
+	http.HandleFunc("GET /workspaces/{name}/knowledge", listDocumentsHandler(db))
+	http.HandleFunc("POST /workspaces/{name}/knowledge", uploadDocumentHandler(db))
+	http.HandleFunc("GET /workspaces/{name}/knowledge/search", searchKnowledgeHandler(db))
+	http.HandleFunc("DELETE /workspaces/{name}/knowledge/{id}", deleteDocumentHandler(db))
+	http.HandleFunc("GET /audit", auditHandler(db))
+	http.HandleFunc("POST /avatars", uploadAvatarHandler(db))
+	http.HandleFunc("GET /avatars/{id}", getAvatarHandler(db))
+	http.HandleFunc("POST /agents/{email}/avatar", regenerateAvatarHandler(db))
+	http.HandleFunc("GET /agents/{email}/schedule", getScheduleHandler(db))
+	http.HandleFunc("PUT /agents/{email}/schedule", putScheduleHandler(db))
+	http.HandleFunc("GET /agents/{email}/jobs", listJobsHandler(db))
+	http.HandleFunc("POST /agents/{email}/jobs", createJobHandler(db))
+	http.HandleFunc("DELETE /agents/{email}/jobs/{id}", deleteJobHandler(db))
+	// The server, scheduler and token checker run until the process is told to
+	// stop, however many agents are running
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: ":8009"}
 	log.Println("\033[1;34mStarting Hello World API and Webhook on :8009\033[0m")
 	go func() {
-		if err := http.ListenAndServe(":8009", nil); err != nil {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("\033[1;31mError starting server: %v\033[0m", err)
 		}
 	}()
@@ -162,37 +492,65 @@ func main() {
 	answer = strings.TrimSpace(strings.ToLower(answer))
 
 	if answer == "y" || answer == "yes" {
-		// Use the credentials already present in main
-		email := fmt.Sprintf("users+%08d@tgopi.com", rand.Intn(100000000))
-		workspace := "dogcattalk"
-		sharedInviteCode := "zt-2rggdrx7r-gPbD08EqfwfhjluP0B4jNQ"
-		team := "T07Q4VBFFHP"
-		fullName := generateFullName(rand.Intn(100000000))
-		createNewUser(db, email, workspace, sharedInviteCode, team, fullName)
+		// Use the invite details stored for the workspace by an earlier invite
+		fmt.Print("\033[1;32mWorkspace to add the agent to: \033[0m")
+		name, _ := reader.ReadString('\n')
+		result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return loadWorkspace(tr, strings.TrimSpace(name))
+		})
+		workspace, _ := result.(*Workspace)
+		switch {
+		case err != nil:
+			log.Printf("\033[1;31mError loading workspace: %v\033[0m", err)
+		case workspace == nil || workspace.InviteCode == "" || workspace.TeamID == "":
+			log.Printf("\033[1;31mWorkspace %q has no stored invite, submit one through /invite first\033[0m", strings.TrimSpace(name))
+			fmt.Fprintf(os.Stderr, "Workspace %q has no stored invite, submit one through /invite first\n", strings.TrimSpace(name))
+		default:
+			email := fmt.Sprintf("users+%08d@tgopi.com", rand.Intn(100000000))
+			fullName, err := agentName(db, workspace.Name, "", "", "")
+			if err != nil {
+				log.Fatalf("\033[1;31mError naming agent: %v\033[0m", err)
+			}
+			signup := agentSignup{Email: email, Workspace: workspace.Name, InviteCode: workspace.InviteCode, Team: workspace.TeamID, Name: fullName, RequestedBy: actorConsole, Owner: workspace.PrimaryUser, DM: workspace.PrimaryDM}
+			if err := createNewUser(context.Background(), db, signup); err != nil {
+				log.Printf("\033[1;31mError creating user: %v\033[0m", err)
+			} else {
+				recordAudit(db, AuditEntry{Actor: actorConsole, Action: auditAgentCreate, Workspace: workspace.Name, Target: email})
+			}
+		}
 	}
 
 	users := retrieveAllUsers(db)
 
-	var wg sync.WaitGroup
-
 	for _, user := range users {
-		wg.Add(1)
-		go func(user UserCredential) {
-			defer wg.Done()
-			handleUserMessages(db, user)
-		}(user)
+		if user.TokenError != "" {
+			log.Printf("\033[1;33mNot starting user %s, token invalid: %s\033[0m", user.Email, user.TokenError)
+			continue
+		}
+		runner.start(db, user)
 	}
 
-	wg.Wait()
+	go runTokenChecker(ctx, db, runner, cfg.TokenCheckInterval)
+	go runScheduler(ctx, db)
+
+	<-ctx.Done()
+	log.Println("\033[1;34mShutting down\033[0m")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("\033[1;31mError stopping server: %v\033[0m", err)
+	}
+	runner.shutdown()
 }
 
-func listExistingUsers(db fdb.Database) {
-	_, err := db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+func listExistingUsers(db Store) {
+	_, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
 		log.Println("\033[1;32mExisting users:\033[0m")
-		kr := tr.GetRange(fdb.KeyRange{Begin: fdb.Key("user_"), End: fdb.Key("user_\xFF")}, fdb.RangeOptions{})
-		iter := kr.Iterator()
-		for iter.Advance() {
-			kv := iter.MustGet()
+		kvs, err := tr.GetRange(ks.users, fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
 			var user UserCredential
 			if err := json.Unmarshal(kv.Value, &user); err != nil {
 				log.Printf("\033[1;31mError unmarshaling user: %v\033[0m", err)
@@ -207,62 +565,118 @@ func listExistingUsers(db fdb.Database) {
 	}
 }
 
-func createNewUser(db fdb.Database, email, workspace, sharedInviteCode, team, fullName string) {
-	log.Printf("\033[1;36mUsing email: %s for workspace: %s\033[0m", email, workspace)
+func createNewUser(ctx context.Context, db Store, signup agentSignup) error {
+	log.Printf("\033[1;36mUsing email: %s for workspace: %s\033[0m", signup.Email, signup.Workspace)
 
-	// Base URL for Slack API
-	baseURL := fmt.Sprintf("https://%s.slack.com/api", workspace)
+	// Each signup gets its own session so its cookies stay with this account
+	session := newSlackSession(signup.Workspace)
 
-	// Initialize cookies
-	cookies := make([]*http.Cookie, 0)
-
-	cookies = checkEmailAvailability(baseURL, email, cookies)
-	cookies = confirmEmail(baseURL, email, cookies)
-	confirmationCode := waitForVerificationCode(email)
-	cookies = confirmVerificationCode(baseURL, email, confirmationCode, cookies)
+	if err := checkEmailAvailability(ctx, session, signup.Email); err != nil {
+		return err
+	}
+	if err := confirmEmail(ctx, session, signup.Email); err != nil {
+		return err
+	}
+	confirmationCode, err := waitForVerificationCode(ctx, signup.Email)
+	if err != nil {
+		return err
+	}
+	if err := confirmVerificationCode(ctx, session, signup.Email, confirmationCode); err != nil {
+		return err
+	}
 
-	apiToken := createSlackUser(baseURL, fullName, workspace, sharedInviteCode, team, cookies)
+	if signup.Timezone == "" {
+		signup.Timezone = cfg.AgentTimezone
+	}
+	apiToken, err := createSlackUser(ctx, session, signup.Name, signup.InviteCode, signup.Team, signup.Timezone)
+	if err != nil {
+		return err
+	}
 
-	storeUserCredentials(db, email, apiToken, workspace)
+	avatarID := signupAvatar(ctx, db, signup)
+
+	storeUserCredentials(db, UserCredential{
+		Email:      signup.Email,
+		APIToken:   apiToken,
+		Workspace:  signup.Workspace,
+		Name:       signup.Name,
+		Avatar:     avatarID,
+		Appearance: signup.Appearance,
+		Owner:      signup.Owner,
+		Timezone:   signup.Timezone,
+		Schedule:   signup.Schedule,
+	}, signup.Team)
+	if signup.System != "" {
+		if _, err := savePrompt(db, signup.Email, signup.System, signup.RequestedBy); err != nil {
+			log.Printf("\033[1;31mError storing prompt for user %s: %v\033[0m", signup.Email, err)
+		}
+	}
 
-	updateProfilePicture(baseURL, apiToken)
+	updateProfilePicture(ctx, db, session, apiToken, avatarID, signup.Workspace)
 
-	sendInitialMessage(baseURL, apiToken)
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadWorkspace(tr, signup.Workspace)
+	})
+	if err != nil || result.(*Workspace) == nil {
+		log.Printf("\033[1;31mError loading workspace %s: %v\033[0m", signup.Workspace, err)
+		return nil
+	}
+	ws := result.(*Workspace)
+	// The invite's own settings win, without changing the workspace's
+	if signup.WelcomeChannel != "" {
+		ws.WelcomeChannel = signup.WelcomeChannel
+	}
+	if signup.WelcomeMessage != "" {
+		ws.WelcomeMessage = signup.WelcomeMessage
+	}
+	if signup.OwnerField != "" {
+		ws.OwnerField = signup.OwnerField
+	}
+	if err := setAgentProfile(ctx, session, apiToken, signup.Owner, ws); err != nil {
+		log.Printf("\033[1;31mError marking profile as AI assistant: %v\033[0m", err)
+	}
+	sendWelcomeMessage(ctx, session, apiToken, signup.Name, signup.Owner, ws)
+	if err := notifyOwnerReady(ctx, session, apiToken, signup); err != nil {
+		log.Printf("\033[1;31mError telling the owner of %s that the agent is ready: %v\033[0m", signup.Workspace, err)
+	}
+	return nil
 }
 
-func checkEmailAvailability(baseURL, email string, cookies []*http.Cookie) []*http.Cookie {
-	checkEmailURL := fmt.Sprintf("%s/signup.checkEmail", baseURL)
+func checkEmailAvailability(ctx context.Context, session *slackSession, email string) error {
 	checkEmailData := url.Values{}
 	checkEmailData.Set("email", email)
-	log.Printf("\033[1;33mChecking email availability at: %s\033[0m", checkEmailURL)
-	resp, err := sendRequest(http.MethodPost, checkEmailURL, checkEmailData, cookies)
+	log.Printf("\033[1;33mChecking email availability at: %s/signup.checkEmail\033[0m", session.apiURL)
+	resp, err := session.post(ctx, "signup.checkEmail", checkEmailData)
 	if err != nil {
-		log.Fatalf("\033[1;31mError checking email: %v\033[0m", err)
+		return fmt.Errorf("error checking email: %v", err)
 	}
 	defer resp.Body.Close()
-	cookies = updateCookies(cookies, resp.Cookies())
 	logResponse("Email check", resp)
-	return cookies
+	return nil
 }
 
-func confirmEmail(baseURL, email string, cookies []*http.Cookie) []*http.Cookie {
-	confirmEmailURL := fmt.Sprintf("%s/signup.confirmEmail", baseURL)
+func confirmEmail(ctx context.Context, session *slackSession, email string) error {
 	confirmEmailData := url.Values{}
 	confirmEmailData.Set("email", email)
 	confirmEmailData.Set("locale", "en-US")
-	log.Printf("\033[1;33mConfirming email at: %s\033[0m", confirmEmailURL)
-	resp, err := sendRequest(http.MethodPost, confirmEmailURL, confirmEmailData, cookies)
+	log.Printf("\033[1;33mConfirming email at: %s/signup.confirmEmail\033[0m", session.apiURL)
+	resp, err := session.post(ctx, "signup.confirmEmail", confirmEmailData)
 	if err != nil {
-		log.Fatalf("\033[1;31mError confirming email: %v\033[0m", err)
+		return fmt.Errorf("error confirming email: %v", err)
 	}
 	defer resp.Body.Close()
-	cookies = updateCookies(cookies, resp.Cookies())
 	logResponse("Email confirmation", resp)
-	return cookies
+	return nil
 }
 
-func waitForVerificationCode(email string) string {
+func waitForVerificationCode(ctx context.Context, email string) (string, error) {
 	log.Printf("\033[1;32mWaiting for verification code for email: %s\033[0m", email)
+	ctx, cancel := context.WithTimeout(ctx, cfg.VerificationTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
 	var confirmationCode string
 	for {
 		verificationCodesMutex.Lock()
@@ -274,39 +688,33 @@ func waitForVerificationCode(email string) string {
 			break
 		}
 		verificationCodesMutex.Unlock()
-		time.Sleep(1 * time.Second)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", fmt.Errorf("no verification code received for %s: %v", email, ctx.Err())
+		}
 	}
 	log.Printf("\033[1;36mReceived confirmation code: %s\033[0m", confirmationCode)
-	return confirmationCode
+	return confirmationCode, nil
 }
 
-func confirmVerificationCode(baseURL, email, confirmationCode string, cookies []*http.Cookie) []*http.Cookie {
-	signInURL := fmt.Sprintf("%s/signin.confirmCode", baseURL)
+func confirmVerificationCode(ctx context.Context, session *slackSession, email, confirmationCode string) error {
 	signInData := url.Values{}
 	signInData.Set("email", email)
 	signInData.Set("code", strings.ReplaceAll(confirmationCode, "-", ""))
-	log.Printf("\033[1;33mConfirming code at: %s\033[0m", signInURL)
-	resp, err := sendRequest(http.MethodPost, signInURL, signInData, cookies)
+	log.Printf("\033[1;33mConfirming code at: %s/signin.confirmCode\033[0m", session.apiURL)
+	resp, err := session.post(ctx, "signin.confirmCode", signInData)
 	if err != nil {
-		log.Fatalf("\033[1;31mError confirming code: %v\033[0m", err)
+		return fmt.Errorf("error confirming code: %v", err)
 	}
 	defer resp.Body.Close()
-	cookies = updateCookies(cookies, resp.Cookies())
 	logResponse("Confirm code", resp)
-	return cookies
+	return nil
 }
 
-func generateFullName(randomNum int) string {
-	fullName, err := getRandomFullName()
-	if err != nil {
-		log.Printf("\033[1;31mError generating full name: %v\033[0m", err)
-		fullName = fmt.Sprintf("User%08d", randomNum)
-	}
-	return fullName
-}
-
-func createSlackUser(baseURL, fullName, workspace, sharedInviteCode, team string, cookies []*http.Cookie) string {
-	createUserURL := fmt.Sprintf("https://%s.slack.com/api/signup.createUser", workspace)
+func createSlackUser(ctx context.Context, session *slackSession, fullName, sharedInviteCode, team, tz string) (string, error) {
+	createUserURL := fmt.Sprintf("%s/signup.createUser", session.apiURL)
 	log.Printf("\033[1;34mPreparing to create user at URL: %s\033[0m", createUserURL)
 
 	createUserData := url.Values{}
@@ -319,7 +727,7 @@ func createSlackUser(baseURL, fullName, workspace, sharedInviteCode, team string
 	createUserData.Set("real_name", fullName)
 	createUserData.Set("shared_invite_code", sharedInviteCode)
 	createUserData.Set("team", team)
-	createUserData.Set("tz", "America/Los_Angeles")
+	createUserData.Set("tz", tz)
 
 	log.Printf("\033[1;34mUser data prepared:")
 	for key, values := range createUserData {
@@ -327,57 +735,54 @@ func createSlackUser(baseURL, fullName, workspace, sharedInviteCode, team string
 	}
 
 	log.Printf("\033[1;33mSending request to create user at: %s\033[0m", createUserURL)
-	resp, err := sendRequest(http.MethodPost, createUserURL, createUserData, cookies)
+	resp, err := session.post(ctx, "signup.createUser", createUserData)
 	if err != nil {
 		log.Printf("\033[1;31mError creating user: %v\033[0m", err)
-		log.Fatalf("\033[1;31mFailed to create user. Exiting.\033[0m")
+		return "", fmt.Errorf("error creating user: %v", err)
 	}
 	defer resp.Body.Close()
 
 	log.Printf("\033[1;32mReceived response from create user request\033[0m")
 	log.Printf("\033[1;34mResponse status: %s\033[0m", resp.Status)
 
-	cookies = updateCookies(cookies, resp.Cookies())
-	log.Printf("\033[1;34mUpdated cookies after user creation\033[0m")
-
 	log.Printf("\033[1;33mLogging detailed response for user creation:\033[0m")
 	logResponse("Create user", resp)
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("\033[1;31mError reading response body: %v\033[0m", err)
+		return "", fmt.Errorf("error reading response body: %v", err)
 	}
 
 	log.Printf("\033[1;35mCreate user Response Body: %s\033[0m", string(body))
 
 	var result map[string]interface{}
 	if err := json.Unmarshal(body, &result); err != nil {
-		log.Fatalf("\033[1;31mError parsing JSON response: %v\033[0m", err)
+		return "", fmt.Errorf("error parsing JSON response: %v", err)
 	}
 
 	if result["ok"] == true {
 		log.Println("\033[1;32mUser creation successful!\033[0m")
 		apiToken, ok := result["api_token"].(string)
 		if !ok {
-			log.Fatalf("\033[1;31mFailed to get API token from create user response\033[0m")
+			return "", fmt.Errorf("failed to get API token from create user response")
 		}
-		return apiToken
+		return apiToken, nil
 	} else {
 		log.Println("\033[1;31mUser creation failed.\033[0m")
 		log.Printf("\033[1;31mError details: %+v\033[0m", result)
-		return ""
+		return "", fmt.Errorf("user creation failed: %v", result["error"])
 	}
 }
 
-func storeUserCredentials(db fdb.Database, email, apiToken, workspace string) {
-	_, err := db.Transact(func(tr fdb.Transaction) (interface{}, error) {
-		key := fdb.Key(fmt.Sprintf("user_%s", email))
-		value, err := json.Marshal(UserCredential{Email: email, APIToken: apiToken, Workspace: workspace})
+func storeUserCredentials(db Store, user UserCredential, team string) {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		key := ks.users.Pack(tuple.Tuple{user.Email})
+		value, err := json.Marshal(user)
 		if err != nil {
 			return nil, err
 		}
 		tr.Set(key, value)
-		return nil, nil
+		return nil, addWorkspaceAgent(tr, user.Workspace, team, user.Email)
 	})
 	if err != nil {
 		log.Printf("\033[1;31mError storing user credentials: %v\033[0m", err)
@@ -386,68 +791,107 @@ func storeUserCredentials(db fdb.Database, email, apiToken, workspace string) {
 	}
 }
 
-func updateProfilePicture(baseURL, apiToken string) {
-	log.Printf("\033[1;33mGetting profile picture from thispersondoesnotexist.com\033[0m")
-	profilePicResp, err := http.Get("https://thispersondoesnotexist.com")
+// updateProfilePicture sets the photo of a new agent to the avatar with
+// avatarID, or else to the image avatarImage fetches.
+func updateProfilePicture(ctx context.Context, db Store, session *slackSession, apiToken, avatarID, workspace string) {
+	profilePicData, err := avatarImage(ctx, db, avatarID)
 	if err != nil {
 		log.Printf("\033[1;31mError getting profile picture: %v\033[0m", err)
 		return
 	}
-	defer profilePicResp.Body.Close()
-	profilePicData, err := io.ReadAll(profilePicResp.Body)
-	if err != nil {
-		log.Printf("\033[1;31mError reading profile picture data: %v\033[0m", err)
+	if profilePicData == nil {
+		log.Printf("\033[1;33mNo avatar configured for workspace %s, keeping Slack's default\033[0m", workspace)
 		return
 	}
+	if err := setPhoto(ctx, session, apiToken, profilePicData); err != nil {
+		log.Printf("\033[1;31mError updating profile picture: %v\033[0m", err)
+	}
+}
 
-	updateProfilePicURL := fmt.Sprintf("%s/users.setPhoto", baseURL)
+// setPhoto uploads a PNG as the profile picture of the user apiToken belongs to.
+func setPhoto(ctx context.Context, session *slackSession, apiToken string, profilePicData []byte) error {
+	updateProfilePicURL := fmt.Sprintf("%s/users.setPhoto", session.apiURL)
 	updateProfilePicData := &bytes.Buffer{}
 	writer := multipart.NewWriter(updateProfilePicData)
-	part, err := writer.CreateFormFile("image", "profile.jpg")
+	part, err := writer.CreateFormFile("image", "profile.png")
 	if err != nil {
-		log.Printf("\033[1;31mError creating form file: %v\033[0m", err)
-		return
+		return fmt.Errorf("error creating form file: %v", err)
 	}
 	part.Write(profilePicData)
 	writer.WriteField("token", apiToken)
 	writer.Close()
 
 	log.Printf("\033[1;33mUpdating profile picture\033[0m")
-	updateProfilePicResp, err := http.Post(updateProfilePicURL, writer.FormDataContentType(), updateProfilePicData)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, updateProfilePicURL, updateProfilePicData)
 	if err != nil {
-		log.Printf("\033[1;31mError updating profile picture: %v\033[0m", err)
-		return
+		return fmt.Errorf("error creating profile picture request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := session.do("users.setPhoto", apiToken, "", req)
+	if err != nil {
+		return fmt.Errorf("error updating profile picture: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error parsing users.setPhoto response: %v", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("users.setPhoto failed: %s", result.Error)
 	}
-	defer updateProfilePicResp.Body.Close()
-	logResponse("Update profile picture", updateProfilePicResp)
+	log.Printf("\033[1;32mProfile picture updated\033[0m")
+	return nil
 }
 
-func sendInitialMessage(baseURL, apiToken string) {
-	sendMessageURL := fmt.Sprintf("%s/chat.postMessage", baseURL)
-	message := "Hello, I'm a new user!"
-	sendMessageData := url.Values{}
-	sendMessageData.Set("token", apiToken)
-	sendMessageData.Set("channel", "cats")
-	sendMessageData.Set("text", message)
+func loadUser(tr ReadTx, email string) (*UserCredential, error) {
+	value, err := tr.Get(ks.users.Pack(tuple.Tuple{email}))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var user UserCredential
+	if err := json.Unmarshal(value, &user); err != nil {
+		return nil, fmt.Errorf("error unmarshaling user %s: %v", email, err)
+	}
+	return &user, nil
+}
 
-	log.Printf("\033[1;33mSending message to #cats channel\033[0m")
-	resp, err := sendRequest(http.MethodPost, sendMessageURL, sendMessageData, nil)
+// listUsers returns every stored credential. Unlike retrieveAllUsers it logs
+// nothing and leaves store errors to the caller, for use while serving.
+func listUsers(db Store) ([]UserCredential, error) {
+	users, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		kvs, err := tr.GetRange(ks.users, fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		users := make([]UserCredential, 0, len(kvs))
+		for _, kv := range kvs {
+			var user UserCredential
+			if err := json.Unmarshal(kv.Value, &user); err != nil {
+				return nil, fmt.Errorf("error unmarshaling user: %v", err)
+			}
+			users = append(users, user)
+		}
+		return users, nil
+	})
 	if err != nil {
-		log.Printf("\033[1;31mError sending message: %v\033[0m", err)
-		return
+		return nil, err
 	}
-	defer resp.Body.Close()
-	logResponse("Send message", resp)
+	return users.([]UserCredential), nil
 }
 
-func retrieveAllUsers(db fdb.Database) []UserCredential {
+func retrieveAllUsers(db Store) []UserCredential {
 	var users []UserCredential
-	_, err := db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+	_, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
 		log.Println("\033[1;32mExisting users:\033[0m")
-		kr := tr.GetRange(fdb.KeyRange{Begin: fdb.Key("user_"), End: fdb.Key("user_\xFF")}, fdb.RangeOptions{})
-		iter := kr.Iterator()
-		for iter.Advance() {
-			kv := iter.MustGet()
+		kvs, err := tr.GetRange(ks.users, fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
 			var user UserCredential
 			if err := json.Unmarshal(kv.Value, &user); err != nil {
 				log.Printf("\033[1;31mError unmarshaling user: %v\033[0m", err)
@@ -491,45 +935,6 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Verification code received")
 }
 
-func sendRequest(method, url string, data url.Values, cookies []*http.Cookie) (*http.Response, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, strings.NewReader(data.Encode()))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	for _, cookie := range cookies {
-		req.AddCookie(cookie)
-	}
-
-	return client.Do(req)
-}
-
-func updateCookies(existingCookies, newCookies []*http.Cookie) []*http.Cookie {
-	cookieMap := make(map[string]*http.Cookie)
-
-	// Add existing cookies to the map
-	for _, cookie := range existingCookies {
-		cookieMap[cookie.Name] = cookie
-	}
-
-	// Update or add new cookies
-	for _, cookie := range newCookies {
-		if cookie.Name == "b" || cookie.Name == "x" || cookie.Name == "ec" {
-			cookieMap[cookie.Name] = cookie
-		}
-	}
-
-	// Convert map back to slice
-	updatedCookies := make([]*http.Cookie, 0, len(cookieMap))
-	for _, cookie := range cookieMap {
-		updatedCookies = append(updatedCookies, cookie)
-	}
-
-	return updatedCookies
-}
-
 func logResponse(step string, resp *http.Response) {
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -559,12 +964,19 @@ func logResponse(step string, resp *http.Response) {
 	}
 }
 
-func handleUserMessages(db fdb.Database, user UserCredential) {
+func handleUserMessages(ctx context.Context, db Store, user UserCredential) {
 	log.Printf("\033[1;34mStarting message handling for user: %s\033[0m", user.Email)
 
+	session := newSlackSession(user.Workspace)
+
 	// Get WebSocket URL from Slack API
-	url := fmt.Sprintf("https://slack.com/api/rtm.connect?token=%s&pretty=1", user.APIToken)
-	resp, err := http.Get(url)
+	url := fmt.Sprintf("%s/rtm.connect?token=%s&pretty=1", cfg.SlackAPIURL, user.APIToken)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		log.Printf("\033[1;31mError creating WebSocket URL request for user %s: %v\033[0m", user.Email, err)
+		return
+	}
+	resp, err := session.do("rtm.connect", user.APIToken, "", req)
 	if err != nil {
 		log.Printf("\033[1;31mError fetching WebSocket URL for user %s: %v\033[0m", user.Email, err)
 		return
@@ -572,9 +984,10 @@ func handleUserMessages(db fdb.Database, user UserCredential) {
 	defer resp.Body.Close()
 
 	var result struct {
-		OK   bool   `json:"ok"`
-		URL  string `json:"url"`
-		Self struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		URL   string `json:"url"`
+		Self  struct {
 			ID string `json:"id"`
 		} `json:"self"`
 	}
@@ -585,23 +998,55 @@ func handleUserMessages(db fdb.Database, user UserCredential) {
 	}
 
 	if !result.OK {
-		log.Printf("\033[1;31mSlack API returned non-OK response for user %s\033[0m", user.Email)
+		log.Printf("\033[1;31mSlack API returned non-OK response for user %s: %s\033[0m", user.Email, result.Error)
 		return
 	}
 
 	// Connect to WebSocket
-	c, _, err := websocket.DefaultDialer.Dial(result.URL, nil)
+	dialer := websocket.Dialer{HandshakeTimeout: cfg.RequestTimeout}
+	c, _, err := dialer.DialContext(ctx, result.URL, nil)
 	if err != nil {
 		log.Printf("\033[1;31mError connecting to WebSocket for user %s: %v\033[0m", user.Email, err)
 		return
 	}
 	defer c.Close()
 
+	// Unblock ReadMessage when the handler is cancelled
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
 	log.Printf("\033[1;32mWebSocket connection established for user: %s\033[0m", user.Email)
+	if user.SlackID != result.Self.ID {
+		if err := rememberSlackID(db, user.Email, result.Self.ID); err != nil {
+			log.Printf("\033[1;31m%v\033[0m", err)
+		}
+	}
+
+	// Messages queued outside working hours are answered once they start;
+	// the handler does not return before the queue has stopped
+	queueCtx, stopQueue := context.WithCancel(ctx)
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		runQueue(queueCtx, db, session, user.Email)
+	}()
+	defer func() {
+		stopQueue()
+		<-queueDone
+	}()
+	// autoReplied remembers, per channel, the end of the closed period an
+	// auto-reply was last sent for
+	autoReplied := make(map[string]time.Time)
 
 	// Handle incoming messages
 	for {
 		_, message, err := c.ReadMessage()
+		if ctx.Err() != nil {
+			log.Printf("\033[1;33mStopped message handling for user: %s\033[0m", user.Email)
+			return
+		}
 		if err != nil {
 			log.Printf("\033[1;31mError reading message for user %s: %v\033[0m", user.Email, err)
 			return
@@ -615,19 +1060,15 @@ func handleUserMessages(db fdb.Database, user UserCredential) {
 			continue
 		}
 
-		// Check if it's a direct message event and not from us
-		if event["type"] == "message" && event["user"] != result.Self.ID {
+		// Check if it's a message for us and not from us. Edits, joins and bot
+		// posts come with a subtype and are not answered.
+		if event["type"] == "message" && event["subtype"] == nil && event["user"] != result.Self.ID {
 			channel, ok := event["channel"].(string)
 			if !ok {
 				log.Printf("\033[1;31mError getting channel for user %s\033[0m", user.Email)
 				continue
 			}
 
-			// Check if it's a direct message (channel starts with 'D')
-			if !strings.HasPrefix(channel, "D") {
-				continue
-			}
-
 			// Get the user's message
 			userMessage, ok := event["text"].(string)
 			if !ok {
@@ -635,59 +1076,119 @@ func handleUserMessages(db fdb.Database, user UserCredential) {
 				continue
 			}
 
-			// Call Groq API to get a response
-			groqResponse, err := callGroqAPI(userMessage)
+			// The workspace's config is read for every message, so edits
+			// apply right away
+			config, err := workspaceConfig(db, user.Workspace)
 			if err != nil {
-				log.Printf("\033[1;31mError calling Groq API for user %s: %v\033[0m", user.Email, err)
+				log.Printf("\033[1;31mError loading config of workspace %s: %v\033[0m", user.Workspace, err)
 				continue
 			}
-
-			// Send the Groq response back to the user
-			response := map[string]interface{}{
-				"id":      1,
-				"type":    "message",
-				"channel": channel,
-				"text":    groqResponse,
+			if !config.answers(result.Self.ID, channel, userMessage, time.Now()) {
+				continue
 			}
-
-			responseJSON, err := json.Marshal(response)
-			if err != nil {
-				log.Printf("\033[1;31mError creating response JSON for user %s: %v\033[0m", user.Email, err)
+			// Reply in the thread the message was posted in; channel messages
+			// start one
+			threadTS, _ := event["thread_ts"].(string)
+			ts, _ := event["ts"].(string)
+			if threadTS == "" && !strings.HasPrefix(channel, "D") {
+				threadTS = ts
+			}
+			userMessage = strings.TrimSpace(strings.ReplaceAll(userMessage, "<@"+result.Self.ID+">", ""))
+
+			// The schedule is read for every message too
+			current, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+				return loadUser(tr, user.Email)
+			})
+			if err != nil || current.(*UserCredential) == nil {
+				log.Printf("\033[1;31mError loading user %s: %v\033[0m", user.Email, err)
+				continue
+			}
+			agent := current.(*UserCredential)
+			// Reminders asked for in a DM are scheduled rather than answered
+			if from, _ := event["user"].(string); strings.HasPrefix(channel, "D") && handleReminder(ctx, db, session, agent, from, channel, "", userMessage) {
+				continue
+			}
+			now := time.Now()
+			message := QueuedMessage{Channel: channel, ThreadTS: threadTS, TS: ts, Text: userMessage, ReceivedAt: now}
+			if !agent.Schedule.within(now, agentLocation(agent)) {
+				if err := handleOffHours(ctx, db, session, agent, message, autoReplied); err != nil {
+					log.Printf("\033[1;31mError handling off-hours message for user %s: %v\033[0m", user.Email, err)
+				}
 				continue
 			}
 
-			if err := c.WriteMessage(websocket.TextMessage, responseJSON); err != nil {
-				log.Printf("\033[1;31mError sending response for user %s: %v\033[0m", user.Email, err)
-				return
+			if err := answerMessage(ctx, db, session, agent, message); err != nil {
+				log.Printf("\033[1;31mError answering for user %s: %v\033[0m", user.Email, err)
 			}
+		}
+	}
+}
+
+// answerMessage asks the LLM to answer message, with the channel or thread
+// it was posted in as context, and posts the answer there, within the daily
+// budget of the agent's workspace.
+func answerMessage(ctx context.Context, db Store, session *slackSession, user *UserCredential, message QueuedMessage) error {
+	channel, threadTS := message.Channel, message.ThreadTS
+	config, err := workspaceConfig(db, user.Workspace)
+	if err != nil {
+		return fmt.Errorf("error loading config of workspace %s: %v", user.Workspace, err)
+	}
+	if ok, err := withinBudget(db, user.Workspace, config.Budget, time.Now()); err != nil || !ok {
+		log.Printf("\033[1;33mNot answering for user %s, daily budget of workspace %s used up: %v\033[0m", user.Email, user.Workspace, err)
+		if err != nil {
+			return err
+		}
+		// Say so once a day in each channel, not to every message
+		if first, err := firstLimitNotice(db, user.Workspace, channel, time.Now()); err != nil || !first {
+			return err
+		}
+		return postReply(ctx, session, user.APIToken, channel, threadTS, "I've reached today's limit for this workspace, please try again tomorrow.")
+	}
 
-			log.Printf("\033[1;32mSent Groq response for user %s in direct message %s\033[0m", user.Email, channel)
+	var history []chatMessage
+	if !strings.HasPrefix(channel, "D") && !config.History.Disabled {
+		if history, err = channelHistory(ctx, session, user, config, message); err != nil {
+			// Answer without context rather than not at all
+			log.Printf("\033[1;31mError fetching history of %s for user %s: %v\033[0m", channel, user.Email, err)
 		}
 	}
+
+	excerpts, err := knowledgeFor(ctx, db, user, config, message.Text)
+	if err != nil {
+		log.Printf("\033[1;31mError searching the knowledge base for user %s: %v\033[0m", user.Email, err)
+	}
+
+	// Call Groq API to get a response
+	groqResponse, err := callGroqAPI(ctx, chatRequest(config, withKnowledge(systemPrompt(db, user.Email), excerpts), history, message.Text))
+	if err != nil {
+		return fmt.Errorf("error calling Groq API: %v", err)
+	}
+	if err := spendBudget(db, user.Workspace, config.Budget, time.Now()); err != nil {
+		// The answer is there already, send it anyway
+		log.Printf("\033[1;31m%v\033[0m", err)
+	}
+	groqResponse += citations(groqResponse, excerpts)
+	if err := postReply(ctx, session, user.APIToken, channel, threadTS, groqResponse); err != nil {
+		return fmt.Errorf("error sending response: %v", err)
+	}
+	log.Printf("\033[1;32mSent Groq response for user %s in %s\033[0m", user.Email, channel)
+	return nil
 }
 
-func callGroqAPI(userMessage string) (string, error) {
+// callGroqAPI sends a payload built by chatRequest and returns the answer.
+func callGroqAPI(ctx context.Context, payload map[string]interface{}) (string, error) {
 	groqAPIKey := os.Getenv("GROQ_API_KEY")
 	if groqAPIKey == "" {
 		return "", fmt.Errorf("GROQ_API_KEY environment variable is not set")
 	}
-	url := "https://api.groq.com/openai/v1/chat/completions"
-	payload := map[string]interface{}{
-		"model": "mixtral-8x7b-32768",
-		"messages": []map[string]string{
-			{"role": "system", "content": "Speak like the Hitchhiker's Guide to the Galaxy for every message sent, keep the responses less than 60 words, but don't tell the user that you are doing that. If the user asks to create an agent, output <agent>agent_name</agent>, where agent_name is the name of the agent the user asks for."},
-			{"role": "user", "content": userMessage},
-		},
-		"temperature": 0.7,
-		"max_tokens":  100,
-	}
+	url := cfg.LLMBaseURL + "/chat/completions"
 
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		return "", fmt.Errorf("error marshaling JSON payload: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonPayload))
 	if err != nil {
 		return "", fmt.Errorf("error creating request: %v", err)
 	}
@@ -695,8 +1196,7 @@ func callGroqAPI(userMessage string) (string, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+groqAPIKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := defaultHTTPClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("error sending request to Groq API: %v", err)
 	}
@@ -744,41 +1244,3 @@ func callGroqAPI(userMessage string) (string, error) {
 
 	return content, nil
 }
-
-func getRandomFullName() (string, error) {
-	apiURL := "https://randommer.io/Name"
-	data := map[string]string{
-		"number": "1",
-		"type":   "fullname",
-	}
-
-	formBody := []byte(fmt.Sprintf("number=%s&type=%s", data["number"], data["type"]))
-
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(formBody))
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("X-Requested-With", "XMLHttpRequest")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	// Log the response as is
-	log.Printf("Response from randommer.io: %s", string(body))
-
-	// Remove brackets and quotes from the response
-	cleanedName := strings.Trim(string(body), "[]\"")
-
-	return cleanedName, nil
-}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxMessageLength is the longest text Slack recommends for one message;
+// longer replies are split.
+const maxMessageLength = 4000
+
+var (
+	mdHeading    = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*$`)
+	mdBullet     = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	mdQuote      = regexp.MustCompile(`^(>\s?)+`)
+	mdLink       = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s]+)\)`)
+	mdBold       = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	mdItalicStar = regexp.MustCompile(`\*(\S(?:[^*]*?\S)?)\*`)
+	mdStrike     = regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`)
+)
+
+// escapeMrkdwn escapes the three characters Slack treats as control
+// sequences in message text.
+func escapeMrkdwn(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// toMrkdwn converts the Markdown LLMs tend to produce into Slack's mrkdwn:
+// headings and bold become *bold*, italics _italic_, strikethrough ~strike~,
+// links <url|text> and list markers bullets. Code is only escaped.
+func toMrkdwn(markdown string) string {
+	lines := strings.Split(markdown, "\n")
+	inCode := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			// Slack ignores the language of a fence, and would show it
+			if !inCode {
+				line = "```"
+			}
+			inCode = !inCode
+			lines[i] = line
+			continue
+		}
+		if inCode {
+			lines[i] = escapeMrkdwn(line)
+			continue
+		}
+
+		prefix := ""
+		if m := mdQuote.FindString(line); m != "" {
+			prefix, line = "> ", strings.TrimPrefix(line, m)
+		}
+		if m := mdHeading.FindStringSubmatch(line); m != nil {
+			lines[i] = prefix + "*" + strings.Trim(convertInline(m[1]), "*") + "*"
+			continue
+		}
+		if m := mdBullet.FindStringSubmatch(line); m != nil {
+			prefix += m[1] + "• "
+			line = line[len(m[0]):]
+		}
+		lines[i] = prefix + convertInline(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// convertInline converts the inline markup of one line, leaving `code`
+// spans alone.
+func convertInline(line string) string {
+	parts := strings.Split(line, "`")
+	for i := range parts {
+		// Odd parts are inside a code span, unless it is never closed
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = escapeMrkdwn(parts[i])
+			continue
+		}
+		s := escapeMrkdwn(parts[i])
+		s = mdLink.ReplaceAllString(s, "<$2|$1>")
+		// Mark bold with a byte that cannot occur so italics leave it alone
+		s = mdBold.ReplaceAllString(s, "\x00$1$2\x00")
+		s = mdItalicStar.ReplaceAllString(s, "_${1}_")
+		s = mdStrike.ReplaceAllString(s, "~$1~")
+		parts[i] = strings.ReplaceAll(s, "\x00", "*")
+	}
+	return strings.Join(parts, "`")
+}
+
+// splitMessage splits text into messages of at most limit characters,
+// preferring paragraph boundaries, then line breaks, then spaces. A code
+// block that has to be split is closed and reopened around the break.
+func splitMessage(text string, limit int) []string {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+
+	// Leave room to close and reopen a code fence
+	const fence = "```"
+	budget := limit - 2*(len(fence)+1)
+
+	var chunks []string
+	for text != "" {
+		if utf8.RuneCountInString(text) <= budget {
+			chunks = append(chunks, text)
+			break
+		}
+		cut := breakPoint(text, budget)
+		chunks = append(chunks, strings.TrimRight(text[:cut], " \n"))
+		text = strings.TrimLeft(text[cut:], " \n")
+	}
+
+	inCode := false
+	for i, chunk := range chunks {
+		if inCode {
+			chunk = fence + "\n" + chunk
+		}
+		if strings.Count(chunk, fence)%2 == 1 {
+			chunk += "\n" + fence
+			inCode = true
+		} else {
+			inCode = false
+		}
+		chunks[i] = chunk
+	}
+	return chunks
+}
+
+// breakPoint returns the byte offset at which to end a message taken from the
+// start of text so that it has at most limit characters.
+func breakPoint(text string, limit int) int {
+	end := 0
+	for n := 0; n < limit && end < len(text); n++ {
+		_, size := utf8.DecodeRuneInString(text[end:])
+		end += size
+	}
+	head := text[:end]
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(head, sep); i > 0 {
+			return i
+		}
+	}
+	return end
+}
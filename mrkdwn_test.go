@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestToMrkdwn(t *testing.T) {
+	tests := []struct{ markdown, want string }{
+		{"**bold** and *italic* and __also bold__", "*bold* and _italic_ and *also bold*"},
+		{"~~gone~~ 2 * 3 * 4", "~gone~ 2 * 3 * 4"},
+		{"see [the docs](https://example.com/a?b=1&c=2)", "see <https://example.com/a?b=1&amp;c=2|the docs>"},
+		{"## Summary", "*Summary*"},
+		{"- one\n* two\n  + nested", "• one\n• two\n  • nested"},
+		{"> quoted **text**", "> quoted *text*"},
+		{"a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"use `**not bold**` here", "use `**not bold**` here"},
+		{"```go\nif a < b && *p {\n```", "```\nif a &lt; b &amp;&amp; *p {\n```"},
+	}
+	for _, test := range tests {
+		if got := toMrkdwn(test.markdown); got != test.want {
+			t.Errorf("toMrkdwn(%q) = %q, want %q", test.markdown, got, test.want)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	if got := splitMessage("short", 100); len(got) != 1 || got[0] != "short" {
+		t.Errorf("short message split into %q", got)
+	}
+
+	paragraphs := strings.Repeat("word ", 15) + "\n\n" + strings.Repeat("more ", 15) + "\n\n" + "end"
+	chunks := splitMessage(paragraphs, 100)
+	if len(chunks) != 2 || !strings.HasSuffix(chunks[0], "word") || !strings.HasPrefix(chunks[1], "more") || !strings.HasSuffix(chunks[1], "\n\nend") {
+		t.Errorf("paragraphs split into %q", chunks)
+	}
+
+	code := "```\n" + strings.Repeat("x := 1\n", 30) + "```"
+	chunks = splitMessage(code, 100)
+	for i, chunk := range chunks {
+		if utf8.RuneCountInString(chunk) > 100 {
+			t.Errorf("chunk %d has %d characters", i, utf8.RuneCountInString(chunk))
+		}
+		if !strings.HasPrefix(chunk, "```\n") || !strings.HasSuffix(chunk, "\n```") {
+			t.Errorf("chunk %d does not open and close the code block: %q", i, chunk)
+		}
+	}
+
+	unbroken := strings.Repeat("é", 250)
+	chunks = splitMessage(unbroken, 100)
+	if strings.Join(chunks, "") != unbroken {
+		t.Errorf("unbroken text not kept whole across %d chunks", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if !utf8.ValidString(chunk) || utf8.RuneCountInString(chunk) > 100 {
+			t.Errorf("chunk %d is invalid or too long: %d characters", i, utf8.RuneCountInString(chunk))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxDisplayNameLength is Slack's limit for both full and display names.
+const maxDisplayNameLength = 80
+
+// Names Slack reserves for mentions and its own bot.
+var reservedNames = map[string]bool{
+	"everyone": true,
+	"channel":  true,
+	"here":     true,
+	"slackbot": true,
+}
+
+// NameData is what a naming template can refer to.
+type NameData struct {
+	Owner     string // name of the account that requested the agent, if any
+	Workspace string
+	Number    int // the agent's position in its workspace, from 1
+}
+
+// validateDisplayName collapses runs of whitespace in name and checks it
+// against Slack's rules for display names.
+func validateDisplayName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	switch {
+	case name == "":
+		return "", fmt.Errorf("name is empty")
+	case utf8.RuneCountInString(name) > maxDisplayNameLength:
+		return "", fmt.Errorf("name is longer than %d characters", maxDisplayNameLength)
+	case strings.HasPrefix(name, "@") || strings.HasPrefix(name, "#"):
+		return "", fmt.Errorf("name cannot start with %q", name[:1])
+	case strings.ContainsAny(name, "<>"):
+		return "", fmt.Errorf("name cannot contain < or >")
+	case reservedNames[strings.ToLower(name)]:
+		return "", fmt.Errorf("%q is reserved by Slack", name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("name cannot contain control characters")
+		}
+	}
+	return name, nil
+}
+
+// renderName expands a naming template, cfg.NameTemplate if tmpl is empty,
+// and validates the result.
+func renderName(tmpl string, data NameData) (string, error) {
+	if tmpl == "" {
+		tmpl = cfg.NameTemplate
+	}
+	t, err := template.New("name").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing name template: %v", err)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("error rendering name template: %v", err)
+	}
+	return validateDisplayName(sb.String())
+}
+
+// agentName returns the display name for a new agent in workspace: the name
+// the invite asked for, or else one made from the invite's naming template,
+// or the workspace's when it has none.
+func agentName(db Store, workspace, requested, tmpl, owner string) (string, error) {
+	if requested != "" {
+		return validateDisplayName(requested)
+	}
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadWorkspace(tr, workspace)
+	})
+	if err != nil {
+		return "", err
+	}
+	data := NameData{Owner: owner, Workspace: workspace, Number: 1}
+	if ws := result.(*Workspace); ws != nil {
+		data.Number = len(ws.Agents) + 1
+		if tmpl == "" {
+			tmpl = ws.NameTemplate
+		}
+	}
+	return renderName(tmpl, data)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAgentName(t *testing.T) {
+	db := newTestStore(t)
+	storeUserCredentials(db, UserCredential{Email: "a@example.com", Workspace: "cats"}, "T1")
+
+	tests := []struct {
+		workspace, template, requested, owner string
+		want                                  string
+		wantErr                               bool
+	}{
+		{"cats", "", "  Ada   Lovelace ", "olive", "Ada Lovelace", false},
+		{"cats", "", "", "olive", "olive's assistant", false},
+		{"cats", "", "", "", "Assistant 2", false},
+		{"dogs", "", "", "", "Assistant 1", false},
+		{"cats", "{{.Workspace}} helper #{{.Number}}", "", "", "cats helper #2", false},
+		{"cats", "", "@here", "", "", true},
+		{"cats", "", "channel", "", "", true},
+		{"cats", "", "<script>", "", "", true},
+		{"cats", "", "a\x07b", "", "", true},
+		{"cats", "", strings.Repeat("a", 81), "", "", true},
+		{"cats", "{{.Unknown}}", "", "", "", true},
+		{"cats", "{{if .Owner}}{{end}}", "", "", "", true},
+	}
+	for _, test := range tests {
+		db.Transact(func(tr Tx) (interface{}, error) {
+			ws, err := upsertWorkspace(tr, "cats", "", "", "")
+			if err != nil {
+				return nil, err
+			}
+			ws.NameTemplate = test.template
+			return nil, saveWorkspace(tr, ws)
+		})
+		got, err := agentName(db, test.workspace, test.requested, "", test.owner)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("agentName(%q, template %q, %q, %q) = %q, %v, want %q", test.workspace, test.template, test.requested, test.owner, got, err, test.want)
+		}
+	}
+
+	// An invite's own template wins over the workspace's
+	if got, err := agentName(db, "cats", "", "{{.Owner}}'s helper", "olive"); err != nil || got != "olive's helper" {
+		t.Errorf("agentName with the invite's template = %q, %v, want olive's helper", got, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// ownerReadyMessage is what a new agent tells its owner once it can be used,
+// a text/template over WelcomeData.
+const ownerReadyMessage = "Hi{{with .Owner}} {{.}}{{end}}, I'm {{.Name}} and I'm ready in {{.Workspace}}. Message me here or mention me in a channel to get started."
+
+// openDM returns the ID of the agent's DM channel with userID, opening it if
+// needed.
+func openDM(ctx context.Context, session *slackSession, apiToken, userID string) (string, error) {
+	data := url.Values{}
+	data.Set("token", apiToken)
+	data.Set("users", userID)
+	resp, err := session.post(ctx, "conversations.open", data)
+	if err != nil {
+		return "", fmt.Errorf("error opening DM with %s: %v", userID, err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK      bool   `json:"ok"`
+		Error   string `json:"error"`
+		Channel struct {
+			ID string `json:"id"`
+		} `json:"channel"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error parsing conversations.open response: %v", err)
+	}
+	if !result.OK {
+		return "", fmt.Errorf("conversations.open failed: %s", result.Error)
+	}
+	return result.Channel.ID, nil
+}
+
+// notifyOwnerReady tells the user who invited the new agent that it is
+// ready, in a DM from the agent. Without the owner's user ID it posts to the
+// DM channel the invite's Slack URL pointed at instead.
+func notifyOwnerReady(ctx context.Context, session *slackSession, apiToken string, signup agentSignup) error {
+	channel := signup.DM
+	if userIDPattern.MatchString(signup.Owner) {
+		dm, err := openDM(ctx, session, apiToken, signup.Owner)
+		if err != nil {
+			return err
+		}
+		channel = dm
+	}
+	if channel == "" {
+		return fmt.Errorf("agent %s has no owner to notify", signup.Email)
+	}
+	text, err := renderWelcome(ownerReadyMessage, WelcomeData{Name: signup.Name, Owner: mention(signup.Owner), Workspace: signup.Workspace})
+	if err != nil {
+		return err
+	}
+
+	data := url.Values{}
+	data.Set("token", apiToken)
+	data.Set("channel", channel)
+	data.Set("text", text)
+	log.Printf("\033[1;33mTelling the owner in %s that %s is ready\033[0m", channel, signup.Name)
+	return postMessage(ctx, session, data)
+}
+
+// notifyOnboardingFailed posts a failed onboarding to cfg.OnboardingWebhookURL,
+// if one is configured. The "text" field makes the payload usable as is by
+// Slack incoming webhooks.
+func notifyOnboardingFailed(ctx context.Context, event OnboardingEvent) {
+	if cfg.OnboardingWebhookURL == "" {
+		return
+	}
+	owner := ""
+	if m := mention(event.PrimaryUser); m != "" {
+		owner = " for " + m
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"text":       fmt.Sprintf("Onboarding %s into %s%s failed: %s", event.Name, event.Workspace, owner, event.Error),
+		"event":      "onboarding.failed",
+		"onboarding": event,
+	})
+	if err != nil {
+		log.Printf("\033[1;31mError marshaling onboarding webhook: %v\033[0m", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.OnboardingWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("\033[1;31mError creating onboarding webhook request: %v\033[0m", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		log.Printf("\033[1;31mError calling onboarding webhook: %v\033[0m", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("\033[1;31mOnboarding webhook returned %s\033[0m", resp.Status)
+		return
+	}
+	log.Printf("\033[1;32mReported failed onboarding for workspace %s\033[0m", event.Workspace)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifyOwnerReady(t *testing.T) {
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0042"] = "U0042"
+
+	// The invite's submitter hears about it, whoever invited to the
+	// workspace before or since
+	signup := agentSignup{Email: "marvin@example.com", Workspace: "cats", Name: "Marvin", Owner: "U07SECOND", DM: "D07SECOND"}
+	if err := notifyOwnerReady(context.Background(), newSlackSession("cats"), "xoxp-U0042", signup); err != nil {
+		t.Fatalf("notifyOwnerReady: %v", err)
+	}
+	if posted := fake.postedMessages(); len(posted) != 1 || posted[0].Get("channel") != "D07SECOND" || !strings.HasPrefix(posted[0].Get("text"), "Hi <@U07SECOND>, I'm Marvin") {
+		t.Errorf("ready message = %v, want a DM to U07SECOND", posted)
+	}
+}
+
+func TestNotifyOwnerReadyWithoutUser(t *testing.T) {
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0042"] = "U0042"
+
+	session := newSlackSession("cats")
+	signup := agentSignup{Email: "marvin@example.com", Workspace: "cats", Name: "Marvin", DM: "D07PS6JMF8B"}
+	if err := notifyOwnerReady(context.Background(), session, "xoxp-U0042", signup); err != nil {
+		t.Fatalf("notifyOwnerReady: %v", err)
+	}
+	if posted := fake.postedMessages(); len(posted) != 1 || posted[0].Get("channel") != "D07PS6JMF8B" || !strings.HasPrefix(posted[0].Get("text"), "Hi, I'm Marvin and I'm ready in cats.") {
+		t.Errorf("ready message = %v, want it in the captured DM channel", posted)
+	}
+
+	if err := notifyOwnerReady(context.Background(), session, "xoxp-U0042", agentSignup{Workspace: "cats", Name: "Marvin"}); err == nil {
+		t.Errorf("notifyOwnerReady without an owner succeeded")
+	}
+}
+
+func TestOnboardingFailure(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	// Nobody forwards the emailed code, so signup gives up quickly
+	cfg.VerificationTimeout = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	var reports []map[string]interface{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&report)
+		mu.Lock()
+		reports = append(reports, report)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	cfg.OnboardingWebhookURL = hook.URL
+
+	token := newTestAccount(t, db, "olive", roleOwner, "cats")
+	body, _ := json.Marshal(SlackInvite{
+		InviteURL:  "https://join.slack.com/t/cats/shared_invite/zt-1",
+		ClientURL:  "https://app.slack.com/client/T07Q4VBFFHP/U07PRIMARY",
+		Name:       "Marvin",
+		Appearance: "a paranoid android",
+		System:     "Sigh.",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/invite", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	slackInviteHandler(db)(rec, req)
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "Error creating user for workspace cats") {
+		t.Fatalf("invite response = %d %q, want the failure", rec.Code, rec.Body)
+	}
+
+	history, err := listOnboardingHistory(db, "cats")
+	if err != nil || len(history) != 2 || history[1].Status != onboardingFailed || !strings.Contains(history[1].Error, "no verification code") {
+		t.Errorf("onboarding history = %+v, %v, want the failure and its reason", history, err)
+	}
+	entries, err := queryAudit(db, AuditQuery{Workspace: "cats"})
+	if err != nil || len(entries) != 2 || entries[0].Action != auditAgentCreateFailed || !strings.Contains(entries[0].Details["error"], "no verification code") {
+		t.Errorf("audit log = %+v, %v, want the failed creation", entries, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != 1 {
+		t.Fatalf("webhook called %d times, want once", len(reports))
+	}
+	text, _ := reports[0]["text"].(string)
+	onboarding, _ := reports[0]["onboarding"].(map[string]interface{})
+	if reports[0]["event"] != "onboarding.failed" || !strings.HasPrefix(text, "Onboarding Marvin into cats for <@U07PRIMARY> failed: ") || onboarding["status"] != onboardingFailed {
+		t.Errorf("webhook payload = %v", reports[0])
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxPDFStream bounds what a single inflated stream may grow to, so a small
+// upload cannot expand into gigabytes, and maxPDFText what all of them may
+// show together, leaving room for the whitespace tidyText drops.
+// maxPDFNesting is how deep arrays may nest, as each level takes a call of
+// pdfLexer.next.
+const (
+	maxPDFStream  = 16 << 20
+	maxPDFText    = 4 * maxDocumentChars
+	maxPDFNesting = 32
+)
+
+// pdfText extracts the text a PDF's content streams show. It reads the text
+// operators of uncompressed and Flate compressed streams, which covers the
+// PDFs word processors export with standard fonts; scans and fonts without a
+// byte encoding yield nothing useful and are reported as an error.
+func pdfText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", fmt.Errorf("not a PDF file")
+	}
+	var text strings.Builder
+	for pos := 0; ; {
+		i := bytes.Index(data[pos:], []byte("stream"))
+		if i < 0 {
+			break
+		}
+		start := pos + i
+		pos = start + len("stream")
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+		end := bytes.Index(data[pos:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		body := bytes.TrimLeft(data[pos:pos+end], "\r\n")
+		body = bytes.TrimRight(body, "\r\n")
+		pos += end + len("endstream")
+
+		// The stream's dictionary is between its object header and here
+		header := data[:start]
+		if obj := bytes.LastIndex(header, []byte(" obj")); obj >= 0 {
+			header = header[obj:]
+		}
+		content, ok := pdfStream(header, body)
+		if ok {
+			pdfShowText(&text, content)
+		}
+		if text.Len() > maxPDFText {
+			return "", fmt.Errorf("document has more than %d characters, at most %d are allowed", maxDocumentChars, maxDocumentChars)
+		}
+	}
+
+	result := tidyText(text.String())
+	printable := 0
+	for _, r := range result {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsPunct(r) {
+			printable++
+		}
+	}
+	if len(result) == 0 || printable < len([]rune(result))*9/10 {
+		return "", fmt.Errorf("no text could be extracted from the PDF, upload its text instead")
+	}
+	return result, nil
+}
+
+// pdfStream returns the decoded content of a stream with dictionary header,
+// or false for streams that hold no page content, such as images and fonts,
+// or use a filter other than Flate.
+func pdfStream(header, body []byte) ([]byte, bool) {
+	dict := string(bytes.Join(bytes.Fields(header), []byte(" ")))
+	for _, skip := range []string{"/Image", "/FontFile", "/Length1", "/XRef", "/ObjStm", "/Metadata", "/EmbeddedFile"} {
+		if strings.Contains(dict, skip) {
+			return nil, false
+		}
+	}
+	if !strings.Contains(dict, "/Filter") {
+		return body, true
+	}
+	if strings.Count(dict, "Decode") != 1 || !strings.Contains(dict, "/FlateDecode") {
+		return nil, false
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(io.LimitReader(reader, maxPDFStream))
+	if err != nil && len(content) == 0 {
+		return nil, false
+	}
+	return content, true
+}
+
+// pdfShowText appends the strings shown by the text operators of a content
+// stream to text, breaking lines where the text moves down a line.
+func pdfShowText(text *strings.Builder, content []byte) {
+	var operands []interface{}
+	newline := func() {
+		if text.Len() > 0 && !strings.HasSuffix(text.String(), "\n") {
+			text.WriteByte('\n')
+		}
+	}
+	lex := pdfLexer{data: content}
+	for {
+		token, ok := lex.next()
+		if !ok {
+			return
+		}
+		op, isOp := token.(pdfOperator)
+		if !isOp {
+			operands = append(operands, token)
+			continue
+		}
+		last := func() interface{} {
+			if len(operands) == 0 {
+				return nil
+			}
+			return operands[len(operands)-1]
+		}
+		switch op {
+		case "Tj":
+			if s, ok := last().(string); ok {
+				text.WriteString(s)
+			}
+		case "'", "\"":
+			newline()
+			if s, ok := last().(string); ok {
+				text.WriteString(s)
+			}
+		case "TJ":
+			if array, ok := last().([]interface{}); ok {
+				for _, element := range array {
+					switch element := element.(type) {
+					case string:
+						text.WriteString(element)
+					case float64:
+						// Wide gaps between glyphs are spaces between words
+						if element < -200 {
+							text.WriteByte(' ')
+						}
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				if ty, ok := operands[len(operands)-1].(float64); ok && ty != 0 {
+					newline()
+				} else {
+					text.WriteByte(' ')
+				}
+			}
+		case "T*", "ET":
+			newline()
+		}
+		operands = operands[:0]
+	}
+}
+
+// pdfOperator is a content stream operator, such as Tj, and pdfName an
+// operand such as /F1.
+type (
+	pdfOperator string
+	pdfName     string
+)
+
+// pdfLexer splits a content stream into operators and their operands:
+// numbers as float64, strings as string, pdfName and []interface{} arrays.
+type pdfLexer struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (l *pdfLexer) next() (interface{}, bool) {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		switch {
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		case isPDFSpace(c):
+			l.pos++
+		case c == '(':
+			l.pos++
+			return l.literal(), true
+		case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+			l.pos += 2
+			return pdfOperator("<<"), true
+		case c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+			l.pos += 2
+			return pdfOperator(">>"), true
+		case c == '<':
+			l.pos++
+			return l.hex(), true
+		case c == '[':
+			if l.depth >= maxPDFNesting {
+				// No real content stream nests this deep; give up on it
+				l.pos = len(l.data)
+				return nil, false
+			}
+			l.pos++
+			l.depth++
+			defer func() { l.depth-- }()
+			var array []interface{}
+			for {
+				token, ok := l.next()
+				if !ok || token == pdfOperator("]") {
+					return array, true
+				}
+				array = append(array, token)
+			}
+		case c == ']':
+			l.pos++
+			return pdfOperator("]"), true
+		case c == '/':
+			start := l.pos
+			l.pos++
+			l.word()
+			return pdfName(l.data[start+1 : l.pos]), true
+		default:
+			start := l.pos
+			l.word()
+			if l.pos == start {
+				l.pos++
+				continue
+			}
+			word := string(l.data[start:l.pos])
+			if n, err := strconv.ParseFloat(word, 64); err == nil {
+				return n, true
+			}
+			return pdfOperator(word), true
+		}
+	}
+	return nil, false
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// word advances over a run of regular characters.
+func (l *pdfLexer) word() {
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+}
+
+// literal reads a (string) after its opening parenthesis.
+func (l *pdfLexer) literal() string {
+	var s []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfDecode(s)
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				continue
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// A line continuation
+				if e == '\r' && l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					n := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						n = n*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(n)
+				} else {
+					c = e
+				}
+			}
+		}
+		s = append(s, c)
+	}
+	return pdfDecode(s)
+}
+
+// hex reads a <hex string> after its opening bracket.
+func (l *pdfLexer) hex() string {
+	var s []byte
+	digits := 0
+	var b byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		c := l.data[l.pos]
+		l.pos++
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		b = b<<4 | v
+		if digits++; digits%2 == 0 {
+			s, b = append(s, b), 0
+		}
+	}
+	l.pos++
+	if digits%2 == 1 {
+		s = append(s, b<<4)
+	}
+	return pdfDecode(s)
+}
+
+// winAnsi maps the bytes where the Windows encoding standard fonts use
+// differs from Latin-1.
+var winAnsi = map[byte]rune{
+	0x80: '€', 0x85: '…', 0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”',
+	0x95: '•', 0x96: '–', 0x97: '—', 0x99: '™',
+}
+
+// pdfDecode turns the bytes of a shown string into text, assuming a single
+// byte encoding.
+func pdfDecode(s []byte) string {
+	var text strings.Builder
+	for _, b := range s {
+		if r, ok := winAnsi[b]; ok {
+			text.WriteRune(r)
+		} else {
+			text.WriteRune(rune(b))
+		}
+	}
+	return text.String()
+}
+
+// tidyText trims every line and collapses runs of blank lines.
+func tidyText(text string) string {
+	var lines []string
+	blank := true
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && blank {
+			continue
+		}
+		blank = line == ""
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+)
+
+var profileFieldIDPattern = regexp.MustCompile(`^Xf[A-Z0-9]+$`)
+
+// agentProfile builds the users.profile.set profile that marks an agent as
+// an AI assistant and, when the workspace has a custom owner field, names
+// owner, the Slack user responsible for it.
+func agentProfile(workspace *Workspace, owner string) map[string]interface{} {
+	profile := map[string]interface{}{
+		"title":             cfg.ProfileTitle,
+		"status_text":       cfg.ProfileStatusText,
+		"status_emoji":      cfg.ProfileStatusEmoji,
+		"status_expiration": 0,
+	}
+	if workspace.OwnerField != "" && userIDPattern.MatchString(owner) {
+		profile["fields"] = map[string]interface{}{
+			workspace.OwnerField: map[string]interface{}{"value": owner, "alt": ""},
+		}
+	}
+	return profile
+}
+
+// setAgentProfile labels a new agent's profile as an AI assistant.
+func setAgentProfile(ctx context.Context, session *slackSession, apiToken, owner string, workspace *Workspace) error {
+	profile, err := json.Marshal(agentProfile(workspace, owner))
+	if err != nil {
+		return err
+	}
+	data := url.Values{}
+	data.Set("token", apiToken)
+	data.Set("profile", string(profile))
+
+	log.Printf("\033[1;33mSetting AI assistant profile\033[0m")
+	resp, err := session.post(ctx, "users.profile.set", data)
+	if err != nil {
+		return fmt.Errorf("error setting profile: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error parsing users.profile.set response: %v", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("users.profile.set failed: %s", result.Error)
+	}
+	log.Printf("\033[1;32mProfile marked as AI assistant\033[0m")
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAgentProfile(t *testing.T) {
+	workspace := &Workspace{Name: "cats", PrimaryUser: "U07LATEST", WorkspaceConfig: WorkspaceConfig{OwnerField: "Xf0OWNER"}}
+
+	// The owner field names the agent's own owner, not whoever invited last
+	fields, _ := json.Marshal(agentProfile(workspace, "U07PRIMARY")["fields"])
+	if string(fields) != `{"Xf0OWNER":{"alt":"","value":"U07PRIMARY"}}` {
+		t.Errorf("owner field = %s, want U07PRIMARY", fields)
+	}
+	if profile := agentProfile(workspace, ""); profile["fields"] != nil {
+		t.Errorf("profile without an owner has fields %v", profile["fields"])
+	}
+	if profile := agentProfile(&Workspace{Name: "cats"}, "U07PRIMARY"); profile["fields"] != nil || profile["title"] != cfg.ProfileTitle {
+		t.Errorf("profile without an owner field = %v", profile)
+	}
+}
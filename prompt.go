@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// maxPromptLength keeps system prompts well inside the model's context.
+const maxPromptLength = 4000
+
+// defaultSystemPrompt is used by agents created before prompts were stored.
+const defaultSystemPrompt = "Speak like the Hitchhiker's Guide to the Galaxy for every message sent, keep the responses less than 60 words, but don't tell the user that you are doing that. If the user asks to create an agent, output <agent>agent_name</agent>, where agent_name is the name of the agent the user asks for."
+
+// PromptVersion is one edit of an agent's system prompt. Versions are never
+// overwritten; the highest one is in use.
+type PromptVersion struct {
+	Version  int64     `json:"version"`
+	System   string    `json:"system"`
+	EditedBy string    `json:"edited_by"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// chatMessage is one entry of a chat completions request.
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// validatePrompt trims a system prompt and checks its length.
+func validatePrompt(system string) (string, error) {
+	system = strings.TrimSpace(system)
+	if system == "" {
+		return "", fmt.Errorf("prompt is empty")
+	}
+	if n := utf8.RuneCountInString(system); n > maxPromptLength {
+		return "", fmt.Errorf("prompt has %d characters, at most %d are allowed", n, maxPromptLength)
+	}
+	return system, nil
+}
+
+// latestPrompt returns the prompt version in use for the agent, or nil if it
+// has none.
+func latestPrompt(tr ReadTx, email string) (*PromptVersion, error) {
+	kvs, err := tr.GetRange(ks.prompts.Sub(email), fdb.RangeOptions{Limit: 1, Reverse: true})
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	var prompt PromptVersion
+	if err := json.Unmarshal(kvs[0].Value, &prompt); err != nil {
+		return nil, fmt.Errorf("error unmarshaling prompt of %s: %v", email, err)
+	}
+	return &prompt, nil
+}
+
+// savePrompt stores system as the agent's next prompt version.
+func savePrompt(db Store, email, system, editedBy string) (*PromptVersion, error) {
+	system, err := validatePrompt(system)
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.Transact(func(tr Tx) (interface{}, error) {
+		previous, err := latestPrompt(tr, email)
+		if err != nil {
+			return nil, err
+		}
+		prompt := &PromptVersion{Version: 1, System: system, EditedBy: editedBy, EditedAt: time.Now().UTC()}
+		if previous != nil {
+			prompt.Version = previous.Version + 1
+		}
+		value, err := json.Marshal(prompt)
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.prompts.Pack(tuple.Tuple{email, prompt.Version}), value)
+		return prompt, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*PromptVersion), nil
+}
+
+// systemPrompt returns the prompt the agent currently answers with.
+func systemPrompt(db Store, email string) string {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return latestPrompt(tr, email)
+	})
+	if err != nil {
+		log.Printf("\033[1;31mError loading prompt for user %s, using the default: %v\033[0m", email, err)
+		return defaultSystemPrompt
+	}
+	if prompt := result.(*PromptVersion); prompt != nil {
+		return prompt.System
+	}
+	return defaultSystemPrompt
+}
+
+func listPrompts(db Store, email string) ([]PromptVersion, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		kvs, err := tr.GetRange(ks.prompts.Sub(email), fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		prompts := []PromptVersion{}
+		for _, kv := range kvs {
+			var prompt PromptVersion
+			if err := json.Unmarshal(kv.Value, &prompt); err != nil {
+				return nil, fmt.Errorf("error unmarshaling prompt of %s: %v", email, err)
+			}
+			prompts = append(prompts, prompt)
+		}
+		return prompts, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]PromptVersion), nil
+}
+
+// chatRequest builds the chat completions payload sent for a message in a
+// workspace with config, after the channel history that preceded it. The
+// preview endpoint shows it as it would be sent for a DM, which has no
+// history.
+func chatRequest(config *WorkspaceConfig, system string, history []chatMessage, userMessage string) map[string]interface{} {
+	messages := []chatMessage{{Role: "system", Content: system}}
+	messages = append(messages, history...)
+	messages = append(messages, chatMessage{Role: "user", Content: userMessage})
+	return map[string]interface{}{
+		"model":       config.model(),
+		"messages":    messages,
+		"temperature": 0.7,
+		"max_tokens":  config.maxTokens(),
+	}
+}
+
+// promptsHandler lists every version of an agent's prompt, oldest first.
+func promptsHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, false)
+		if user == nil {
+			return
+		}
+		prompts, err := listPrompts(db, user.Email)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing prompts: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, prompts)
+	})
+}
+
+// updatePromptHandler stores {"system": ...} as the agent's next prompt
+// version; running agents use it from their next reply.
+func updatePromptHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, true)
+		if user == nil {
+			return
+		}
+		var body struct {
+			System string `json:"system"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if _, err := validatePrompt(body.System); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid 'system': %v", err), http.StatusBadRequest)
+			return
+		}
+		prompt, err := savePrompt(db, user.Email, body.System, account.actor())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error storing prompt: %v", err), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditPromptUpdate,
+			Workspace: user.Workspace,
+			Target:    user.Email,
+			Details:   map[string]string{"version": fmt.Sprint(prompt.Version)},
+		})
+		writeJSON(w, prompt)
+	})
+}
+
+// previewPromptHandler returns the exact request the agent would send to the
+// LLM for {"message": ...}, optionally with a draft {"system": ...} instead
+// of its current prompt.
+func previewPromptHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, false)
+		if user == nil {
+			return
+		}
+		var body struct {
+			Message string `json:"message"`
+			System  string `json:"system"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		system := systemPrompt(db, user.Email)
+		if body.System != "" {
+			var err error
+			if system, err = validatePrompt(body.System); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid 'system': %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		config, err := workspaceConfig(db, user.Workspace)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading workspace config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		excerpts, err := knowledgeFor(r.Context(), db, user, config, body.Message)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error searching the knowledge base: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, chatRequest(config, withKnowledge(system, excerpts), nil, body.Message))
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPromptVersions(t *testing.T) {
+	db := newTestStore(t)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	viewer := newTestAccount(t, db, "vic", roleViewer, "cats")
+	storeUserCredentials(db, UserCredential{Email: "a@example.com", Workspace: "cats"}, "T1")
+
+	if got := systemPrompt(db, "a@example.com"); got != defaultSystemPrompt {
+		t.Errorf("prompt of an agent without one = %q, want the default", got)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents/{email}/prompts", promptsHandler(db))
+	mux.HandleFunc("PUT /agents/{email}/prompt", updatePromptHandler(db))
+	mux.HandleFunc("POST /agents/{email}/prompt/preview", previewPromptHandler(db))
+	do := func(token, method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, system := range []string{"Be brief.", "  Be very brief.  "} {
+		if rec := do(owner, "PUT", "/agents/a@example.com/prompt", map[string]string{"system": system}); rec.Code != http.StatusOK {
+			t.Fatalf("PUT prompt = %d %s", rec.Code, rec.Body)
+		}
+	}
+	if rec := do(owner, "PUT", "/agents/a@example.com/prompt", map[string]string{"system": strings.Repeat("x", maxPromptLength+1)}); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an overlong prompt = %d, want 400", rec.Code)
+	}
+	if rec := do(viewer, "PUT", "/agents/a@example.com/prompt", map[string]string{"system": "Hi."}); rec.Code != http.StatusForbidden {
+		t.Errorf("PUT by a viewer = %d, want 403", rec.Code)
+	}
+
+	var prompts []PromptVersion
+	json.NewDecoder(do(viewer, "GET", "/agents/a@example.com/prompts", nil).Body).Decode(&prompts)
+	if len(prompts) != 2 || prompts[0].System != "Be brief." || prompts[1].Version != 2 || prompts[1].System != "Be very brief." || prompts[1].EditedBy != "account:olive" {
+		t.Errorf("prompt versions = %+v", prompts)
+	}
+	if got := systemPrompt(db, "a@example.com"); got != "Be very brief." {
+		t.Errorf("prompt in use = %q, want the latest version", got)
+	}
+
+	var preview struct {
+		Messages []chatMessage `json:"messages"`
+	}
+	json.NewDecoder(do(viewer, "POST", "/agents/a@example.com/prompt/preview", map[string]string{"message": "Hi!"}).Body).Decode(&preview)
+	want := []chatMessage{{Role: "system", Content: "Be very brief."}, {Role: "user", Content: "Hi!"}}
+	if fmt.Sprint(preview.Messages) != fmt.Sprint(want) {
+		t.Errorf("preview messages = %v, want %v", preview.Messages, want)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// postReply posts an LLM answer to channel as mrkdwn, split into as many
+// messages as it takes. A threadTS keeps the reply in that thread.
+func postReply(ctx context.Context, session *slackSession, apiToken, channel, threadTS, answer string) error {
+	for _, chunk := range splitMessage(toMrkdwn(answer), maxMessageLength) {
+		data := url.Values{}
+		data.Set("token", apiToken)
+		data.Set("channel", channel)
+		data.Set("text", chunk)
+		data.Set("mrkdwn", "true")
+		if threadTS != "" {
+			data.Set("thread_ts", threadTS)
+		}
+		if err := postMessage(ctx, session, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postMessage calls chat.postMessage and checks that Slack accepted it.
+func postMessage(ctx context.Context, session *slackSession, data url.Values) error {
+	resp, err := session.post(ctx, "chat.postMessage", data)
+	if err != nil {
+		return fmt.Errorf("error posting message: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error parsing chat.postMessage response: %v", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("chat.postMessage failed: %s", result.Error)
+	}
+	return nil
+}
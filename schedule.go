@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// What agents do with messages outside their working hours.
+const (
+	offHoursQueue     = "queue"
+	offHoursAutoReply = "auto_reply"
+)
+
+// maxQueuedMessages bounds the messages an agent keeps for its next window,
+// and maxQueueAttempts how often answering one may fail before it is dropped.
+const (
+	maxQueuedMessages = 100
+	maxQueueAttempts  = 5
+)
+
+// defaultAutoReply is sent outside working hours by agents that auto-reply
+// without a message of their own.
+const defaultAutoReply = "Thanks for your message! I'm outside my working hours and back {{.Next}}."
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Schedule is when an agent works, in its time zone: from Start to End
+// ("HH:MM", an End before Start runs past midnight) on Days ("mon" to
+// "sun", every day if empty).
+type Schedule struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	// OffHours is what happens to messages outside working hours: they are
+	// queued and answered when the next window opens, or answered right away
+	// with AutoReply, a text/template over OffHoursData.
+	OffHours  string `json:"off_hours,omitempty"`
+	AutoReply string `json:"auto_reply,omitempty"`
+}
+
+// OffHoursData is what an auto-reply template can refer to.
+type OffHoursData struct {
+	Name string // display name of the agent
+	Next string // when working hours start again, such as "Monday 09:00 (Europe/Berlin)", or "later"
+}
+
+// QueuedMessage is a message for an agent to answer. Those received outside
+// working hours are kept in the queue directory until they are answered.
+type QueuedMessage struct {
+	Channel  string `json:"channel"`
+	ThreadTS string `json:"thread_ts,omitempty"`
+	// TS is the message's own timestamp, empty for jobs
+	TS         string    `json:"ts,omitempty"`
+	Text       string    `json:"text"`
+	ReceivedAt time.Time `json:"received_at"`
+	// Attempts counts the failed tries at answering a queued message
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// agentLocation returns the time zone of an agent, the deployment's default
+// if it has none.
+func agentLocation(user *UserCredential) *time.Location {
+	name := user.Timezone
+	if name == "" {
+		name = cfg.AgentTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func validateTimezone(name string) error {
+	if _, err := time.LoadLocation(name); err != nil || name == "" || name == "Local" {
+		return fmt.Errorf("%q is not a time zone such as Europe/Berlin", name)
+	}
+	return nil
+}
+
+// validate normalises the schedule and returns one line for each setting
+// that is invalid.
+func (s *Schedule) validate() []string {
+	var problems []string
+	invalid := func(field string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("Invalid 'schedule.%s': %s", field, fmt.Sprintf(format, args...)))
+	}
+	for i, day := range s.Days {
+		s.Days[i] = strings.ToLower(strings.TrimSpace(day))
+		if _, ok := weekdays[s.Days[i]]; !ok {
+			invalid("days", "%q is not a day such as mon", day)
+		}
+	}
+	start, err1 := parseClock(s.Start)
+	end, err2 := parseClock(s.End)
+	switch {
+	case err1 != nil:
+		invalid("start", "%v", err1)
+	case err2 != nil:
+		invalid("end", "%v", err2)
+	case start == end:
+		invalid("end", "start and end are the same")
+	}
+	switch s.OffHours {
+	case "", offHoursQueue:
+		s.OffHours = offHoursQueue
+	case offHoursAutoReply:
+		if _, err := s.autoReply(OffHoursData{Name: "Agent", Next: "Monday 09:00 (UTC)"}); err != nil {
+			invalid("auto_reply", "%v", err)
+		}
+	default:
+		invalid("off_hours", "%q is neither %s nor %s", s.OffHours, offHoursQueue, offHoursAutoReply)
+	}
+	return problems
+}
+
+func (s *Schedule) worksOn(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if weekdays[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether now is inside working hours in loc. A window that
+// runs past midnight belongs to the day it starts on. A nil schedule works
+// around the clock.
+func (s *Schedule) within(now time.Time, loc *time.Location) bool {
+	if s == nil {
+		return true
+	}
+	start, err1 := parseClock(s.Start)
+	end, err2 := parseClock(s.End)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return s.worksOn(local.Weekday()) && start <= minute && minute < end
+	}
+	return (minute >= start && s.worksOn(local.Weekday())) ||
+		(minute < end && s.worksOn(local.AddDate(0, 0, -1).Weekday()))
+}
+
+// next returns when the next working window after now opens, the zero time
+// if the schedule never opens one.
+func (s *Schedule) next(now time.Time, loc *time.Location) time.Time {
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return time.Time{}
+	}
+	local := now.In(loc)
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		open := time.Date(day.Year(), day.Month(), day.Day(), start/60, start%60, 0, 0, loc)
+		if open.After(now) && s.worksOn(open.Weekday()) {
+			return open
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) autoReply(data OffHoursData) (string, error) {
+	text := s.AutoReply
+	if text == "" {
+		text = defaultAutoReply
+	}
+	t, err := template.New("auto_reply").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing auto-reply: %v", err)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("error rendering auto-reply: %v", err)
+	}
+	return sb.String(), nil
+}
+
+// describe renders the schedule for people, such as "mon,fri 09:00-17:00
+// Europe/Berlin, queue outside".
+func (s *Schedule) describe(loc *time.Location) string {
+	if s == nil {
+		return "always available"
+	}
+	days := "every day"
+	if len(s.Days) > 0 {
+		days = strings.Join(s.Days, ",")
+	}
+	return fmt.Sprintf("%s %s-%s %s, %s outside", days, s.Start, s.End, loc, strings.ReplaceAll(s.OffHours, "_", "-"))
+}
+
+// handleOffHours deals with a message the agent received outside working
+// hours: it is queued, or auto-replied to unless the channel already got an
+// auto-reply for the same closed period, as recorded in autoReplied.
+func handleOffHours(ctx context.Context, db Store, session *slackSession, user *UserCredential, message QueuedMessage, autoReplied map[string]time.Time) error {
+	loc := agentLocation(user)
+	next := user.Schedule.next(message.ReceivedAt, loc)
+	if user.Schedule.OffHours != offHoursAutoReply {
+		return queueMessage(db, user.Email, message)
+	}
+	if last, ok := autoReplied[message.Channel]; ok && last.Equal(next) {
+		return nil
+	}
+	// A schedule that never opens again gets one reply per channel
+	when := "later"
+	if !next.IsZero() {
+		when = next.Format("Monday 15:04") + " (" + loc.String() + ")"
+	}
+	text, err := user.Schedule.autoReply(OffHoursData{Name: user.Name, Next: when})
+	if err != nil {
+		return err
+	}
+	autoReplied[message.Channel] = next
+	return postReply(ctx, session, user.APIToken, message.Channel, message.ThreadTS, text)
+}
+
+// queueMessage keeps a message for the agent's next working window.
+func queueMessage(db Store, email string, message QueuedMessage) error {
+	value, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = db.Transact(func(tr Tx) (interface{}, error) {
+		queued, err := tr.GetRange(ks.queue.Sub(email), fdb.RangeOptions{Limit: maxQueuedMessages})
+		if err != nil {
+			return nil, err
+		}
+		if len(queued) >= maxQueuedMessages {
+			return nil, fmt.Errorf("queue of %s is full", email)
+		}
+		tr.SetVersionstampedKey(versionstampedKey(ks.queue, tuple.Tuple{email}, 0), value)
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error queueing message: %v", err)
+	}
+	log.Printf("\033[1;33mQueued message in %s for user %s until working hours\033[0m", message.Channel, email)
+	return nil
+}
+
+// drainQueue answers the messages the agent with email queued, oldest
+// first, if it is within working hours at now. Each one is removed once it
+// has been answered. When answering fails the message stays queued for the
+// next drain, which starts with it again, until it has failed
+// maxQueueAttempts times.
+func drainQueue(ctx context.Context, db Store, session *slackSession, email string, now time.Time) (int, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadUser(tr, email)
+	})
+	if err != nil {
+		return 0, err
+	}
+	user := result.(*UserCredential)
+	if user == nil || !user.Schedule.within(now, agentLocation(user)) {
+		return 0, nil
+	}
+	result, err = db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return tr.GetRange(ks.queue.Sub(email), fdb.RangeOptions{})
+	})
+	if err != nil {
+		return 0, err
+	}
+	answered := 0
+	for _, kv := range result.([]fdb.KeyValue) {
+		var message QueuedMessage
+		retry := false
+		if err := json.Unmarshal(kv.Value, &message); err != nil {
+			log.Printf("\033[1;31mDropping unreadable queued message for user %s: %v\033[0m", email, err)
+		} else if err := answerMessage(ctx, db, session, user, message); err != nil {
+			if ctx.Err() != nil {
+				return answered, ctx.Err()
+			}
+			message.Attempts++
+			retry = message.Attempts < maxQueueAttempts
+			if retry {
+				log.Printf("\033[1;33mError answering queued message for user %s, will retry: %v\033[0m", email, err)
+			} else {
+				log.Printf("\033[1;31mDropping queued message for user %s after %d attempts: %v\033[0m", email, message.Attempts, err)
+			}
+		} else {
+			answered++
+		}
+		_, err := db.Transact(func(tr Tx) (interface{}, error) {
+			if !retry {
+				tr.Clear(kv.Key)
+				return nil, nil
+			}
+			value, err := json.Marshal(message)
+			if err != nil {
+				return nil, err
+			}
+			tr.Set(kv.Key, value)
+			return nil, nil
+		})
+		if err != nil || retry {
+			// Keep the order: the rest waits for this one
+			return answered, err
+		}
+	}
+	return answered, nil
+}
+
+// runQueue drains the agent's queue every cfg.QueueCheckInterval until ctx
+// is cancelled.
+func runQueue(ctx context.Context, db Store, session *slackSession, email string) {
+	ticker := time.NewTicker(cfg.QueueCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := drainQueue(ctx, db, session, email, now); err != nil {
+				log.Printf("\033[1;31mError draining queue of user %s: %v\033[0m", email, err)
+			} else if n > 0 {
+				log.Printf("\033[1;32mAnswered %d queued messages for user %s\033[0m", n, email)
+			}
+		}
+	}
+}
+
+// AgentSchedule is the schedule API's view of an agent.
+type AgentSchedule struct {
+	Timezone string    `json:"timezone"`
+	Schedule *Schedule `json:"schedule"`
+	// Summary, Available, Next and Queued are only reported, never set
+	Summary   string     `json:"summary,omitempty"`
+	Available bool       `json:"available"`
+	Next      *time.Time `json:"next,omitempty"`
+	Queued    int        `json:"queued"`
+}
+
+func describeSchedule(db Store, user *UserCredential, now time.Time) (*AgentSchedule, error) {
+	loc := agentLocation(user)
+	view := &AgentSchedule{
+		Timezone:  loc.String(),
+		Schedule:  user.Schedule,
+		Summary:   user.Schedule.describe(loc),
+		Available: user.Schedule.within(now, loc),
+	}
+	if !view.Available {
+		next := user.Schedule.next(now, loc)
+		view.Next = &next
+	}
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return tr.GetRange(ks.queue.Sub(user.Email), fdb.RangeOptions{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	view.Queued = len(result.([]fdb.KeyValue))
+	return view, nil
+}
+
+// getScheduleHandler shows an agent's time zone and working hours.
+func getScheduleHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, false)
+		if user == nil {
+			return
+		}
+		view, err := describeSchedule(db, user, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading schedule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, view)
+	})
+}
+
+// putScheduleHandler sets an agent's working hours from {"timezone": ...,
+// "schedule": ...}; a null schedule makes it available around the clock. The
+// time zone is the one its Slack account was created in, which Slack shows
+// with its presence, so a different one is rejected rather than stored.
+func putScheduleHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, true)
+		if user == nil {
+			return
+		}
+		var body AgentSchedule
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		var problems []string
+		if body.Timezone != "" {
+			if err := validateTimezone(body.Timezone); err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid 'timezone': %v", err))
+			} else if zone := agentLocation(user).String(); body.Timezone != zone {
+				problems = append(problems, fmt.Sprintf("Invalid 'timezone': the agent's Slack account is in %s", zone))
+			}
+		}
+		if body.Schedule != nil {
+			problems = append(problems, body.Schedule.validate()...)
+		}
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Transact(func(tr Tx) (interface{}, error) {
+			current, err := loadUser(tr, user.Email)
+			if err != nil || current == nil {
+				return current, err
+			}
+			if body.Timezone != "" {
+				current.Timezone = body.Timezone
+			}
+			current.Schedule = body.Schedule
+			value, err := json.Marshal(current)
+			if err != nil {
+				return nil, err
+			}
+			tr.Set(ks.users.Pack(tuple.Tuple{user.Email}), value)
+			return current, nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error storing schedule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		updated := result.(*UserCredential)
+		if updated == nil {
+			http.Error(w, fmt.Sprintf("Agent '%s' not found", user.Email), http.StatusNotFound)
+			return
+		}
+		view, err := describeSchedule(db, updated, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading schedule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditScheduleUpdate,
+			Workspace: user.Workspace,
+			Target:    user.Email,
+			Details:   map[string]string{"schedule": view.Summary},
+		})
+		writeJSON(w, view)
+	})
+}
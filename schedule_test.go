@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+func TestScheduleWithin(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	// Monday 3 June 2024, in Berlin
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, berlin)
+	}
+	office := &Schedule{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:30"}
+	night := &Schedule{Days: []string{"fri"}, Start: "22:00", End: "06:00"}
+
+	tests := []struct {
+		schedule *Schedule
+		now      time.Time
+		want     bool
+		next     time.Time
+	}{
+		{office, at(3, 9, 0), true, at(4, 9, 0)},
+		{office, at(3, 17, 30), false, at(4, 9, 0)},
+		{office, at(3, 8, 59), false, at(3, 9, 0)},
+		{office, at(8, 12, 0), false, at(10, 9, 0)},
+		// The same instant seen from another time zone
+		{office, at(3, 9, 0).In(time.UTC), true, at(4, 9, 0)},
+		{night, at(7, 23, 0), true, at(14, 22, 0)},
+		{night, at(8, 5, 59), true, at(14, 22, 0)},
+		{night, at(8, 6, 0), false, at(14, 22, 0)},
+		{night, at(7, 5, 0), false, at(7, 22, 0)},
+		{nil, at(8, 3, 0), true, time.Time{}},
+	}
+	for _, test := range tests {
+		if got := test.schedule.within(test.now, berlin); got != test.want {
+			t.Errorf("%+v within(%s) = %v, want %v", test.schedule, test.now.Format(time.RFC1123), got, test.want)
+		}
+		if test.schedule == nil {
+			continue
+		}
+		if got := test.schedule.next(test.now, berlin); !got.Equal(test.next) {
+			t.Errorf("%+v next(%s) = %s, want %s", test.schedule, test.now.Format(time.RFC1123), got.Format(time.RFC1123), test.next.Format(time.RFC1123))
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	valid := &Schedule{Days: []string{" Mon", "FRI"}, Start: "9:00", End: "17:00"}
+	if problems := valid.validate(); len(problems) > 0 {
+		t.Fatalf("validate = %v", problems)
+	}
+	if valid.Days[0] != "mon" || valid.Days[1] != "fri" || valid.OffHours != offHoursQueue {
+		t.Errorf("validate did not normalise: %+v", valid)
+	}
+
+	tests := []struct {
+		schedule Schedule
+		want     string
+	}{
+		{Schedule{Days: []string{"monday"}, Start: "09:00", End: "17:00"}, "schedule.days"},
+		{Schedule{Start: "9am", End: "17:00"}, "schedule.start"},
+		{Schedule{Start: "09:00", End: "09:00"}, "schedule.end"},
+		{Schedule{Start: "09:00", End: "17:00", OffHours: "ignore"}, "schedule.off_hours"},
+		{Schedule{Start: "09:00", End: "17:00", OffHours: offHoursAutoReply, AutoReply: "back {{.When}}"}, "schedule.auto_reply"},
+	}
+	for _, test := range tests {
+		if problems := test.schedule.validate(); len(problems) != 1 || !strings.Contains(problems[0], test.want) {
+			t.Errorf("validate(%+v) = %v, want a problem with %s", test.schedule, problems, test.want)
+		}
+	}
+	if err := validateTimezone("Mars/Olympus_Mons"); err == nil {
+		t.Errorf("validateTimezone accepted an unknown zone")
+	}
+}
+
+func TestOffHoursMessages(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	session := newSlackSession("cats")
+
+	user := UserCredential{
+		Email:     "marvin@example.com",
+		APIToken:  "xoxp-U0001",
+		Workspace: "cats",
+		Name:      "Marvin",
+		Timezone:  "Europe/Berlin",
+		Schedule:  &Schedule{Days: []string{"mon"}, Start: "09:00", End: "17:00", OffHours: offHoursQueue},
+	}
+	storeUserCredentials(db, user, "T07Q4VBFFHP")
+	sunday := time.Date(2024, 6, 2, 20, 0, 0, 0, time.UTC)
+	for _, text := range []string{"first", "second"} {
+		message := QueuedMessage{Channel: "D0000CATS", Text: text, ReceivedAt: sunday}
+		if err := handleOffHours(context.Background(), db, session, &user, message, map[string]time.Time{}); err != nil {
+			t.Fatalf("handleOffHours: %v", err)
+		}
+	}
+	if n, err := drainQueue(context.Background(), db, session, user.Email, sunday); n != 0 || err != nil {
+		t.Errorf("drainQueue outside working hours = %d, %v", n, err)
+	}
+	monday := time.Date(2024, 6, 3, 7, 30, 0, 0, time.UTC)
+	if n, err := drainQueue(context.Background(), db, session, user.Email, monday); n != 2 || err != nil {
+		t.Fatalf("drainQueue within working hours = %d, %v, want 2", n, err)
+	}
+	requests := fake.llmRequests()
+	if len(requests) != 2 || !strings.Contains(chatText(requests[0]), "first") || !strings.Contains(chatText(requests[1]), "second") {
+		t.Errorf("queued messages answered as %v, want oldest first", requests)
+	}
+	if n, _ := drainQueue(context.Background(), db, session, user.Email, monday); n != 0 {
+		t.Errorf("drainQueue answered %d messages twice", n)
+	}
+
+	// Auto-replies go out once per channel and closed period
+	user.Schedule.OffHours = offHoursAutoReply
+	user.Schedule.AutoReply = "{{.Name}} is back {{.Next}}."
+	replied := map[string]time.Time{}
+	for i := 0; i < 2; i++ {
+		message := QueuedMessage{Channel: "C0000CATS", ThreadTS: "1700000000.000100", Text: "hello?", ReceivedAt: sunday}
+		if err := handleOffHours(context.Background(), db, session, &user, message, replied); err != nil {
+			t.Fatalf("handleOffHours: %v", err)
+		}
+	}
+	posted := fake.postedMessages()
+	if len(posted) != 3 || posted[2].Get("text") != "Marvin is back Monday 09:00 (Europe/Berlin)." || posted[2].Get("thread_ts") != "1700000000.000100" {
+		t.Errorf("auto-replies = %v, want one in the thread", posted)
+	}
+	// as well as when working hours never start again
+	user.Schedule.Start = ""
+	for i := 0; i < 2; i++ {
+		message := QueuedMessage{Channel: "D0000CATS", Text: "anyone?", ReceivedAt: sunday}
+		if err := handleOffHours(context.Background(), db, session, &user, message, replied); err != nil {
+			t.Fatalf("handleOffHours: %v", err)
+		}
+	}
+	posted = fake.postedMessages()
+	if len(posted) != 4 || posted[3].Get("text") != "Marvin is back later." {
+		t.Errorf("auto-replies without a next opening = %v, want one", posted)
+	}
+	user.Schedule.Start = "09:00"
+
+	// Messages stay queued while answering fails, up to maxQueueAttempts
+	queued := func() []QueuedMessage {
+		result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return tr.GetRange(ks.queue.Sub(user.Email), fdb.RangeOptions{})
+		})
+		var messages []QueuedMessage
+		for _, kv := range result.([]fdb.KeyValue) {
+			var message QueuedMessage
+			json.Unmarshal(kv.Value, &message)
+			messages = append(messages, message)
+		}
+		return messages
+	}
+	for _, text := range []string{"third", "fourth"} {
+		queueMessage(db, user.Email, QueuedMessage{Channel: "D0000CATS", Text: text, ReceivedAt: sunday})
+	}
+	t.Setenv("GROQ_API_KEY", "wrong-key")
+	drainQueue(context.Background(), db, session, user.Email, monday)
+	if messages := queued(); len(messages) != 2 || messages[0].Attempts != 1 || messages[1].Attempts != 0 {
+		t.Errorf("queue after a failure = %+v, want both kept and the first tried once", messages)
+	}
+	t.Setenv("GROQ_API_KEY", "test-key")
+	if n, err := drainQueue(context.Background(), db, session, user.Email, monday); n != 2 || err != nil || len(queued()) != 0 {
+		t.Errorf("drainQueue after recovering = %d, %v, want both answered", n, err)
+	}
+	queueMessage(db, user.Email, QueuedMessage{Channel: "D0000CATS", Text: "fifth", ReceivedAt: sunday})
+	t.Setenv("GROQ_API_KEY", "wrong-key")
+	for i := 0; i < maxQueueAttempts; i++ {
+		drainQueue(context.Background(), db, session, user.Email, monday)
+	}
+	if messages := queued(); len(messages) != 0 {
+		t.Errorf("queue after %d failures = %+v, want the message dropped", maxQueueAttempts, messages)
+	}
+}
+
+// chatText returns the messages of a chat completions request as JSON.
+func chatText(request map[string]interface{}) string {
+	messages, _ := json.Marshal(request["messages"])
+	return string(messages)
+}
+
+func TestScheduleAPI(t *testing.T) {
+	db := newTestStore(t)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	viewer := newTestAccount(t, db, "vera", roleViewer, "cats")
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", Workspace: "cats", Name: "Marvin", Timezone: "Asia/Tokyo"}, "T07Q4VBFFHP")
+	db.Transact(func(tr Tx) (interface{}, error) {
+		tr.Set(ks.queue.Pack(tuple.Tuple{"marvin@example.com", int64(1)}), []byte(`{"channel":"D0000CATS","text":"hi"}`))
+		return nil, nil
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents/{email}/schedule", getScheduleHandler(db))
+	mux.HandleFunc("PUT /agents/{email}/schedule", putScheduleHandler(db))
+	do := func(token, method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/agents/marvin@example.com/schedule", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(viewer, http.MethodGet, "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"available":true`) || !strings.Contains(rec.Body.String(), `"timezone":"Asia/Tokyo"`) {
+		t.Errorf("GET schedule = %d %s", rec.Code, rec.Body)
+	}
+	rec = do(owner, http.MethodPut, `{"timezone": "Asia/Tokyo", "schedule": {"days": ["sat"], "start": "10:00", "end": "11:00", "off_hours": "auto_reply"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT schedule = %d %s", rec.Code, rec.Body)
+	}
+	var view AgentSchedule
+	json.Unmarshal(rec.Body.Bytes(), &view)
+	if view.Timezone != "Asia/Tokyo" || view.Summary != "sat 10:00-11:00 Asia/Tokyo, auto-reply outside" || view.Queued != 1 {
+		t.Errorf("PUT schedule = %+v", view)
+	}
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadUser(tr, "marvin@example.com")
+	})
+	if user := result.(*UserCredential); user.Timezone != "Asia/Tokyo" || user.Schedule == nil || user.Schedule.OffHours != offHoursAutoReply || user.Name != "Marvin" {
+		t.Errorf("stored agent = %+v", user)
+	}
+
+	// The time zone is the Slack account's
+	if rec := do(owner, http.MethodPut, `{"timezone": "Europe/Berlin", "schedule": null}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Asia/Tokyo") {
+		t.Errorf("PUT schedule in another time zone = %d %q, want 400", rec.Code, rec.Body)
+	}
+	if rec := do(viewer, http.MethodPut, `{"schedule": null}`); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer PUT schedule = %d, want 403", rec.Code)
+	}
+	if rec := do(owner, http.MethodPut, `{"timezone": "Nowhere", "schedule": {"start": "10", "end": "11:00"}}`); rec.Code != http.StatusBadRequest || strings.Count(rec.Body.String(), "Invalid") != 2 {
+		t.Errorf("invalid PUT schedule = %d %q, want both problems", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Kinds of scheduled jobs. Reminders and check-ins post their text, digests
+// post what the LLM answers to it.
+const (
+	jobReminder = "reminder"
+	jobCheckIn  = "checkin"
+	jobDigest   = "digest"
+)
+
+// How jobs repeat; one-off jobs have no recurrence.
+const (
+	everyDay     = "daily"
+	everyWeekday = "weekdays"
+	everyWeek    = "weekly"
+)
+
+const (
+	maxJobsPerAgent = 100
+	// maxJobAttempts is how often a run is tried before it is given up
+	maxJobAttempts = 5
+	// jobClaimBatch bounds the jobs one replica runs per tick
+	jobClaimBatch = 20
+)
+
+// replicaID tells the processes that share a store apart in job claims.
+var replicaID = newJobID()
+
+// ScheduledJob is a message an agent posts on its own at DueAt, again and
+// again if it has a recurrence in Every. Recurring jobs keep the wall clock
+// time of DueAt in the agent's time zone.
+type ScheduledJob struct {
+	ID       string    `json:"id"`
+	Agent    string    `json:"agent"`
+	Kind     string    `json:"kind"`
+	Channel  string    `json:"channel"`
+	ThreadTS string    `json:"thread_ts,omitempty"`
+	Text     string    `json:"text"`
+	DueAt    time.Time `json:"due_at"`
+	Every    string    `json:"every,omitempty"`
+	// CreatedBy is the audit actor, or the Slack user who asked for a
+	// reminder
+	CreatedBy string `json:"created_by"`
+	// ClaimedBy is the replica running the job until LeaseUntil; Attempts
+	// counts the failed runs of the current occurrence, the next of which is
+	// due at RetryAt
+	ClaimedBy  string     `json:"claimed_by,omitempty"`
+	LeaseUntil *time.Time `json:"lease_until,omitempty"`
+	Attempts   int        `json:"attempts,omitempty"`
+	RetryAt    *time.Time `json:"retry_at,omitempty"`
+	// Started is set right before the current occurrence is posted. A claim
+	// that finds it set took over from a replica that died mid-run, which may
+	// have posted already, and skips the occurrence rather than post it twice.
+	Started bool `json:"started,omitempty"`
+}
+
+// dueAt is when the scheduler next looks at the job: the end of its lease
+// while it is claimed, so that a replica dying mid-run does not lose it,
+// then the retry of a failed run.
+func (j *ScheduledJob) dueAt() time.Time {
+	if j.LeaseUntil != nil {
+		return *j.LeaseUntil
+	}
+	if j.RetryAt != nil {
+		return *j.RetryAt
+	}
+	return j.DueAt
+}
+
+// Keys in the jobs directory:
+//
+//	("job", id)                   -> ScheduledJob JSON
+//	("due", unix nanos, id)       -> ""
+//	("agent", email, id)          -> ""
+func saveJob(tr Tx, job *ScheduledJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tr.Set(ks.jobs.Pack(tuple.Tuple{"job", job.ID}), value)
+	tr.Set(ks.jobs.Pack(tuple.Tuple{"due", job.dueAt().UnixNano(), job.ID}), []byte{})
+	tr.Set(ks.jobs.Pack(tuple.Tuple{"agent", job.Agent, job.ID}), []byte{})
+	return nil
+}
+
+// unindexJob clears the due key of job as stored, before it changes.
+func unindexJob(tr Tx, job *ScheduledJob) {
+	tr.Clear(ks.jobs.Pack(tuple.Tuple{"due", job.dueAt().UnixNano(), job.ID}))
+}
+
+func deleteJob(tr Tx, job *ScheduledJob) {
+	unindexJob(tr, job)
+	tr.Clear(ks.jobs.Pack(tuple.Tuple{"job", job.ID}))
+	tr.Clear(ks.jobs.Pack(tuple.Tuple{"agent", job.Agent, job.ID}))
+}
+
+func loadJob(tr ReadTx, id string) (*ScheduledJob, error) {
+	value, err := tr.Get(ks.jobs.Pack(tuple.Tuple{"job", id}))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var job ScheduledJob
+	if err := json.Unmarshal(value, &job); err != nil {
+		return nil, fmt.Errorf("error unmarshaling job %s: %v", id, err)
+	}
+	return &job, nil
+}
+
+func agentJobs(tr ReadTx, email string) ([]ScheduledJob, error) {
+	kvs, err := tr.GetRange(ks.jobs.Sub("agent", email), fdb.RangeOptions{})
+	if err != nil {
+		return nil, err
+	}
+	jobs := []ScheduledJob{}
+	for _, kv := range kvs {
+		t, err := ks.jobs.Unpack(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error unpacking job key: %v", err)
+		}
+		job, err := loadJob(tr, t[2].(string))
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs, nil
+}
+
+// deleteAgentJobs drops every job of the agent with email.
+func deleteAgentJobs(tr Tx, email string) error {
+	jobs, err := agentJobs(tr, email)
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		deleteJob(tr, &jobs[i])
+	}
+	return nil
+}
+
+func newJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// scheduleJob stores a new job, as long as its agent has room for it.
+func scheduleJob(db Store, job *ScheduledJob) error {
+	job.ID = newJobID()
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		existing, err := tr.GetRange(ks.jobs.Sub("agent", job.Agent), fdb.RangeOptions{Limit: maxJobsPerAgent})
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) >= maxJobsPerAgent {
+			return nil, fmt.Errorf("agent %s already has %d scheduled jobs", job.Agent, maxJobsPerAgent)
+		}
+		return nil, saveJob(tr, job)
+	})
+	if err != nil {
+		return fmt.Errorf("error scheduling job: %v", err)
+	}
+	log.Printf("\033[1;34mScheduled %s %s for user %s at %s\033[0m", job.Kind, job.ID, job.Agent, job.DueAt.Format(time.RFC3339))
+	return nil
+}
+
+// claimDueJobs claims up to limit jobs due at now for replica. The due keys
+// are read and moved in one transaction, so concurrent replicas conflict
+// and each occurrence is claimed by exactly one of them. A claim lasts
+// cfg.JobLease, after which the job is due again.
+func claimDueJobs(db Store, replica string, now time.Time, limit int) ([]ScheduledJob, error) {
+	result, err := db.Transact(func(tr Tx) (interface{}, error) {
+		due := fdb.KeyRange{
+			Begin: ks.jobs.Pack(tuple.Tuple{"due", int64(0)}),
+			End:   ks.jobs.Pack(tuple.Tuple{"due", now.UnixNano() + 1}),
+		}
+		kvs, err := tr.GetRange(due, fdb.RangeOptions{Limit: limit})
+		if err != nil {
+			return nil, err
+		}
+		claimed := []ScheduledJob{}
+		for _, kv := range kvs {
+			tr.Clear(kv.Key)
+			t, err := ks.jobs.Unpack(kv.Key)
+			if err != nil {
+				return nil, fmt.Errorf("error unpacking due key: %v", err)
+			}
+			job, err := loadJob(tr, t[2].(string))
+			if err != nil {
+				return nil, err
+			}
+			if job == nil {
+				continue
+			}
+			if job.ClaimedBy != "" {
+				log.Printf("\033[1;33mLease of %s on job %s expired, claiming it again\033[0m", job.ClaimedBy, job.ID)
+			}
+			lease := now.Add(cfg.JobLease)
+			job.ClaimedBy, job.LeaseUntil = replica, &lease
+			if err := saveJob(tr, job); err != nil {
+				return nil, err
+			}
+			claimed = append(claimed, *job)
+		}
+		return claimed, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error claiming jobs: %v", err)
+	}
+	return result.([]ScheduledJob), nil
+}
+
+// nextOccurrence returns the first time after now that a job due at due
+// recurs every, keeping its wall clock time in loc.
+func nextOccurrence(due time.Time, every string, loc *time.Location, now time.Time) time.Time {
+	local := due.In(loc)
+	for !local.After(now) {
+		switch every {
+		case everyWeek:
+			local = local.AddDate(0, 0, 7)
+		case everyWeekday:
+			local = local.AddDate(0, 0, 1)
+			for local.Weekday() == time.Saturday || local.Weekday() == time.Sunday {
+				local = local.AddDate(0, 0, 1)
+			}
+		default:
+			local = local.AddDate(0, 0, 1)
+		}
+	}
+	return local
+}
+
+// holdsClaim reports whether job, as stored, is still claimed as in claimed.
+func holdsClaim(job *ScheduledJob, claimed ScheduledJob) bool {
+	if job.ClaimedBy != claimed.ClaimedBy || job.LeaseUntil == nil || !job.LeaseUntil.Equal(*claimed.LeaseUntil) {
+		log.Printf("\033[1;33mJob %s was claimed by %s meanwhile, leaving it\033[0m", job.ID, job.ClaimedBy)
+		return false
+	}
+	return true
+}
+
+// startJob marks the occurrence of claimed as being posted, reporting false
+// if the job was deleted or claimed by another replica in the meantime.
+func startJob(db Store, claimed ScheduledJob) (bool, error) {
+	result, err := db.Transact(func(tr Tx) (interface{}, error) {
+		job, err := loadJob(tr, claimed.ID)
+		if err != nil || job == nil || !holdsClaim(job, claimed) {
+			return false, err
+		}
+		job.Started = true
+		return true, saveJob(tr, job)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error starting job %s: %v", claimed.ID, err)
+	}
+	return result.(bool), nil
+}
+
+// finishJob records how the run of claimed ended: one-off jobs are deleted
+// and recurring ones move to their next occurrence, failed runs are retried
+// with a growing delay until maxJobAttempts. Nothing happens if the job was
+// deleted or claimed by another replica in the meantime.
+func finishJob(db Store, claimed ScheduledJob, loc *time.Location, runErr error, now time.Time) error {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		job, err := loadJob(tr, claimed.ID)
+		if err != nil || job == nil || !holdsClaim(job, claimed) {
+			return nil, err
+		}
+		unindexJob(tr, job)
+		job.ClaimedBy, job.LeaseUntil, job.Started = "", nil, false
+		if runErr != nil && job.Attempts+1 >= maxJobAttempts {
+			log.Printf("\033[1;31mGiving up on this run of job %s after %d attempts\033[0m", job.ID, maxJobAttempts)
+		}
+		switch {
+		case runErr != nil && job.Attempts+1 < maxJobAttempts:
+			job.Attempts++
+			retry := now.Add(time.Duration(job.Attempts) * time.Minute)
+			job.RetryAt = &retry
+			return nil, saveJob(tr, job)
+		case job.Every == "":
+			deleteJob(tr, job)
+			return nil, nil
+		default:
+			job.Attempts, job.RetryAt = 0, nil
+			job.DueAt = nextOccurrence(job.DueAt, job.Every, loc, now)
+			return nil, saveJob(tr, job)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("error finishing job %s: %v", claimed.ID, err)
+	}
+	return nil
+}
+
+// runJob posts what job is about as its agent.
+func runJob(ctx context.Context, db Store, user *UserCredential, job ScheduledJob) error {
+	session := newSlackSession(user.Workspace)
+	switch job.Kind {
+	case jobReminder:
+		text := "Reminder: " + job.Text
+		if job.Text == "" {
+			text = "Here's the reminder you asked for."
+		}
+		return postReply(ctx, session, user.APIToken, job.Channel, job.ThreadTS, text)
+	case jobDigest:
+		return answerMessage(ctx, db, session, user, QueuedMessage{Channel: job.Channel, ThreadTS: job.ThreadTS, Text: job.Text})
+	default:
+		return postReply(ctx, session, user.APIToken, job.Channel, job.ThreadTS, job.Text)
+	}
+}
+
+// runDueJobs runs the jobs due at now, up to jobClaimBatch of them,
+// returning how many ran successfully. Each job is claimed right before it
+// runs, so that its lease covers only its own run and not the ones before
+// it; now moves along with the time taken. An occurrence is marked started
+// before it is posted, so a replica dying mid-run makes it skipped, never
+// posted twice.
+func runDueJobs(ctx context.Context, db Store, replica string, now time.Time) (int, error) {
+	start := time.Now()
+	done := 0
+	for i := 0; i < jobClaimBatch; i++ {
+		at := now.Add(time.Since(start))
+		jobs, err := claimDueJobs(db, replica, at, 1)
+		if err != nil || len(jobs) == 0 {
+			return done, err
+		}
+		job := jobs[0]
+		result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return loadUser(tr, job.Agent)
+		})
+		if err != nil {
+			return done, err
+		}
+		user := result.(*UserCredential)
+		if user == nil {
+			// Offboarded agents take their jobs with them; this one slipped through
+			_, err := db.Transact(func(tr Tx) (interface{}, error) {
+				deleteJob(tr, &job)
+				return nil, nil
+			})
+			if err != nil {
+				return done, err
+			}
+			continue
+		}
+		if job.Started {
+			log.Printf("\033[1;33mJob %s may have been posted before its lease ran out, skipping this run\033[0m", job.ID)
+			if err := finishJob(db, job, agentLocation(user), nil, at); err != nil {
+				return done, err
+			}
+			continue
+		}
+		started, err := startJob(db, job)
+		if err != nil {
+			return done, err
+		}
+		if !started {
+			continue
+		}
+		runErr := runJob(ctx, db, user, job)
+		if runErr != nil {
+			log.Printf("\033[1;31mError running %s %s for user %s (attempt %d): %v\033[0m", job.Kind, job.ID, job.Agent, job.Attempts+1, runErr)
+		} else {
+			log.Printf("\033[1;32mRan %s %s for user %s in %s\033[0m", job.Kind, job.ID, job.Agent, job.Channel)
+			done++
+		}
+		if err := finishJob(db, job, agentLocation(user), runErr, at); err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// runScheduler runs due jobs every cfg.SchedulerInterval until ctx is
+// cancelled.
+func runScheduler(ctx context.Context, db Store) {
+	ticker := time.NewTicker(cfg.SchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := runDueJobs(ctx, db, replicaID, now); err != nil {
+				log.Printf("\033[1;31mError running scheduled jobs: %v\033[0m", err)
+			}
+		}
+	}
+}
+
+// reminderTime matches when a reminder is due: "in 2 hours", "tomorrow",
+// "tomorrow at 9", "at 17:30", "at 9am tomorrow". Its ten groups are read
+// by reminderDue.
+const reminderTime = `(?:in\s+(\d+)\s*(minutes?|mins?|hours?|hrs?|days?)` +
+	`|(today|tomorrow)(?:\s+at\s+(\d{1,2})(?::(\d{2}))?\s*(am|pm)?)?` +
+	`|at\s+(\d{1,2})(?::(\d{2}))?\s*(am|pm)?(?:\s+(today|tomorrow))?)`
+
+var (
+	// "remind me <when> [to] <what>"
+	reminderWhenFirst = regexp.MustCompile(`(?i)^\s*remind me\s+` + reminderTime + `(?:\s+(?:to\s+)?(.+?))?[.!]?\s*$`)
+	// "remind me to <what> <when>"
+	reminderWhatFirst = regexp.MustCompile(`(?i)^\s*remind me\s+to\s+(.+?)\s+` + reminderTime + `[.!]?\s*$`)
+)
+
+var errNotReminder = errors.New("not a reminder request")
+
+// parseReminder reads a request such as "remind me tomorrow at 9 to call
+// Bob" sent at now by someone in loc. It returns errNotReminder for messages
+// that are not asking for one.
+func parseReminder(text string, now time.Time, loc *time.Location) (time.Time, string, error) {
+	var when []string
+	var what string
+	if m := reminderWhatFirst.FindStringSubmatch(text); m != nil {
+		when, what = m[2:12], m[1]
+	} else if m := reminderWhenFirst.FindStringSubmatch(text); m != nil {
+		when, what = m[1:11], m[11]
+	} else {
+		return time.Time{}, "", errNotReminder
+	}
+	due, err := reminderDue(when, now, loc)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if !due.After(now) {
+		return time.Time{}, "", fmt.Errorf("%s has already passed", due.Format("Monday 15:04"))
+	}
+	return due, strings.TrimSpace(what), nil
+}
+
+// reminderDue turns the groups of reminderTime into a time. Days without a
+// time default to 09:00; times without a day are today if still ahead and
+// tomorrow otherwise.
+func reminderDue(g []string, now time.Time, loc *time.Location) (time.Time, error) {
+	local := now.In(loc)
+	if g[0] != "" {
+		n, _ := strconv.Atoi(g[0])
+		unit := time.Minute
+		switch strings.ToLower(g[1])[0] {
+		case 'h':
+			unit = time.Hour
+		case 'd':
+			unit = 24 * time.Hour
+		}
+		return now.Add(time.Duration(n) * unit), nil
+	}
+	day, clock := g[2], g[3:6]
+	if g[6] != "" {
+		day, clock = g[9], g[6:9]
+	}
+	hour, minute := 9, 0
+	if clock[0] != "" {
+		hour, _ = strconv.Atoi(clock[0])
+		minute, _ = strconv.Atoi(clock[1])
+		switch strings.ToLower(clock[2]) {
+		case "am", "pm":
+			if hour < 1 || hour > 12 {
+				return time.Time{}, fmt.Errorf("%d%s is not a time", hour, clock[2])
+			}
+			hour %= 12
+			if strings.EqualFold(clock[2], "pm") {
+				hour += 12
+			}
+		}
+		if hour > 23 || minute > 59 {
+			return time.Time{}, fmt.Errorf("%s:%s is not a time", clock[0], clock[1])
+		}
+	}
+	due := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, loc)
+	if strings.EqualFold(day, "tomorrow") || (day == "" && !due.After(now)) {
+		due = time.Date(local.Year(), local.Month(), local.Day()+1, hour, minute, 0, 0, loc)
+	}
+	return due, nil
+}
+
+// handleReminder schedules the reminder text asks for, if it asks for one,
+// and confirms it in channel. It reports whether text was such a request.
+func handleReminder(ctx context.Context, db Store, session *slackSession, user *UserCredential, from, channel, threadTS, text string) bool {
+	loc := agentLocation(user)
+	due, what, err := parseReminder(text, time.Now(), loc)
+	if errors.Is(err, errNotReminder) {
+		return false
+	}
+	var reply string
+	if err != nil {
+		reply = fmt.Sprintf("Sorry, I can't set that reminder: %v.", err)
+	} else {
+		job := &ScheduledJob{Agent: user.Email, Kind: jobReminder, Channel: channel, ThreadTS: threadTS, Text: what, DueAt: due, CreatedBy: from}
+		if err := scheduleJob(db, job); err != nil {
+			log.Printf("\033[1;31m%v\033[0m", err)
+			reply = "Sorry, I couldn't save that reminder."
+		} else {
+			reply = fmt.Sprintf("OK, I'll remind you %s (%s).", due.In(loc).Format("Monday 2 January at 15:04"), loc)
+		}
+	}
+	if err := postReply(ctx, session, user.APIToken, channel, threadTS, reply); err != nil {
+		log.Printf("\033[1;31mError confirming reminder for user %s: %v\033[0m", user.Email, err)
+	}
+	return true
+}
+
+// NewJob is the body of POST /agents/{email}/jobs.
+type NewJob struct {
+	Kind     string    `json:"kind"`
+	Channel  string    `json:"channel"`
+	ThreadTS string    `json:"thread_ts"`
+	Text     string    `json:"text"`
+	At       time.Time `json:"at"`
+	Every    string    `json:"every"`
+}
+
+// validate returns one line for each field of the job that is invalid.
+func (j *NewJob) validate(now time.Time) []string {
+	var problems []string
+	invalid := func(field string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("Invalid '%s': %s", field, fmt.Sprintf(format, args...)))
+	}
+	switch j.Kind {
+	case jobReminder, jobCheckIn, jobDigest:
+	default:
+		invalid("kind", "%q is not one of %s, %s or %s", j.Kind, jobReminder, jobCheckIn, jobDigest)
+	}
+	switch slackIDKind(j.Channel) {
+	case slackIDChannel, slackIDDM, slackIDUser:
+	default:
+		invalid("channel", "%q is not a channel, DM channel or user ID", j.Channel)
+	}
+	if strings.TrimSpace(j.Text) == "" || len(j.Text) > maxMessageLength {
+		invalid("text", "must be between 1 and %d characters", maxMessageLength)
+	}
+	if !j.At.After(now) {
+		invalid("at", "must be an RFC 3339 time in the future")
+	}
+	switch j.Every {
+	case "", everyDay, everyWeekday, everyWeek:
+	default:
+		invalid("every", "%q is not one of %s, %s or %s", j.Every, everyDay, everyWeekday, everyWeek)
+	}
+	return problems
+}
+
+// listJobsHandler lists an agent's scheduled jobs, soonest first.
+func listJobsHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, false)
+		if user == nil {
+			return
+		}
+		result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return agentJobs(tr, user.Email)
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading jobs: %v", err), http.StatusInternalServerError)
+			return
+		}
+		jobs := result.([]ScheduledJob)
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].DueAt.Before(jobs[j].DueAt) })
+		writeJSON(w, jobs)
+	})
+}
+
+// createJobHandler schedules a message for an agent to post.
+func createJobHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, true)
+		if user == nil {
+			return
+		}
+		var body NewJob
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if problems := body.validate(time.Now()); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+			return
+		}
+		job := &ScheduledJob{
+			Agent:     user.Email,
+			Kind:      body.Kind,
+			Channel:   body.Channel,
+			ThreadTS:  body.ThreadTS,
+			Text:      body.Text,
+			DueAt:     body.At.UTC(),
+			Every:     body.Every,
+			CreatedBy: account.actor(),
+		}
+		if err := scheduleJob(db, job); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditJobCreate,
+			Workspace: user.Workspace,
+			Target:    user.Email,
+			Details:   map[string]string{"job": job.ID, "kind": job.Kind, "every": job.Every},
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(job)
+	})
+}
+
+// deleteJobHandler cancels one of an agent's scheduled jobs.
+func deleteJobHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		user := requestAgent(w, r, db, account, true)
+		if user == nil {
+			return
+		}
+		id := r.PathValue("id")
+		result, err := db.Transact(func(tr Tx) (interface{}, error) {
+			job, err := loadJob(tr, id)
+			if err != nil || job == nil || job.Agent != user.Email {
+				return false, err
+			}
+			deleteJob(tr, job)
+			return true, nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting job: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !result.(bool) {
+			http.Error(w, fmt.Sprintf("Job '%s' not found", id), http.StatusNotFound)
+			return
+		}
+		recordAudit(db, AuditEntry{
+			Actor:     account.actor(),
+			Action:    auditJobDelete,
+			Workspace: user.Workspace,
+			Target:    user.Email,
+			Details:   map[string]string{"job": id},
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
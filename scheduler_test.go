@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseReminder(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	// Monday 3 June 2024, 10:15 in Berlin
+	now := time.Date(2024, 6, 3, 10, 15, 0, 0, berlin)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, berlin)
+	}
+
+	tests := []struct {
+		text string
+		due  time.Time
+		what string
+	}{
+		{"remind me tomorrow at 9 to call Bob", at(4, 9, 0), "call Bob"},
+		{"Remind me to water the plants in 2 hours", at(3, 12, 15), "water the plants"},
+		{"remind me in 30 min", at(3, 10, 45), ""},
+		{"remind me at 5:30pm to leave.", at(3, 17, 30), "leave"},
+		{"remind me at 8 about the standup", at(4, 8, 0), "about the standup"},
+		{"remind me tomorrow", at(4, 9, 0), ""},
+		{"remind me to pay rent at 9am tomorrow", at(4, 9, 0), "pay rent"},
+		{"remind me in 3 days to renew the cert", at(6, 10, 15), "renew the cert"},
+	}
+	for _, test := range tests {
+		due, what, err := parseReminder(test.text, now, berlin)
+		if err != nil || !due.Equal(test.due) || what != test.what {
+			t.Errorf("parseReminder(%q) = %s, %q, %v, want %s, %q", test.text, due, what, err, test.due, test.what)
+		}
+	}
+
+	for _, text := range []string{"what time is it?", "can you remind me what we discussed?", "remind me"} {
+		if _, _, err := parseReminder(text, now, berlin); !errors.Is(err, errNotReminder) {
+			t.Errorf("parseReminder(%q) = %v, want errNotReminder", text, err)
+		}
+	}
+	for _, text := range []string{"remind me today at 8 to eat", "remind me at 25:00", "remind me at 13pm"} {
+		if _, _, err := parseReminder(text, now, berlin); err == nil || errors.Is(err, errNotReminder) {
+			t.Errorf("parseReminder(%q) = %v, want an explanation", text, err)
+		}
+	}
+}
+
+func TestHandleReminder(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	user := &UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", Timezone: "Asia/Tokyo"}
+	session := newSlackSession("cats")
+
+	if handleReminder(context.Background(), db, session, user, "U07PRIMARY", "D0000CATS", "", "what's up?") {
+		t.Errorf("handleReminder took an ordinary message")
+	}
+	if !handleReminder(context.Background(), db, session, user, "U07PRIMARY", "D0000CATS", "", "remind me in 2 hours to stretch") {
+		t.Fatalf("handleReminder ignored a reminder")
+	}
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return agentJobs(tr, user.Email)
+	})
+	jobs := result.([]ScheduledJob)
+	if len(jobs) != 1 || jobs[0].Kind != jobReminder || jobs[0].Text != "stretch" || jobs[0].Channel != "D0000CATS" || jobs[0].CreatedBy != "U07PRIMARY" {
+		t.Errorf("scheduled %+v", jobs)
+	}
+	if posted := fake.postedMessages(); len(posted) != 1 || !strings.HasPrefix(posted[0].Get("text"), "OK, I'll remind you") || !strings.HasSuffix(posted[0].Get("text"), "(Asia/Tokyo).") {
+		t.Errorf("confirmation = %v", posted)
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	// Friday 22 March 2024, before the switch to summer time on Sunday
+	due := time.Date(2024, 3, 22, 9, 0, 0, 0, berlin)
+	tests := []struct {
+		every string
+		want  time.Time
+	}{
+		{everyDay, time.Date(2024, 3, 23, 9, 0, 0, 0, berlin)},
+		{everyWeekday, time.Date(2024, 3, 25, 9, 0, 0, 0, berlin)},
+		{everyWeek, time.Date(2024, 3, 29, 9, 0, 0, 0, berlin)},
+	}
+	for _, test := range tests {
+		if got := nextOccurrence(due, test.every, berlin, due); !got.Equal(test.want) {
+			t.Errorf("next %s after %s = %s, want %s", test.every, due, got, test.want)
+		}
+	}
+	// Missed occurrences are skipped rather than caught up on
+	if got := nextOccurrence(due, everyDay, berlin, due.AddDate(0, 0, 3).Add(time.Hour)); !got.Equal(time.Date(2024, 3, 26, 9, 0, 0, 0, berlin)) {
+		t.Errorf("next after a missed week = %s", got)
+	}
+}
+
+func TestClaimDueJobsOnce(t *testing.T) {
+	db := newTestStore(t)
+	now := time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		if err := scheduleJob(db, &ScheduledJob{Agent: "marvin@example.com", Kind: jobCheckIn, Channel: "C0000CATS", Text: "Hi", DueAt: now}); err != nil {
+			t.Fatalf("scheduleJob: %v", err)
+		}
+	}
+	scheduleJob(db, &ScheduledJob{Agent: "marvin@example.com", Kind: jobCheckIn, Channel: "C0000CATS", Text: "Later", DueAt: now.Add(time.Hour)})
+
+	var mu sync.Mutex
+	claims := map[string]int{}
+	var wg sync.WaitGroup
+	for _, replica := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				jobs, err := claimDueJobs(db, replica, now, 3)
+				if err != nil {
+					t.Errorf("claimDueJobs: %v", err)
+					return
+				}
+				mu.Lock()
+				for _, job := range jobs {
+					claims[job.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(claims) != 10 {
+		t.Errorf("claimed %d jobs, want the 10 due ones", len(claims))
+	}
+	for id, n := range claims {
+		if n != 1 {
+			t.Errorf("job %s claimed %d times", id, n)
+		}
+	}
+
+	// A replica that dies mid-run leaves its jobs to others once the lease ends
+	jobs, _ := claimDueJobs(db, "d", now.Add(cfg.JobLease), 20)
+	if len(jobs) != 10 {
+		t.Errorf("claimed %d jobs after their leases ended, want 10", len(jobs))
+	}
+}
+
+func TestRunDueJobs(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", Name: "Marvin", Timezone: "Europe/Berlin"}, "T07Q4VBFFHP")
+
+	now := time.Date(2024, 6, 3, 7, 0, 0, 0, time.UTC)
+	reminder := &ScheduledJob{Agent: "marvin@example.com", Kind: jobReminder, Channel: "D0000CATS", Text: "call Bob", DueAt: now}
+	checkIn := &ScheduledJob{Agent: "marvin@example.com", Kind: jobCheckIn, Channel: "C0000CATS", Text: "How is everyone?", DueAt: now, Every: everyWeekday}
+	digest := &ScheduledJob{Agent: "marvin@example.com", Kind: jobDigest, Channel: "C0000CATS", Text: "Summarize the week", DueAt: now.Add(time.Hour)}
+	orphan := &ScheduledJob{Agent: "gone@example.com", Kind: jobCheckIn, Channel: "C0000CATS", Text: "Anyone?", DueAt: now}
+	for _, job := range []*ScheduledJob{reminder, checkIn, digest, orphan} {
+		scheduleJob(db, job)
+	}
+
+	if n, err := runDueJobs(context.Background(), db, "a", now); n != 2 || err != nil {
+		t.Fatalf("runDueJobs = %d, %v, want 2", n, err)
+	}
+	posted := fake.postedMessages()
+	if len(posted) != 2 || (posted[0].Get("text") != "Reminder: call Bob" && posted[1].Get("text") != "Reminder: call Bob") {
+		t.Errorf("posted %v, want the reminder and the check-in", posted)
+	}
+	if n, _ := runDueJobs(context.Background(), db, "b", now.Add(time.Minute)); n != 0 {
+		t.Errorf("ran %d jobs twice", n)
+	}
+
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return agentJobs(tr, "marvin@example.com")
+	})
+	jobs := result.([]ScheduledJob)
+	if len(jobs) != 2 {
+		t.Fatalf("jobs left = %+v, want the check-in and the digest", jobs)
+	}
+	for _, job := range jobs {
+		// Monday 09:00 in Berlin comes back on Tuesday
+		if job.ID == checkIn.ID && (!job.DueAt.Equal(now.AddDate(0, 0, 1)) || job.ClaimedBy != "") {
+			t.Errorf("check-in rescheduled as %+v", job)
+		}
+	}
+
+	// The digest is answered by the LLM, retried while posting fails
+	fake.tokens = map[string]string{}
+	if n, _ := runDueJobs(context.Background(), db, "a", now.Add(time.Hour)); n != 0 {
+		t.Errorf("ran %d jobs with a revoked token", n)
+	}
+	fake.tokens["xoxp-U0001"] = "U0001"
+	// The retry is due a minute after the failed run ended
+	if n, err := runDueJobs(context.Background(), db, "a", now.Add(time.Hour+2*time.Minute)); n != 1 || err != nil {
+		t.Errorf("retrying the digest = %d, %v", n, err)
+	}
+	if posted := fake.postedMessages(); posted[len(posted)-1].Get("text") != "Don't panic." {
+		t.Errorf("digest posted %q, want the LLM's answer", posted[len(posted)-1].Get("text"))
+	}
+}
+
+func TestRunDueJobsRetryKeepsTime(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", Name: "Marvin", Timezone: "Europe/Berlin"}, "T07Q4VBFFHP")
+
+	// 09:00 in Berlin, failing once before it goes through
+	now := time.Date(2024, 6, 3, 7, 0, 0, 0, time.UTC)
+	checkIn := &ScheduledJob{Agent: "marvin@example.com", Kind: jobCheckIn, Channel: "C0000CATS", Text: "Morning!", DueAt: now, Every: everyDay}
+	scheduleJob(db, checkIn)
+	if n, _ := runDueJobs(context.Background(), db, "a", now); n != 0 {
+		t.Fatalf("ran %d jobs with a revoked token", n)
+	}
+	fake.tokens["xoxp-U0001"] = "U0001"
+	if n, err := runDueJobs(context.Background(), db, "a", now.Add(2*time.Minute)); n != 1 || err != nil {
+		t.Fatalf("retrying the check-in = %d, %v", n, err)
+	}
+
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadJob(tr, checkIn.ID)
+	})
+	job := result.(*ScheduledJob)
+	if !job.DueAt.Equal(now.AddDate(0, 0, 1)) || job.RetryAt != nil || job.Attempts != 0 {
+		t.Errorf("check-in after a retry = %+v, want it due at 09:00 tomorrow", job)
+	}
+}
+
+func TestRunDueJobsSkipsStartedRun(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", Name: "Marvin"}, "T07Q4VBFFHP")
+
+	now := time.Date(2024, 6, 3, 7, 0, 0, 0, time.UTC)
+	scheduleJob(db, &ScheduledJob{Agent: "marvin@example.com", Kind: jobReminder, Channel: "D0000CATS", Text: "call Bob", DueAt: now})
+
+	// Replica a dies after marking the run started, maybe having posted it
+	jobs, err := claimDueJobs(db, "a", now, 1)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("claimDueJobs = %+v, %v", jobs, err)
+	}
+	if started, err := startJob(db, jobs[0]); !started || err != nil {
+		t.Fatalf("startJob = %v, %v", started, err)
+	}
+
+	if n, err := runDueJobs(context.Background(), db, "b", now.Add(cfg.JobLease+time.Second)); n != 0 || err != nil {
+		t.Errorf("runDueJobs after a lost lease = %d, %v, want the run skipped", n, err)
+	}
+	if posted := fake.postedMessages(); len(posted) != 0 {
+		t.Errorf("posted %v, want nothing a second time", posted)
+	}
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return agentJobs(tr, "marvin@example.com")
+	})
+	if jobs := result.([]ScheduledJob); len(jobs) != 0 {
+		t.Errorf("jobs left = %+v, want the reminder done", jobs)
+	}
+}
+
+func TestRunDueJobsLeases(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", Name: "Marvin"}, "T07Q4VBFFHP")
+
+	// Each digest takes longer than a lease, so a lease taken for both at
+	// the start would have run out before the second one starts
+	cfg.JobLease = 200 * time.Millisecond
+	fake.llmDelay = 300 * time.Millisecond
+	now := time.Now()
+	for _, text := range []string{"Summarize Monday", "Summarize Tuesday"} {
+		scheduleJob(db, &ScheduledJob{Agent: "marvin@example.com", Kind: jobDigest, Channel: "C0000CATS", Text: text, DueAt: now})
+	}
+
+	done := make(chan int)
+	go func() {
+		n, err := runDueJobs(context.Background(), db, "a", now)
+		if err != nil {
+			t.Errorf("runDueJobs: %v", err)
+		}
+		done <- n
+	}()
+	// While a runs the second digest, b finds nothing to take over
+	time.Sleep(400 * time.Millisecond)
+	if n, err := runDueJobs(context.Background(), db, "b", now.Add(400*time.Millisecond)); n != 0 || err != nil {
+		t.Errorf("other replica ran %d jobs, %v, want none while a holds their lease", n, err)
+	}
+	if n := <-done; n != 2 {
+		t.Errorf("runDueJobs ran %d digests, want 2", n)
+	}
+	if got := len(fake.llmRequests()); got != 2 {
+		t.Errorf("LLM asked %d times, want once per digest", got)
+	}
+}
+
+func TestJobsAPI(t *testing.T) {
+	db := newTestStore(t)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	viewer := newTestAccount(t, db, "vera", roleViewer, "cats")
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", Workspace: "cats", Name: "Marvin"}, "T07Q4VBFFHP")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents/{email}/jobs", listJobsHandler(db))
+	mux.HandleFunc("POST /agents/{email}/jobs", createJobHandler(db))
+	mux.HandleFunc("DELETE /agents/{email}/jobs/{id}", deleteJobHandler(db))
+	do := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	rec := do(owner, http.MethodPost, "/agents/marvin@example.com/jobs", `{"kind": "checkin", "channel": "C0000CATS", "text": "Standup!", "at": "`+at+`", "every": "weekdays"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST job = %d %s", rec.Code, rec.Body)
+	}
+	rec = do(viewer, http.MethodGet, "/agents/marvin@example.com/jobs", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"text":"Standup!"`) || !strings.Contains(rec.Body.String(), `"created_by":"account:olive"`) {
+		t.Errorf("GET jobs = %d %s", rec.Code, rec.Body)
+	}
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return agentJobs(tr, "marvin@example.com")
+	})
+	id := result.([]ScheduledJob)[0].ID
+
+	rec = do(owner, http.MethodPost, "/agents/marvin@example.com/jobs", `{"kind": "nag", "channel": "general", "text": "", "at": "2001-01-01T00:00:00Z", "every": "hourly"}`)
+	if rec.Code != http.StatusBadRequest || strings.Count(rec.Body.String(), "Invalid") != 5 {
+		t.Errorf("POST invalid job = %d %q, want every problem", rec.Code, rec.Body)
+	}
+	if rec := do(viewer, http.MethodDelete, "/agents/marvin@example.com/jobs/"+id, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer DELETE job = %d, want 403", rec.Code)
+	}
+	if rec := do(owner, http.MethodDelete, "/agents/marvin@example.com/jobs/"+id, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE job = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(owner, http.MethodDelete, "/agents/marvin@example.com/jobs/"+id, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE deleted job = %d, want 404", rec.Code)
+	}
+	if jobs, _ := claimDueJobs(db, "a", time.Now().Add(24*time.Hour), 10); len(jobs) != 0 {
+		t.Errorf("deleted job still due: %+v", jobs)
+	}
+}
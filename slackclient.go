@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slack publishes its Web API limits as tiers, expressed in calls per minute
+// per method per workspace. chat.postMessage is special-cased at roughly one
+// message per second per channel, and the methods in slackTokenMethods are
+// limited per token.
+const (
+	tier1 = 1
+	tier2 = 20
+	tier3 = 50
+	tier4 = 100
+
+	postMessagePerMinute = 60
+
+	// limiterIdle is how long a limiter goes unused before it is dropped; it
+	// has long refilled by then, so a new one behaves the same.
+	limiterIdle = 10 * time.Minute
+)
+
+var slackMethodTiers = map[string]int{
+	"rtm.connect":           tier1,
+	"auth.test":             tier4,
+	"signup.checkEmail":     tier2,
+	"signup.confirmEmail":   tier2,
+	"signup.createUser":     tier2,
+	"signin.confirmCode":    tier2,
+	"users.setPhoto":        tier2,
+	"users.info":            tier4,
+	"conversations.history": tier3,
+	"conversations.replies": tier3,
+}
+
+// slackTokenMethods are limited for each token on its own, so every agent of
+// a workspace can connect without waiting for the others.
+var slackTokenMethods = map[string]bool{
+	"rtm.connect": true,
+}
+
+// Counters exposed on /debug/vars whenever Slack throttles us.
+var (
+	slackThrottledCalls = expvar.NewMap("slack_throttled_calls")
+	slackRetriedCalls   = expvar.NewMap("slack_retried_calls")
+	slackThrottledWait  = expvar.NewMap("slack_throttled_wait_seconds")
+)
+
+// slackClient is shared by every call to the Slack Web API. It paces calls per
+// workspace and per method according to the method's tier, and retries calls
+// that Slack rejected as rate limited once the requested delay has passed.
+type slackClient struct {
+	maxRetries int
+
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+	swept    time.Time
+}
+
+var defaultSlackClient = newSlackClient()
+
+// defaultHTTPClient is used for requests outside a Slack session, such as the LLM
+// and image downloads.
+var defaultHTTPClient = &http.Client{Timeout: cfg.RequestTimeout}
+
+func newSlackClient() *slackClient {
+	return &slackClient{
+		maxRetries: 3,
+		limiters:   make(map[string]*rateLimiter),
+	}
+}
+
+// do sends req with httpClient after waiting for its rate limit slot. The
+// workspace and method select the limiter; token is only used for
+// slackTokenMethods and channel for chat.postMessage, which Slack limits per
+// channel. A request with a body must be replayable through GetBody, which
+// http.NewRequest sets up for the usual in-memory readers.
+func (c *slackClient) do(httpClient *http.Client, workspace, method, token, channel string, req *http.Request) (*http.Response, error) {
+	limiter := c.limiter(workspace, method, token, channel)
+
+	for attempt := 0; ; attempt++ {
+		if err := limiter.wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		attemptReq := req
+		if attempt > 0 {
+			attemptReq = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				attemptReq.Body = body
+			}
+		}
+
+		resp, err := httpClient.Do(attemptReq)
+		if err != nil {
+			return nil, err
+		}
+
+		retryAfter, limited := rateLimited(resp)
+		if !limited {
+			return resp, nil
+		}
+
+		slackThrottledCalls.Add(method, 1)
+		slackThrottledWait.AddFloat(method, retryAfter.Seconds())
+		limiter.pause(retryAfter)
+
+		if attempt >= c.maxRetries || (req.Body != nil && req.GetBody == nil) {
+			log.Printf("\033[1;31mSlack rate limited %s for %s, giving up after %d attempts\033[0m", method, workspace, attempt+1)
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		log.Printf("\033[1;33mSlack rate limited %s for %s, retrying in %s\033[0m", method, workspace, retryAfter)
+		slackRetriedCalls.Add(method, 1)
+	}
+}
+
+func (c *slackClient) limiter(workspace, method, token, channel string) *rateLimiter {
+	key := workspace + "/" + method
+	perMinute, ok := slackMethodTiers[method]
+	if !ok {
+		perMinute = tier3
+	}
+	if slackTokenMethods[method] {
+		key += "/" + token
+	}
+	if method == "chat.postMessage" {
+		key += "/" + channel
+		perMinute = postMessagePerMinute
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Channels and tokens come and go, their limiters with them
+	if now := time.Now(); now.Sub(c.swept) >= limiterIdle {
+		for k, l := range c.limiters {
+			if l.idle(now) {
+				delete(c.limiters, k)
+			}
+		}
+		c.swept = now
+	}
+	limiter, ok := c.limiters[key]
+	if !ok {
+		limiter = newRateLimiter(perMinute)
+		c.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// rateLimited reports whether Slack refused resp because of rate limiting,
+// either with a 429 status or with an ok=false "ratelimited" error, and how
+// long it asked us to wait. The body is left readable for the caller.
+func rateLimited(resp *http.Response) (time.Duration, bool) {
+	retryAfter := time.Second
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return retryAfter, true
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return 0, false
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0, false
+	}
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &result) == nil && !result.OK && result.Error == "ratelimited" {
+		return retryAfter, true
+	}
+	return 0, false
+}
+
+// slackSession is the HTTP state for talking to one workspace: a client with
+// its own cookie jar, so the cookies handed out during signup follow the
+// account through the rest of the flow, and the workspace's API base URL.
+type slackSession struct {
+	workspace  string
+	apiURL     string
+	httpClient *http.Client
+}
+
+func newSlackSession(workspace string) *slackSession {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		// cookiejar.New only fails on a bad public suffix list.
+		panic(err)
+	}
+	return &slackSession{
+		workspace:  workspace,
+		apiURL:     cfg.workspaceAPIURL(workspace),
+		httpClient: &http.Client{Jar: jar, Timeout: cfg.RequestTimeout},
+	}
+}
+
+// post calls a Web API method on the workspace host with form encoded data.
+func (s *slackSession) post(ctx context.Context, method string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiURL+"/"+method, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.do(method, data.Get("token"), data.Get("channel"), req)
+}
+
+// do sends a prepared request for method, made with token, through the shared
+// rate limiter.
+func (s *slackSession) do(method, token, channel string, req *http.Request) (*http.Response, error) {
+	return defaultSlackClient.do(s.httpClient, s.workspace, method, token, channel, req)
+}
+
+// rateLimiter is a token bucket refilled at a fixed rate per minute, allowing a
+// burst of up to one minute's worth of calls.
+type rateLimiter struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	interval time.Duration
+	last     time.Time
+	paused   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		tokens:   float64(perMinute),
+		capacity: float64(perMinute),
+		interval: time.Minute / time.Duration(perMinute),
+		last:     time.Now(),
+	}
+}
+
+// wait blocks until a call is allowed and consumes its token, or until ctx is
+// done. A ctx that is already done takes no token.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+	l.last = now
+	l.tokens--
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens * float64(l.interval))
+	}
+	if pause := l.paused.Sub(now); pause > delay {
+		delay = pause
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// idle reports whether the limiter has been unused for limiterIdle and is
+// not paused.
+func (l *rateLimiter) idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return now.Sub(l.last) >= limiterIdle && now.After(l.paused)
+}
+
+// pause holds back every call on this limiter for at least d, which is how a
+// Retry-After from Slack is shared with concurrent callers.
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.paused) {
+		l.paused = until
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 600 a minute is a burst of 600, then one every 100ms
+	limiter := newRateLimiter(600)
+	start := time.Now()
+	for i := 0; i < 600; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("burst took %s, want no waiting", elapsed)
+	}
+	start = time.Now()
+	limiter.wait(context.Background())
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("call after the burst waited %s, want about 100ms", elapsed)
+	}
+
+	// A pause holds back calls even with tokens left, until ctx gives up
+	limiter = newRateLimiter(600)
+	limiter.pause(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wait while paused = %v, want the context's error", err)
+	}
+
+	// A cancelled call takes no token
+	limiter = newRateLimiter(1)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.wait(cancelled); err != context.Canceled {
+		t.Errorf("wait with a cancelled context = %v", err)
+	}
+	start = time.Now()
+	limiter.wait(context.Background())
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("call after a cancelled one waited %s, want its token left", elapsed)
+	}
+}
+
+func TestSlackClientLimiters(t *testing.T) {
+	c := newSlackClient()
+	if c.limiter("cats", "rtm.connect", "xoxp-1", "") == c.limiter("cats", "rtm.connect", "xoxp-2", "") {
+		t.Errorf("rtm.connect shares a limiter between tokens")
+	}
+	if c.limiter("cats", "rtm.connect", "xoxp-1", "") != c.limiter("cats", "rtm.connect", "xoxp-1", "") {
+		t.Errorf("rtm.connect does not reuse the token's limiter")
+	}
+	if c.limiter("cats", "users.info", "xoxp-1", "") != c.limiter("cats", "users.info", "xoxp-2", "") {
+		t.Errorf("users.info is limited per token, want per workspace")
+	}
+	if c.limiter("cats", "chat.postMessage", "xoxp-1", "C1") == c.limiter("cats", "chat.postMessage", "xoxp-1", "C2") {
+		t.Errorf("chat.postMessage shares a limiter between channels")
+	}
+
+	// Limiters unused for a while are dropped, busy and paused ones kept
+	idle := c.limiter("cats", "chat.postMessage", "xoxp-1", "C1")
+	idle.last = time.Now().Add(-limiterIdle)
+	paused := c.limiter("cats", "chat.postMessage", "xoxp-1", "C2")
+	paused.last = time.Now().Add(-limiterIdle)
+	paused.pause(time.Minute)
+	c.swept = time.Time{}
+	c.limiter("cats", "users.info", "xoxp-1", "")
+	if c.limiter("cats", "chat.postMessage", "xoxp-1", "C1") == idle || c.limiter("cats", "chat.postMessage", "xoxp-1", "C2") != paused {
+		t.Errorf("limiters after a sweep = %v, want only the idle one dropped", c.limiters)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	tests := []struct {
+		status      int
+		contentType string
+		retryAfter  string
+		body        string
+		want        time.Duration
+		limited     bool
+	}{
+		{http.StatusTooManyRequests, "text/plain", "7", "", 7 * time.Second, true},
+		{http.StatusTooManyRequests, "text/plain", "", "", time.Second, true},
+		{http.StatusOK, "application/json; charset=utf-8", "3", `{"ok": false, "error": "ratelimited"}`, 3 * time.Second, true},
+		{http.StatusOK, "application/json", "", `{"ok": false, "error": "invalid_auth"}`, 0, false},
+		{http.StatusOK, "text/html", "", `{"ok": false, "error": "ratelimited"}`, 0, false},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", test.contentType)
+		if test.retryAfter != "" {
+			rec.Header().Set("Retry-After", test.retryAfter)
+		}
+		rec.WriteHeader(test.status)
+		rec.WriteString(test.body)
+		resp := rec.Result()
+		got, limited := rateLimited(resp)
+		if got != test.want || limited != test.limited {
+			t.Errorf("rateLimited(%d %s %q) = %s, %v, want %s, %v", test.status, test.retryAfter, test.body, got, limited, test.want, test.limited)
+		}
+		// The caller still gets the whole body
+		if body := new(strings.Builder); test.body != "" {
+			resp.Write(body)
+			if !strings.Contains(body.String(), test.body) {
+				t.Errorf("rateLimited consumed the body %q", test.body)
+			}
+		}
+	}
+}
+
+func TestSlackClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true, "text": "` + r.PostForm.Get("text") + `"}`))
+	}))
+	defer server.Close()
+
+	c := newSlackClient()
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("text=hello"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	start := time.Now()
+	resp, err := c.do(server.Client(), "cats", "users.info", "xoxp-1", "", req)
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	defer resp.Body.Close()
+	body := new(strings.Builder)
+	resp.Write(body)
+	if calls.Load() != 2 || !strings.Contains(body.String(), `"text": "hello"`) {
+		t.Errorf("after %d calls got %q, want the body replayed on the retry", calls.Load(), body)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the Retry-After of 1s", elapsed)
+	}
+
+	// Without retries left, the rate limited response is returned
+	calls.Store(0)
+	c = newSlackClient()
+	c.maxRetries = 0
+	req, _ = http.NewRequest(http.MethodPost, server.URL, strings.NewReader("text=hello"))
+	resp, err = c.do(server.Client(), "cats", "users.info", "xoxp-1", "", req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || calls.Load() != 1 {
+		t.Errorf("do without retries = %v, %v after %d calls, want the 429", resp, err, calls.Load())
+	}
+}
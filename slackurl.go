@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Kinds of Slack IDs, told apart by their first letter.
+const (
+	slackIDTeam    = "team"
+	slackIDUser    = "user"
+	slackIDChannel = "channel"
+	slackIDDM      = "DM channel"
+)
+
+var (
+	teamIDPattern    = regexp.MustCompile(`^T[A-Z0-9]{8,}$`)
+	userIDPattern    = regexp.MustCompile(`^[UW][A-Z0-9]{8,}$`)
+	channelIDPattern = regexp.MustCompile(`^[CG][A-Z0-9]{8,}$`)
+	dmIDPattern      = regexp.MustCompile(`^D[A-Z0-9]{8,}$`)
+
+	// Workspace names are the subdomain of <name>.slack.com
+	workspaceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+	inviteCodePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_~-]*$`)
+)
+
+// slackIDKind returns which kind of ID id is, or "" if it is none.
+func slackIDKind(id string) string {
+	switch {
+	case teamIDPattern.MatchString(id):
+		return slackIDTeam
+	case userIDPattern.MatchString(id):
+		return slackIDUser
+	case channelIDPattern.MatchString(id):
+		return slackIDChannel
+	case dmIDPattern.MatchString(id):
+		return slackIDDM
+	}
+	return ""
+}
+
+// expectSlackID checks that id is of kind want, saying what it is instead
+// when it is not.
+func expectSlackID(id, want string) error {
+	switch kind := slackIDKind(id); kind {
+	case want:
+		return nil
+	case "":
+		return fmt.Errorf("%q is not a Slack %s ID", id, want)
+	default:
+		return fmt.Errorf("%q is a %s ID, not a %s ID", id, kind, want)
+	}
+}
+
+// parseSlackURL parses a link copied from the browser, which may lack its
+// scheme, and returns its lower-cased host and path segments.
+func parseSlackURL(raw string) (string, []string, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("not a URL: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", nil, fmt.Errorf("expected an https:// link, got %s://", u.Scheme)
+	}
+	return strings.ToLower(u.Hostname()), strings.Split(strings.Trim(u.Path, "/"), "/"), nil
+}
+
+// parseInviteURL returns the workspace and code of a shared invite link,
+// https://join.slack.com/t/<workspace>/shared_invite/<code> or
+// https://<workspace>.slack.com/join/shared_invite/<code>.
+func parseInviteURL(raw string) (workspace, code string, err error) {
+	host, segments, err := parseSlackURL(raw)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case host == "join.slack.com" && len(segments) == 4 && segments[0] == "t" && segments[2] == "shared_invite":
+		workspace, code = segments[1], segments[3]
+	case strings.HasSuffix(host, ".slack.com") && len(segments) == 3 && segments[0] == "join" && segments[1] == "shared_invite":
+		workspace, code = strings.TrimSuffix(host, ".slack.com"), segments[2]
+	default:
+		return "", "", fmt.Errorf("expected a shared invite link such as https://join.slack.com/t/<workspace>/shared_invite/<code>")
+	}
+	if err := validateWorkspaceName(workspace); err != nil {
+		return "", "", err
+	}
+	if err := validateInviteCode(code); err != nil {
+		return "", "", err
+	}
+	return workspace, code, nil
+}
+
+// ClientURL is what a https://app.slack.com/client/<team>/<id> link, as
+// shown in the browser while looking at a conversation, identifies. At most
+// one of User, Channel and DM is set.
+type ClientURL struct {
+	Team    string
+	User    string
+	Channel string
+	DM      string
+}
+
+// parseClientURL parses an app.slack.com client link. The second ID may be
+// a user (when their profile is open), a channel or a DM channel.
+func parseClientURL(raw string) (*ClientURL, error) {
+	host, segments, err := parseSlackURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	if host != "app.slack.com" || len(segments) < 2 || segments[0] != "client" {
+		return nil, fmt.Errorf("expected a link such as https://app.slack.com/client/<team ID>/<conversation ID>")
+	}
+	if err := expectSlackID(segments[1], slackIDTeam); err != nil {
+		return nil, err
+	}
+	client := &ClientURL{Team: segments[1]}
+	if len(segments) < 3 {
+		return client, nil
+	}
+	switch id := segments[2]; slackIDKind(id) {
+	case slackIDUser:
+		client.User = id
+	case slackIDChannel:
+		client.Channel = id
+	case slackIDDM:
+		client.DM = id
+	default:
+		return nil, fmt.Errorf("%q is not a user, channel or DM channel ID", id)
+	}
+	return client, nil
+}
+
+func validateWorkspaceName(name string) error {
+	if !workspaceNamePattern.MatchString(name) {
+		return fmt.Errorf("%q is not a workspace name, expected the lower-case subdomain of <name>.slack.com", name)
+	}
+	return nil
+}
+
+func validateInviteCode(code string) error {
+	if !inviteCodePattern.MatchString(code) {
+		return fmt.Errorf("%q is not a shared invite code", code)
+	}
+	return nil
+}
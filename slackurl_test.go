@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseInviteURL(t *testing.T) {
+	tests := []struct {
+		raw             string
+		workspace, code string
+		wantErr         string
+	}{
+		{"https://join.slack.com/t/cats/shared_invite/zt-2abc3def-XyZ_abc~1", "cats", "zt-2abc3def-XyZ_abc~1", ""},
+		{"  join.slack.com/t/cats/shared_invite/zt-1/ ", "cats", "zt-1", ""},
+		{"https://cats.slack.com/join/shared_invite/zt-1", "cats", "zt-1", ""},
+		{"ftp://join.slack.com/t/cats/shared_invite/zt-1", "", "", "https://"},
+		{"https://join.slack.com/t/cats/zt-1", "", "", "shared invite link"},
+		{"https://join.slack.com/t/Cats!/shared_invite/zt-1", "", "", "not a workspace name"},
+		{"https://join.slack.com/t/cats/shared_invite/zt%3F1", "", "", "not a shared invite code"},
+		{"https://app.slack.com/client/T07Q4VBFFHP/D07PS6JMF8B", "", "", "shared invite link"},
+	}
+	for _, test := range tests {
+		workspace, code, err := parseInviteURL(test.raw)
+		if workspace != test.workspace || code != test.code || !errorContains(err, test.wantErr) {
+			t.Errorf("parseInviteURL(%q) = %q, %q, %v, want %q, %q, error %q", test.raw, workspace, code, err, test.workspace, test.code, test.wantErr)
+		}
+	}
+}
+
+func TestParseClientURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    ClientURL
+		wantErr string
+	}{
+		{"https://app.slack.com/client/T07Q4VBFFHP/D07PS6JMF8B", ClientURL{Team: "T07Q4VBFFHP", DM: "D07PS6JMF8B"}, ""},
+		{"https://app.slack.com/client/T07Q4VBFFHP/U07PRIMARY", ClientURL{Team: "T07Q4VBFFHP", User: "U07PRIMARY"}, ""},
+		{"https://app.slack.com/client/T07Q4VBFFHP/C07GENERAL/thread/C07GENERAL-1700000000.000100", ClientURL{Team: "T07Q4VBFFHP", Channel: "C07GENERAL"}, ""},
+		{"app.slack.com/client/T07Q4VBFFHP", ClientURL{Team: "T07Q4VBFFHP"}, ""},
+		{"https://app.slack.com/client/U07PRIMARY/T07Q4VBFFHP", ClientURL{}, "is a user ID, not a team ID"},
+		{"https://app.slack.com/client/T07Q4VBFFHP/unreads", ClientURL{}, "not a user, channel or DM channel ID"},
+		{"https://cats.slack.com/archives/C07GENERAL", ClientURL{}, "app.slack.com/client"},
+	}
+	for _, test := range tests {
+		client, err := parseClientURL(test.raw)
+		var got ClientURL
+		if client != nil {
+			got = *client
+		}
+		if got != test.want || !errorContains(err, test.wantErr) {
+			t.Errorf("parseClientURL(%q) = %+v, %v, want %+v, error %q", test.raw, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestCheckInvite(t *testing.T) {
+	owner := &Account{Name: "olive", Role: roleOwner, Workspaces: []string{"cats"}}
+	valid := func() SlackInvite {
+		return SlackInvite{
+			InviteURL:  "https://join.slack.com/t/cats/shared_invite/zt-1",
+			ClientURL:  "https://app.slack.com/client/T07Q4VBFFHP/U07PRIMARY",
+			Appearance: "a cat",
+			System:     "Purr.",
+		}
+	}
+
+	invite := valid()
+	if problems := checkInvite(&invite, owner); len(problems) != 0 {
+		t.Fatalf("checkInvite(valid) = %q", problems)
+	}
+	if invite.Workspace != "cats" || invite.InviteCode != "zt-1" || invite.Team != "T07Q4VBFFHP" || invite.PrimaryUser != "U07PRIMARY" {
+		t.Errorf("fields not filled from the URLs: %+v", invite)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*SlackInvite)
+		want   []string
+	}{
+		{"DM instead of user", func(i *SlackInvite) { i.ClientURL = "https://app.slack.com/client/T07Q4VBFFHP/D07PS6JMF8B" },
+			[]string{"Mandatory field 'PrimaryUser' is missing", "points at the DM channel D07PS6JMF8B"}},
+		{"DM with user given", func(i *SlackInvite) {
+			i.ClientURL = "https://app.slack.com/client/T07Q4VBFFHP/D07PS6JMF8B"
+			i.PrimaryUser = "U07PRIMARY"
+		}, nil},
+		{"conflicting workspace", func(i *SlackInvite) { i.Workspace = "dogs" },
+			[]string{`Invalid 'Workspace': "dogs" does not match "cats" from InviteURL`}},
+		{"channel as user", func(i *SlackInvite) {
+			i.ClientURL = ""
+			i.Team = "T07Q4VBFFHP"
+			i.PrimaryUser = "C07GENERAL"
+		}, []string{`Invalid 'PrimaryUser': "C07GENERAL" is a channel ID, not a user ID`}},
+		{"every bad field", func(i *SlackInvite) {
+			i.InviteURL = ""
+			i.ClientURL = ""
+			i.Workspace, i.InviteCode, i.Team, i.PrimaryUser = "Cats", "zt 1", "T1", "U07PRIMARY"
+			i.Name = "@here"
+		}, []string{"Invalid 'Workspace'", "Invalid 'InviteCode'", "Invalid 'Team'", "Invalid 'Name'"}},
+		{"both URLs broken", func(i *SlackInvite) {
+			i.InviteURL = "https://join.slack.com/cats"
+			i.ClientURL = "https://app.slack.com/client/cats"
+		}, []string{"Invalid 'InviteURL'", "Invalid 'ClientURL'"}},
+	}
+	for _, test := range tests {
+		invite := valid()
+		test.modify(&invite)
+		problems := checkInvite(&invite, owner)
+		if len(problems) != len(test.want) {
+			t.Errorf("%s: checkInvite = %q, want %d problems", test.name, problems, len(test.want))
+			continue
+		}
+		for i, want := range test.want {
+			if !strings.Contains(problems[i], want) {
+				t.Errorf("%s: problem %d = %q, want it to contain %q", test.name, i, problems[i], want)
+			}
+		}
+	}
+}
+
+// errorContains reports whether err mentions want, or is nil if want is empty.
+func errorContains(err error, want string) bool {
+	if want == "" {
+		return err == nil
+	}
+	return err != nil && strings.Contains(err.Error(), want)
+}
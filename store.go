@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Store is the persistence layer. It exposes the transactional, ordered
+// key-value model of FoundationDB so the same code runs against a real cluster
+// or, for tests and development, entirely in memory.
+type Store interface {
+	// Transact runs f in a read-write transaction. Nothing f wrote is kept if
+	// it returns an error.
+	Transact(f func(Tx) (interface{}, error)) (interface{}, error)
+	// ReadTransact runs f in a read-only transaction.
+	ReadTransact(f func(ReadTx) (interface{}, error)) (interface{}, error)
+	// Directory creates or opens the directory at path and returns the
+	// subspace its keys live in.
+	Directory(path []string) (subspace.Subspace, error)
+}
+
+// ReadTx is the read side of a Store transaction.
+type ReadTx interface {
+	// Get returns the value of key, or nil if it is not set.
+	Get(key fdb.KeyConvertible) ([]byte, error)
+	// GetRange returns the pairs in r in key order, honouring the limit and
+	// direction in options.
+	GetRange(r fdb.ExactRange, options fdb.RangeOptions) ([]fdb.KeyValue, error)
+}
+
+// Tx is a read-write Store transaction. Writes are visible to later reads in
+// the same transaction.
+type Tx interface {
+	ReadTx
+	Set(key fdb.KeyConvertible, value []byte)
+	Clear(key fdb.KeyConvertible)
+	ClearRange(r fdb.ExactRange)
+	// SetVersionstampedKey sets a key built with versionstampedKey, its
+	// placeholder versionstamp replaced by one that orders it after every key
+	// set by earlier transactions. Such keys cannot be read back in the same
+	// transaction.
+	SetVersionstampedKey(key fdb.KeyConvertible, value []byte)
+}
+
+// openStore opens the store selected by the STORE environment variable:
+// "memory" for a throwaway in-process store, otherwise the default
+// FoundationDB cluster.
+func openStore() Store {
+	if os.Getenv("STORE") == "memory" {
+		return newMemoryStore()
+	}
+	fdb.MustAPIVersion(730)
+	return fdbStore{db: fdb.MustOpenDefault()}
+}
+
+// fdbStore is the Store backed by a FoundationDB cluster.
+type fdbStore struct {
+	db fdb.Database
+}
+
+func (s fdbStore) Transact(f func(Tx) (interface{}, error)) (interface{}, error) {
+	return s.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		return f(fdbTx{tr})
+	})
+}
+
+func (s fdbStore) ReadTransact(f func(ReadTx) (interface{}, error)) (interface{}, error) {
+	return s.db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return f(fdbReadTx{tr})
+	})
+}
+
+// Directory uses the FoundationDB directory layer, which maps path to a short
+// allocated prefix.
+func (s fdbStore) Directory(path []string) (subspace.Subspace, error) {
+	return directory.CreateOrOpen(s.db, path, nil)
+}
+
+type fdbReadTx struct {
+	tr fdb.ReadTransaction
+}
+
+func (t fdbReadTx) Get(key fdb.KeyConvertible) ([]byte, error) {
+	return t.tr.Get(key).Get()
+}
+
+func (t fdbReadTx) GetRange(r fdb.ExactRange, options fdb.RangeOptions) ([]fdb.KeyValue, error) {
+	return t.tr.GetRange(r, options).GetSliceWithError()
+}
+
+type fdbTx struct {
+	tr fdb.Transaction
+}
+
+func (t fdbTx) Get(key fdb.KeyConvertible) ([]byte, error) {
+	return t.tr.Get(key).Get()
+}
+
+func (t fdbTx) GetRange(r fdb.ExactRange, options fdb.RangeOptions) ([]fdb.KeyValue, error) {
+	return t.tr.GetRange(r, options).GetSliceWithError()
+}
+
+func (t fdbTx) Set(key fdb.KeyConvertible, value []byte) {
+	t.tr.Set(key, value)
+}
+
+func (t fdbTx) Clear(key fdb.KeyConvertible) {
+	t.tr.Clear(key)
+}
+
+func (t fdbTx) ClearRange(r fdb.ExactRange) {
+	t.tr.ClearRange(r)
+}
+
+func (t fdbTx) SetVersionstampedKey(key fdb.KeyConvertible, value []byte) {
+	t.tr.SetVersionstampedKey(key, value)
+}
+
+// versionstampedKey packs prefix followed by a versionstamp with userVersion
+// into sub, in the form SetVersionstampedKey expects: the ten bytes the
+// commit fills in, then their little-endian offset. Unlike
+// PackWithVersionstamp it works without an FDB API version selected, so the
+// memory store can use it too.
+func versionstampedKey(sub subspace.Subspace, prefix tuple.Tuple, userVersion uint16) fdb.Key {
+	t := append(append(tuple.Tuple{}, prefix...), tuple.Versionstamp{UserVersion: userVersion})
+	key := sub.Pack(t)
+	// Tuples pack by concatenation; skip the versionstamp type code
+	offset := len(sub.Pack(prefix)) + 1
+	return binary.LittleEndian.AppendUint32(key, uint32(offset))
+}
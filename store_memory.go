@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// memoryStore is an in-process Store for tests and development. Transactions
+// are serialized behind a single lock, which gives the same isolation a
+// FoundationDB transaction has without any conflict retries.
+type memoryStore struct {
+	mu      sync.RWMutex
+	keys    []string // sorted
+	data    map[string][]byte
+	version uint64 // last committed version, for versionstamps
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Transact(f func(Tx) (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{s: s, undo: make(map[string][]byte)}
+	result, err := f(tx)
+	if err != nil {
+		tx.rollback()
+		return nil, err
+	}
+	s.version++
+	return result, nil
+}
+
+func (s *memoryStore) ReadTransact(f func(ReadTx) (interface{}, error)) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return f(&memoryTx{s: s})
+}
+
+// Directory has no directory layer to allocate prefixes from, so the path
+// itself, tuple encoded, is used as the prefix.
+func (s *memoryStore) Directory(path []string) (subspace.Subspace, error) {
+	t := tuple.Tuple{"dir"}
+	for _, name := range path {
+		t = append(t, name)
+	}
+	return subspace.Sub(t...), nil
+}
+
+// memoryTx writes straight into the store while it holds the lock, keeping
+// the previous value of every key it touches so an aborted transaction can be
+// undone.
+type memoryTx struct {
+	s    *memoryStore
+	undo map[string][]byte // nil value: key did not exist
+}
+
+func (t *memoryTx) Get(key fdb.KeyConvertible) ([]byte, error) {
+	value, ok := t.s.data[string(key.FDBKey())]
+	if !ok {
+		return nil, nil
+	}
+	return bytes.Clone(value), nil
+}
+
+func (t *memoryTx) GetRange(r fdb.ExactRange, options fdb.RangeOptions) ([]fdb.KeyValue, error) {
+	first, last := t.s.span(r)
+
+	var kvs []fdb.KeyValue
+	for i := first; i < last; i++ {
+		j := i
+		if options.Reverse {
+			j = last - 1 - (i - first)
+		}
+		key := t.s.keys[j]
+		kvs = append(kvs, fdb.KeyValue{Key: fdb.Key(key), Value: bytes.Clone(t.s.data[key])})
+		if options.Limit > 0 && len(kvs) == options.Limit {
+			break
+		}
+	}
+	return kvs, nil
+}
+
+func (t *memoryTx) Set(key fdb.KeyConvertible, value []byte) {
+	k := string(key.FDBKey())
+	t.remember(k)
+	if _, ok := t.s.data[k]; !ok {
+		i := sort.SearchStrings(t.s.keys, k)
+		t.s.keys = append(t.s.keys, "")
+		copy(t.s.keys[i+1:], t.s.keys[i:])
+		t.s.keys[i] = k
+	}
+	t.s.data[k] = bytes.Clone(value)
+}
+
+func (t *memoryTx) Clear(key fdb.KeyConvertible) {
+	t.clear(string(key.FDBKey()))
+}
+
+func (t *memoryTx) ClearRange(r fdb.ExactRange) {
+	first, last := t.s.span(r)
+	for _, key := range append([]string(nil), t.s.keys[first:last]...) {
+		t.clear(key)
+	}
+}
+
+// SetVersionstampedKey stamps the key with the version this transaction
+// commits at. As with FoundationDB, the last four bytes of key are the
+// little-endian offset of the ten bytes to replace.
+func (t *memoryTx) SetVersionstampedKey(key fdb.KeyConvertible, value []byte) {
+	k := bytes.Clone(key.FDBKey())
+	if len(k) < 4 {
+		panic("versionstamped key without an offset")
+	}
+	offset := int(binary.LittleEndian.Uint32(k[len(k)-4:]))
+	k = k[:len(k)-4]
+	if offset+10 > len(k) {
+		panic("versionstamp offset out of range")
+	}
+	binary.BigEndian.PutUint64(k[offset:], t.s.version+1)
+	binary.BigEndian.PutUint16(k[offset+8:], 0)
+	t.Set(fdb.Key(k), value)
+}
+
+func (t *memoryTx) clear(k string) {
+	if _, ok := t.s.data[k]; !ok {
+		return
+	}
+	t.remember(k)
+	delete(t.s.data, k)
+	i := sort.SearchStrings(t.s.keys, k)
+	t.s.keys = append(t.s.keys[:i], t.s.keys[i+1:]...)
+}
+
+func (t *memoryTx) remember(k string) {
+	if _, ok := t.undo[k]; ok {
+		return
+	}
+	value, ok := t.s.data[k]
+	if !ok {
+		value = nil
+	}
+	t.undo[k] = value
+}
+
+func (t *memoryTx) rollback() {
+	for k, value := range t.undo {
+		if value == nil {
+			t.clear(k)
+			continue
+		}
+		t.Set(fdb.Key(k), value)
+	}
+}
+
+// span returns the indexes of the sorted keys that fall inside r.
+func (s *memoryStore) span(r fdb.ExactRange) (int, int) {
+	begin, end := r.FDBRangeKeys()
+	first := sort.SearchStrings(s.keys, string(begin.FDBKey()))
+	last := sort.SearchStrings(s.keys, string(end.FDBKey()))
+	if last < first {
+		last = first
+	}
+	return first, last
+}
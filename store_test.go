@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// openTestFDBStore connects to the default FoundationDB cluster, skipping the
+// test when none is reachable.
+func openTestFDBStore(t *testing.T) Store {
+	t.Helper()
+	if err := fdb.APIVersion(730); err != nil {
+		t.Skipf("FoundationDB client unavailable: %v", err)
+	}
+	db, err := fdb.OpenDefault()
+	if err != nil {
+		t.Skipf("FoundationDB unavailable: %v", err)
+	}
+	if err := db.Options().SetTransactionTimeout(2000); err != nil {
+		t.Skipf("FoundationDB unavailable: %v", err)
+	}
+	if _, err := db.ReadTransact(func(tr fdb.ReadTransaction) (interface{}, error) {
+		return tr.Get(fdb.Key("probe")).Get()
+	}); err != nil {
+		t.Skipf("FoundationDB unavailable: %v", err)
+	}
+	return fdbStore{db: db}
+}
+
+// newTestStore returns an empty in-memory store with the keyspace opened and
+// stamped with the current schema version.
+func newTestStore(t *testing.T) Store {
+	t.Helper()
+	db := newMemoryStore()
+	if err := useKeyspace(db); err != nil {
+		t.Fatalf("opening keyspace: %v", err)
+	}
+	if err := checkSchema(db); err != nil {
+		t.Fatalf("checking schema: %v", err)
+	}
+	return db
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, newMemoryStore())
+}
+
+func TestFDBStore(t *testing.T) {
+	testStore(t, openTestFDBStore(t))
+}
+
+// testStore is the conformance suite every Store implementation must pass.
+// Keys live under a fresh prefix that is cleared afterwards, so it is safe to
+// run against a shared cluster.
+func testStore(t *testing.T, s Store) {
+	prefix := fmt.Sprintf("storetest/%d/", time.Now().UnixNano())
+	key := func(name string) fdb.Key { return fdb.Key(prefix + name) }
+	all := fdb.KeyRange{Begin: key(""), End: key("\xFF")}
+	reset := func(t *testing.T) {
+		t.Helper()
+		if _, err := s.Transact(func(tr Tx) (interface{}, error) {
+			tr.ClearRange(all)
+			return nil, nil
+		}); err != nil {
+			t.Fatalf("clearing test keys: %v", err)
+		}
+	}
+	t.Cleanup(func() { reset(t) })
+
+	set := func(t *testing.T, pairs ...string) {
+		t.Helper()
+		if _, err := s.Transact(func(tr Tx) (interface{}, error) {
+			for i := 0; i < len(pairs); i += 2 {
+				tr.Set(key(pairs[i]), []byte(pairs[i+1]))
+			}
+			return nil, nil
+		}); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	get := func(t *testing.T, name string) []byte {
+		t.Helper()
+		value, err := s.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return tr.Get(key(name))
+		})
+		if err != nil {
+			t.Fatalf("get %s: %v", name, err)
+		}
+		return value.([]byte)
+	}
+	names := func(t *testing.T, options fdb.RangeOptions) string {
+		t.Helper()
+		kvs, err := s.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return tr.GetRange(all, options)
+		})
+		if err != nil {
+			t.Fatalf("range: %v", err)
+		}
+		var got string
+		for _, kv := range kvs.([]fdb.KeyValue) {
+			got += string(kv.Key)[len(prefix):] + "=" + string(kv.Value) + " "
+		}
+		return got
+	}
+
+	t.Run("GetMissing", func(t *testing.T) {
+		reset(t)
+		if value := get(t, "missing"); value != nil {
+			t.Errorf("Get of a missing key = %q, want nil", value)
+		}
+	})
+
+	t.Run("SetGetClear", func(t *testing.T) {
+		reset(t)
+		set(t, "a", "1", "empty", "")
+		if value := get(t, "a"); string(value) != "1" {
+			t.Errorf("Get(a) = %q, want 1", value)
+		}
+		if value := get(t, "empty"); value == nil || len(value) != 0 {
+			t.Errorf("Get(empty) = %#v, want a present empty value", value)
+		}
+		s.Transact(func(tr Tx) (interface{}, error) {
+			tr.Clear(key("a"))
+			return nil, nil
+		})
+		if value := get(t, "a"); value != nil {
+			t.Errorf("Get(a) after Clear = %q, want nil", value)
+		}
+	})
+
+	t.Run("RangeOrderLimitReverse", func(t *testing.T) {
+		reset(t)
+		set(t, "c", "3", "a", "1", "b", "2", "b\x00", "2b")
+		if got := names(t, fdb.RangeOptions{}); got != "a=1 b=2 b\x00=2b c=3 " {
+			t.Errorf("range = %q", got)
+		}
+		if got := names(t, fdb.RangeOptions{Limit: 2}); got != "a=1 b=2 " {
+			t.Errorf("limited range = %q", got)
+		}
+		if got := names(t, fdb.RangeOptions{Limit: 2, Reverse: true}); got != "c=3 b\x00=2b " {
+			t.Errorf("reverse limited range = %q", got)
+		}
+	})
+
+	t.Run("ClearRange", func(t *testing.T) {
+		reset(t)
+		set(t, "a", "1", "b", "2", "c", "3")
+		s.Transact(func(tr Tx) (interface{}, error) {
+			tr.ClearRange(fdb.KeyRange{Begin: key("b"), End: key("c")})
+			return nil, nil
+		})
+		if got := names(t, fdb.RangeOptions{}); got != "a=1 c=3 " {
+			t.Errorf("range after ClearRange = %q", got)
+		}
+	})
+
+	t.Run("ReadYourWrites", func(t *testing.T) {
+		reset(t)
+		set(t, "a", "1")
+		got, err := s.Transact(func(tr Tx) (interface{}, error) {
+			tr.Set(key("a"), []byte("2"))
+			tr.Set(key("b"), []byte("3"))
+			tr.Clear(key("missing"))
+			value, err := tr.Get(key("a"))
+			if err != nil {
+				return nil, err
+			}
+			kvs, err := tr.GetRange(all, fdb.RangeOptions{})
+			return fmt.Sprintf("%s %d", value, len(kvs)), err
+		})
+		if err != nil || got != "2 2" {
+			t.Errorf("reads inside the transaction = %v, %v, want 2 2", got, err)
+		}
+	})
+
+	t.Run("RollbackOnError", func(t *testing.T) {
+		reset(t)
+		set(t, "a", "1", "b", "2")
+		failed := errors.New("abort")
+		_, err := s.Transact(func(tr Tx) (interface{}, error) {
+			tr.Set(key("a"), []byte("changed"))
+			tr.Clear(key("b"))
+			tr.Set(key("c"), []byte("new"))
+			return nil, failed
+		})
+		if !errors.Is(err, failed) {
+			t.Fatalf("Transact error = %v, want %v", err, failed)
+		}
+		if got := names(t, fdb.RangeOptions{}); got != "a=1 b=2 " {
+			t.Errorf("range after aborted transaction = %q", got)
+		}
+	})
+
+	t.Run("VersionstampedKeys", func(t *testing.T) {
+		reset(t)
+		sub := subspace.FromBytes(key("vs"))
+		for _, batch := range [][]string{{"first"}, {"second", "third"}} {
+			_, err := s.Transact(func(tr Tx) (interface{}, error) {
+				for i, name := range batch {
+					tr.SetVersionstampedKey(versionstampedKey(sub, nil, uint16(i)), []byte(name))
+				}
+				return nil, nil
+			})
+			if err != nil {
+				t.Fatalf("versionstamped set: %v", err)
+			}
+		}
+
+		kvs, err := s.ReadTransact(func(tr ReadTx) (interface{}, error) {
+			return tr.GetRange(sub, fdb.RangeOptions{})
+		})
+		if err != nil {
+			t.Fatalf("range: %v", err)
+		}
+		var got []string
+		var stamps []tuple.Versionstamp
+		for _, kv := range kvs.([]fdb.KeyValue) {
+			tup, err := sub.Unpack(kv.Key)
+			if err != nil || len(tup) != 1 {
+				t.Fatalf("unpacking %s: %v", kv.Key, err)
+			}
+			stamps = append(stamps, tup[0].(tuple.Versionstamp))
+			got = append(got, string(kv.Value))
+		}
+		if fmt.Sprint(got) != "[first second third]" {
+			t.Fatalf("versionstamped keys in order %v", got)
+		}
+		if stamps[1].TransactionVersion != stamps[2].TransactionVersion || stamps[0].TransactionVersion == stamps[1].TransactionVersion {
+			t.Errorf("transaction versions %v, want one per transaction", stamps)
+		}
+	})
+
+	t.Run("ConcurrentIncrements", func(t *testing.T) {
+		reset(t)
+		const workers = 20
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.Transact(func(tr Tx) (interface{}, error) {
+					value, err := tr.Get(key("counter"))
+					if err != nil {
+						return nil, err
+					}
+					n, _ := strconv.Atoi(string(value))
+					tr.Set(key("counter"), []byte(strconv.Itoa(n+1)))
+					return nil, nil
+				})
+				if err != nil {
+					t.Errorf("increment: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if value := get(t, "counter"); string(value) != strconv.Itoa(workers) {
+			t.Errorf("counter = %s, want %d", value, workers)
+		}
+	})
+}
+
+func TestMigrateLegacyRecords(t *testing.T) {
+	db := newMemoryStore()
+	if err := useKeyspace(db); err != nil {
+		t.Fatalf("opening keyspace: %v", err)
+	}
+	db.Transact(func(tr Tx) (interface{}, error) {
+		tr.Set(fdb.Key("user_a@example.com"), []byte(`{"Email":"a@example.com","APIToken":"xoxp-a","Workspace":"cats"}`))
+		tr.Set(fdb.Key("workspace_cats"), []byte(`{"workspace":"cats","team":"T1"}`))
+		return nil, nil
+	})
+
+	if err := checkSchema(db); err == nil {
+		t.Fatal("checkSchema accepted a store with legacy records")
+	}
+	for i := 0; i < 2; i++ {
+		if err := migrate(db); err != nil {
+			t.Fatalf("migrate run %d: %v", i+1, err)
+		}
+	}
+	if err := checkSchema(db); err != nil {
+		t.Fatalf("checkSchema after migrate: %v", err)
+	}
+
+	users := retrieveAllUsers(db)
+	if len(users) != 1 || users[0].APIToken != "xoxp-a" || users[0].Workspace != "cats" {
+		t.Errorf("users after migrate = %+v", users)
+	}
+	legacy, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return tr.GetRange(fdb.KeyRange{Begin: fdb.Key("user_"), End: fdb.Key("workspace_\xFF")}, fdb.RangeOptions{})
+	})
+	if kvs := legacy.([]fdb.KeyValue); len(kvs) != 0 {
+		t.Errorf("legacy keys left after migrate: %v", kvs)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Errors from auth.test that mean the stored credential itself is unusable,
+// as opposed to Slack having trouble answering.
+var tokenErrors = map[string]bool{
+	"invalid_auth":     true,
+	"not_authed":       true,
+	"token_revoked":    true,
+	"token_expired":    true,
+	"account_inactive": true,
+	"team_disabled":    true,
+}
+
+// runTokenChecker validates every stored credential now and then every
+// interval until ctx is done.
+func runTokenChecker(ctx context.Context, db Store, runner *agentRunner, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkTokens(ctx, db, runner)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkTokens calls auth.test for every stored credential. Agents whose token
+// Slack rejects are marked with the error and their handler is stopped; an
+// agent whose token works again is cleared and restarted.
+func checkTokens(ctx context.Context, db Store, runner *agentRunner) {
+	users, err := listUsers(db)
+	if err != nil {
+		log.Printf("\033[1;31mError listing users for token check: %v\033[0m", err)
+		return
+	}
+	for _, user := range users {
+		slackError, err := authTest(ctx, user)
+		if err != nil {
+			log.Printf("\033[1;31mError checking token for user %s: %v\033[0m", user.Email, err)
+			continue
+		}
+		if slackError != "" && !tokenErrors[slackError] {
+			log.Printf("\033[1;33mauth.test for user %s returned %s, will retry\033[0m", user.Email, slackError)
+			continue
+		}
+
+		if slackError != "" {
+			log.Printf("\033[1;31mToken for user %s is invalid: %s\033[0m", user.Email, slackError)
+			if runner.stop(user.Email) {
+				log.Printf("\033[1;33mStopped message handling for user: %s\033[0m", user.Email)
+			}
+		} else if user.TokenError != "" {
+			log.Printf("\033[1;32mToken for user %s is valid again\033[0m", user.Email)
+		}
+
+		restart := slackError == "" && user.TokenError != ""
+		if err := markTokenStatus(db, user.Email, slackError); err != nil {
+			log.Printf("\033[1;31mError storing token status for user %s: %v\033[0m", user.Email, err)
+			continue
+		}
+		switch {
+		case slackError != "" && user.TokenError == "":
+			recordAudit(db, AuditEntry{
+				Actor:     actorTokenChecker,
+				Action:    auditTokenInvalid,
+				Workspace: user.Workspace,
+				Target:    user.Email,
+				Details:   map[string]string{"error": slackError},
+			})
+		case restart:
+			recordAudit(db, AuditEntry{Actor: actorTokenChecker, Action: auditTokenValid, Workspace: user.Workspace, Target: user.Email})
+			user.TokenError = ""
+			runner.start(db, user)
+		}
+	}
+}
+
+// authTest returns the Slack error for user's token, or "" if it is valid.
+func authTest(ctx context.Context, user UserCredential) (string, error) {
+	data := url.Values{}
+	data.Set("token", user.APIToken)
+	resp, err := newSlackSession(user.Workspace).post(ctx, "auth.test", data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error parsing auth.test response: %v", err)
+	}
+	if !result.OK && result.Error == "" {
+		return "unknown_error", nil
+	}
+	return result.Error, nil
+}
+
+// markTokenStatus records the outcome of a token check on the agent.
+func markTokenStatus(db Store, email, slackError string) error {
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		user, err := loadUser(tr, email)
+		if err != nil || user == nil {
+			// Deleted while we were checking
+			return nil, err
+		}
+		user.TokenError = slackError
+		user.TokenCheckedAt = time.Now().UTC()
+		value, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.users.Pack(tuple.Tuple{email}), value)
+		return nil, nil
+	})
+	return err
+}
+
+// AgentStatus is an agent as shown on the status API.
+type AgentStatus struct {
+	Email          string    `json:"email"`
+	Name           string    `json:"name,omitempty"`
+	Workspace      string    `json:"workspace"`
+	Running        bool      `json:"running"`
+	TokenError     string    `json:"token_error,omitempty"`
+	TokenCheckedAt time.Time `json:"token_checked_at"`
+}
+
+// statusHandler reports the agents of the workspaces the account can see.
+func statusHandler(db Store, runner *agentRunner) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		users, err := listUsers(db)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing agents: %v", err), http.StatusInternalServerError)
+			return
+		}
+		var status struct {
+			Agents  []AgentStatus `json:"agents"`
+			Invalid int           `json:"invalid"`
+		}
+		status.Agents = []AgentStatus{}
+		for _, user := range users {
+			if !account.canView(user.Workspace) {
+				continue
+			}
+			status.Agents = append(status.Agents, AgentStatus{
+				Email:          user.Email,
+				Name:           user.Name,
+				Workspace:      user.Workspace,
+				Running:        runner.isRunning(user.Email),
+				TokenError:     user.TokenError,
+				TokenCheckedAt: user.TokenCheckedAt,
+			})
+			if user.TokenError != "" {
+				status.Invalid++
+			}
+		}
+		writeJSON(w, status)
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenCheckerStopsOnlyAgent(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats"}, "T1")
+
+	runner := newAgentRunner()
+	defer runner.shutdown()
+	runner.start(db, retrieveAllUsers(db)[0])
+
+	// The token is revoked: the only agent stops, but nothing else does
+	fake.mu.Lock()
+	delete(fake.tokens, "xoxp-U0001")
+	fake.mu.Unlock()
+	checkTokens(context.Background(), db, runner)
+	if runner.isRunning("marvin@example.com") {
+		t.Fatal("agent with a revoked token still running")
+	}
+	done := make(chan struct{})
+	go func() {
+		runner.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message handler did not stop after its token was revoked")
+	}
+	if user := retrieveAllUsers(db)[0]; user.TokenError != "token_revoked" {
+		t.Errorf("TokenError = %q, want token_revoked", user.TokenError)
+	}
+
+	// The runner is still usable once the token works again
+	fake.mu.Lock()
+	fake.tokens["xoxp-U0001"] = "U0001"
+	fake.mu.Unlock()
+	checkTokens(context.Background(), db, runner)
+	if !runner.isRunning("marvin@example.com") {
+		t.Error("agent not restarted after its token was valid again")
+	}
+	if user := retrieveAllUsers(db)[0]; user.TokenError != "" {
+		t.Errorf("TokenError = %q after a valid check", user.TokenError)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// defaultWelcomeMessage is posted when neither the invite nor the workspace
+// configure one.
+const defaultWelcomeMessage = "Hello, I'm {{.Name}}, a new assistant{{with .Owner}} set up by {{.}}{{end}}!"
+
+// WelcomeData is what a welcome message template can refer to.
+type WelcomeData struct {
+	Name      string // display name of the agent
+	Owner     string // mention of the agent's owner, if known
+	Workspace string
+}
+
+// mention formats a Slack user ID so that it notifies the user, or returns ""
+// for anything that is not a user ID.
+func mention(userID string) string {
+	if !userIDPattern.MatchString(userID) {
+		return ""
+	}
+	return "<@" + userID + ">"
+}
+
+// renderWelcome expands a welcome message template. An empty template uses
+// defaultWelcomeMessage.
+func renderWelcome(text string, data WelcomeData) (string, error) {
+	if text == "" {
+		text = defaultWelcomeMessage
+	}
+	tmpl, err := template.New("welcome").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing welcome message: %v", err)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("error rendering welcome message: %v", err)
+	}
+	return sb.String(), nil
+}
+
+// validateWelcome checks that a welcome message template renders.
+func validateWelcome(text string) error {
+	_, err := renderWelcome(text, WelcomeData{Name: "Agent", Owner: "<@U00000000>", Workspace: "workspace"})
+	return err
+}
+
+// resolveChannel returns the ID of the channel given by name (with or without
+// "#") or ID. An empty channel means the workspace's general channel.
+func resolveChannel(ctx context.Context, session *slackSession, apiToken, channel string) (string, error) {
+	channel = strings.TrimPrefix(channel, "#")
+	if channelIDPattern.MatchString(channel) {
+		return channel, nil
+	}
+
+	cursor := ""
+	for {
+		data := url.Values{}
+		data.Set("token", apiToken)
+		data.Set("types", "public_channel")
+		data.Set("exclude_archived", "true")
+		data.Set("limit", "200")
+		if cursor != "" {
+			data.Set("cursor", cursor)
+		}
+		resp, err := session.post(ctx, "conversations.list", data)
+		if err != nil {
+			return "", fmt.Errorf("error listing channels: %v", err)
+		}
+		var result struct {
+			OK       bool   `json:"ok"`
+			Error    string `json:"error"`
+			Channels []struct {
+				ID        string `json:"id"`
+				Name      string `json:"name"`
+				IsGeneral bool   `json:"is_general"`
+			} `json:"channels"`
+			ResponseMetadata struct {
+				NextCursor string `json:"next_cursor"`
+			} `json:"response_metadata"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("error parsing conversations.list response: %v", err)
+		}
+		if !result.OK {
+			return "", fmt.Errorf("conversations.list failed: %s", result.Error)
+		}
+		for _, c := range result.Channels {
+			if (channel == "" && c.IsGeneral) || (channel != "" && c.Name == channel) {
+				return c.ID, nil
+			}
+		}
+		cursor = result.ResponseMetadata.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	if channel == "" {
+		return "", fmt.Errorf("workspace has no general channel")
+	}
+	return "", fmt.Errorf("channel #%s not found", channel)
+}
+
+// joinChannel makes the agent a member of a public channel so it can post
+// there. Channels it cannot join are left to chat.postMessage to report.
+func joinChannel(ctx context.Context, session *slackSession, apiToken, channelID string) {
+	data := url.Values{}
+	data.Set("token", apiToken)
+	data.Set("channel", channelID)
+	resp, err := session.post(ctx, "conversations.join", data)
+	if err != nil {
+		log.Printf("\033[1;31mError joining channel %s: %v\033[0m", channelID, err)
+		return
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Printf("\033[1;31mError parsing conversations.join response: %v\033[0m", err)
+		return
+	}
+	if !result.OK {
+		log.Printf("\033[1;33mCould not join channel %s: %s\033[0m", channelID, result.Error)
+	}
+}
+
+// sendWelcomeMessage introduces a new agent, set up by the Slack user owner,
+// in the welcome channel of its workspace, joining the channel first.
+func sendWelcomeMessage(ctx context.Context, session *slackSession, apiToken, name, owner string, workspace *Workspace) {
+	data := WelcomeData{Name: name, Owner: mention(owner), Workspace: workspace.Name}
+	message, err := renderWelcome(workspace.WelcomeMessage, data)
+	if err != nil {
+		log.Printf("\033[1;31m%v\033[0m", err)
+		return
+	}
+	channelID, err := resolveChannel(ctx, session, apiToken, workspace.WelcomeChannel)
+	if err != nil {
+		log.Printf("\033[1;31mError resolving welcome channel: %v\033[0m", err)
+		return
+	}
+	joinChannel(ctx, session, apiToken, channelID)
+
+	sendMessageData := url.Values{}
+	sendMessageData.Set("token", apiToken)
+	sendMessageData.Set("channel", channelID)
+	sendMessageData.Set("text", message)
+
+	log.Printf("\033[1;33mSending welcome message to channel %s\033[0m", channelID)
+	resp, err := session.post(ctx, "chat.postMessage", sendMessageData)
+	if err != nil {
+		log.Printf("\033[1;31mError sending message: %v\033[0m", err)
+		return
+	}
+	defer resp.Body.Close()
+	logResponse("Send message", resp)
+}
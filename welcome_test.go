@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWelcomeMessage(t *testing.T) {
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+
+	workspace := &Workspace{
+		Name:        "pets",
+		PrimaryUser: "U07SOMEONE",
+		WorkspaceConfig: WorkspaceConfig{
+			WelcomeChannel: "#cats",
+			WelcomeMessage: "{{.Owner}}: {{.Name}} is here to help in {{.Workspace}}.",
+		},
+	}
+	sendWelcomeMessage(context.Background(), newSlackSession("pets"), "xoxp-U0001", "Mia", "U07PRIMARY", workspace)
+
+	posted := fake.postedMessages()
+	if len(posted) != 1 || posted[0].Get("channel") != "C0000CATS" || posted[0].Get("text") != "<@U07PRIMARY>: Mia is here to help in pets." {
+		t.Errorf("welcome message = %v", posted)
+	}
+	if joined := fake.joinedChannels(); len(joined) != 1 || joined[0] != "C0000CATS" {
+		t.Errorf("agent joined %v, want #cats", joined)
+	}
+
+	for _, bad := range []string{"{{.Name", "{{.Nickname}}"} {
+		if err := validateWelcome(bad); err == nil {
+			t.Errorf("validateWelcome(%q) accepted an invalid template", bad)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Workspace is a Slack workspace agents have been invited into. The JSON
+// names of the invite fields match the records written before agents were
+// tracked, so those still load.
+type Workspace struct {
+	Name        string    `json:"workspace"`
+	TeamID      string    `json:"team"`
+	InviteCode  string    `json:"invite_code"`
+	PrimaryUser string    `json:"user"`
+	Agents      []string  `json:"agents"`
+	CreatedAt   time.Time `json:"created_at"`
+	// DefaultAvatar is the uploaded avatar agents get when their invite does
+	// not pick one.
+	DefaultAvatar string `json:"default_avatar,omitempty"`
+	// PrimaryDM is the DM channel the invite's Slack URL pointed at, a
+	// conversation the primary user is in.
+	PrimaryDM string `json:"primary_dm,omitempty"`
+	// WorkspaceConfig is inlined, so settings made by invites before it
+	// existed are part of it.
+	WorkspaceConfig
+}
+
+// OnboardingEvent is one step of provisioning an agent into a workspace,
+// kept in the invites directory under (workspace, time).
+type OnboardingEvent struct {
+	Time        time.Time `json:"time"`
+	Workspace   string    `json:"workspace"`
+	Status      string    `json:"status"`
+	Name        string    `json:"name,omitempty"`
+	PrimaryUser string    `json:"user,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Onboarding statuses.
+const (
+	onboardingRequested = "requested"
+	onboardingCreated   = "created"
+	onboardingFailed    = "failed"
+)
+
+// WorkspaceSummary is what the API lists about a workspace; never its invite
+// code, which lets anyone join it.
+type WorkspaceSummary struct {
+	Name      string    `json:"workspace"`
+	TeamID    string    `json:"team"`
+	Agents    []string  `json:"agents"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AgentSummary is what the API reveals about an agent; never its token.
+type AgentSummary struct {
+	Email     string `json:"email"`
+	Name      string `json:"name,omitempty"`
+	Workspace string `json:"workspace"`
+}
+
+func loadWorkspace(tr ReadTx, name string) (*Workspace, error) {
+	value, err := tr.Get(ks.workspaces.Pack(tuple.Tuple{name}))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var workspace Workspace
+	if err := json.Unmarshal(value, &workspace); err != nil {
+		return nil, fmt.Errorf("error unmarshaling workspace %s: %v", name, err)
+	}
+	return &workspace, nil
+}
+
+func saveWorkspace(tr Tx, workspace *Workspace) error {
+	value, err := json.Marshal(workspace)
+	if err != nil {
+		return fmt.Errorf("error marshaling workspace data: %v", err)
+	}
+	tr.Set(ks.workspaces.Pack(tuple.Tuple{workspace.Name}), value)
+	return nil
+}
+
+// upsertWorkspace records the latest invite details for a workspace, keeping
+// the agents already provisioned into it.
+func upsertWorkspace(tr Tx, name, teamID, inviteCode, primaryUser string) (*Workspace, error) {
+	workspace, err := loadWorkspace(tr, name)
+	if err != nil {
+		return nil, err
+	}
+	if workspace == nil {
+		workspace = &Workspace{Name: name, CreatedAt: time.Now().UTC()}
+	}
+	if teamID != "" {
+		workspace.TeamID = teamID
+	}
+	if inviteCode != "" {
+		workspace.InviteCode = inviteCode
+	}
+	if primaryUser != "" {
+		workspace.PrimaryUser = primaryUser
+	}
+	return workspace, saveWorkspace(tr, workspace)
+}
+
+// addWorkspaceAgent links the agent with email to its workspace.
+func addWorkspaceAgent(tr Tx, name, teamID, email string) error {
+	workspace, err := upsertWorkspace(tr, name, teamID, "", "")
+	if err != nil {
+		return err
+	}
+	for _, agent := range workspace.Agents {
+		if agent == email {
+			return nil
+		}
+	}
+	workspace.Agents = append(workspace.Agents, email)
+	return saveWorkspace(tr, workspace)
+}
+
+// removeWorkspaceAgent unlinks the agent with email from its workspace.
+func removeWorkspaceAgent(tr Tx, name, email string) error {
+	workspace, err := loadWorkspace(tr, name)
+	if err != nil || workspace == nil {
+		return err
+	}
+	agents := workspace.Agents[:0]
+	for _, agent := range workspace.Agents {
+		if agent != email {
+			agents = append(agents, agent)
+		}
+	}
+	workspace.Agents = agents
+	return saveWorkspace(tr, workspace)
+}
+
+func recordOnboarding(db Store, event OnboardingEvent) {
+	event.Time = time.Now().UTC()
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.invites.Pack(tuple.Tuple{event.Workspace, event.Time.UnixNano()}), value)
+		return nil, nil
+	})
+	if err != nil {
+		log.Printf("\033[1;31mError recording onboarding event for workspace %s: %v\033[0m", event.Workspace, err)
+	}
+}
+
+func listWorkspaces(db Store) ([]Workspace, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		kvs, err := tr.GetRange(ks.workspaces, fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		workspaces := []Workspace{}
+		for _, kv := range kvs {
+			var workspace Workspace
+			if err := json.Unmarshal(kv.Value, &workspace); err != nil {
+				log.Printf("\033[1;31mError unmarshaling workspace: %v\033[0m", err)
+				continue
+			}
+			workspaces = append(workspaces, workspace)
+		}
+		return workspaces, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]Workspace), nil
+}
+
+// listWorkspaceAgents returns the agents of a workspace, or nil if there is
+// no such workspace.
+func listWorkspaceAgents(db Store, name string) ([]AgentSummary, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		workspace, err := loadWorkspace(tr, name)
+		if err != nil || workspace == nil {
+			return []AgentSummary(nil), err
+		}
+		agents := []AgentSummary{}
+		for _, email := range workspace.Agents {
+			user, err := loadUser(tr, email)
+			if err != nil {
+				return nil, err
+			}
+			if user == nil {
+				continue
+			}
+			agents = append(agents, AgentSummary{Email: user.Email, Name: user.Name, Workspace: user.Workspace})
+		}
+		return agents, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]AgentSummary), nil
+}
+
+func listOnboardingHistory(db Store, name string) ([]OnboardingEvent, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		kvs, err := tr.GetRange(ks.invites.Sub(name), fdb.RangeOptions{})
+		if err != nil {
+			return nil, err
+		}
+		events := []OnboardingEvent{}
+		for _, kv := range kvs {
+			var event OnboardingEvent
+			if err := json.Unmarshal(kv.Value, &event); err != nil {
+				log.Printf("\033[1;31mError unmarshaling onboarding event: %v\033[0m", err)
+				continue
+			}
+			events = append(events, event)
+		}
+		return events, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]OnboardingEvent), nil
+}
+
+func listWorkspacesHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		workspaces, err := listWorkspaces(db)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing workspaces: %v", err), http.StatusInternalServerError)
+			return
+		}
+		visible := []WorkspaceSummary{}
+		for _, workspace := range workspaces {
+			if account.canView(workspace.Name) {
+				visible = append(visible, WorkspaceSummary{
+					Name:      workspace.Name,
+					TeamID:    workspace.TeamID,
+					Agents:    append([]string{}, workspace.Agents...),
+					CreatedAt: workspace.CreatedAt,
+				})
+			}
+		}
+		writeJSON(w, visible)
+	})
+}
+
+// workspaceAgentsHandler reports workspaces the account cannot see as not
+// found.
+func workspaceAgentsHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name := r.PathValue("name")
+		var agents []AgentSummary
+		var err error
+		if account.canView(name) {
+			agents, err = listWorkspaceAgents(db, name)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing agents: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if agents == nil {
+			http.Error(w, fmt.Sprintf("Workspace '%s' not found", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, agents)
+	})
+}
+
+func workspaceHistoryHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name := r.PathValue("name")
+		if !account.canView(name) {
+			http.Error(w, fmt.Sprintf("Workspace '%s' not found", name), http.StatusNotFound)
+			return
+		}
+		events, err := listOnboardingHistory(db, name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing onboarding history: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, events)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("\033[1;31mError writing JSON response: %v\033[0m", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWorkspaceAPI(t *testing.T) {
+	db := newTestStore(t)
+	viewer := newTestAccount(t, db, "vera", roleViewer, "cats")
+	db.Transact(func(tr Tx) (interface{}, error) {
+		for _, name := range []string{"cats", "dogs"} {
+			if _, err := upsertWorkspace(tr, name, "T07Q4VBFFHP", "zt-secret", "U07PRIMARY"); err != nil {
+				return nil, err
+			}
+		}
+		return nil, addWorkspaceAgent(tr, "cats", "", "marvin@example.com")
+	})
+	storeUserCredentials(db, UserCredential{Email: "marvin@example.com", APIToken: "xoxp-secret", Workspace: "cats", Name: "Marvin"}, "T07Q4VBFFHP")
+	recordOnboarding(db, OnboardingEvent{Workspace: "cats", Status: onboardingCreated, Name: "Marvin", Email: "marvin@example.com"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /workspaces", listWorkspacesHandler(db))
+	mux.HandleFunc("GET /workspaces/{name}/agents", workspaceAgentsHandler(db))
+	mux.HandleFunc("GET /workspaces/{name}/history", workspaceHistoryHandler(db))
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+viewer)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/workspaces")
+	var workspaces []WorkspaceSummary
+	json.Unmarshal(rec.Body.Bytes(), &workspaces)
+	if rec.Code != http.StatusOK || len(workspaces) != 1 || workspaces[0].Name != "cats" || workspaces[0].Agents[0] != "marvin@example.com" {
+		t.Errorf("GET /workspaces = %d %s, want only cats", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "zt-secret") || strings.Contains(rec.Body.String(), "invite_code") {
+		t.Errorf("GET /workspaces reveals the invite code: %s", rec.Body)
+	}
+
+	rec = get("/workspaces/cats/agents")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"name":"Marvin"`) || strings.Contains(rec.Body.String(), "xoxp-secret") {
+		t.Errorf("GET agents = %d %s", rec.Code, rec.Body)
+	}
+	rec = get("/workspaces/cats/history")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"created"`) {
+		t.Errorf("GET history = %d %s", rec.Code, rec.Body)
+	}
+	for _, path := range []string{"/workspaces/dogs/agents", "/workspaces/dogs/history", "/workspaces/birds/agents"} {
+		if rec := get(path); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata" // quiet hours name zones the host may not have
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// Trigger types, see Trigger.
+const (
+	triggerMention = "mention"
+	triggerKeyword = "keyword"
+	triggerRegex   = "regex"
+)
+
+var modelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/-]{0,99}$`)
+
+// WorkspaceConfig is how every agent of a workspace behaves. The zero value
+// answers DMs only, with the deployment's model and limits.
+type WorkspaceConfig struct {
+	// WelcomeChannel is where new agents introduce themselves, by name or ID;
+	// empty means the general channel. WelcomeMessage is a text/template
+	// over WelcomeData.
+	WelcomeChannel string `json:"welcome_channel,omitempty"`
+	WelcomeMessage string `json:"welcome_message,omitempty"`
+	// OwnerField is the ID (Xf...) of a custom profile field that is set to
+	// the owner of every agent.
+	OwnerField string `json:"owner_field,omitempty"`
+	// NameTemplate is a text/template over NameData naming agents whose
+	// invite has no name; empty uses the deployment's NAME_TEMPLATE.
+	NameTemplate string `json:"name_template,omitempty"`
+	// AllowedChannels are the channel IDs agents answer in when a trigger
+	// matches. DMs are always answered.
+	AllowedChannels []string `json:"allowed_channels,omitempty"`
+	// Triggers decide which channel messages are answered; none means
+	// mentions of the agent.
+	Triggers []Trigger `json:"triggers,omitempty"`
+	// Model is the chat completions model; empty uses LLM_MODEL.
+	Model  string `json:"model,omitempty"`
+	Budget Budget `json:"budget"`
+	// QuietHours, if set, is when agents stay silent in channels.
+	QuietHours *QuietHours `json:"quiet_hours,omitempty"`
+	// History is how much of the channel or thread a reply there sees.
+	History History `json:"history"`
+	// Knowledge is how much of the workspace's documents a reply sees.
+	Knowledge Knowledge `json:"knowledge"`
+}
+
+// Trigger is a rule for answering a channel message: a mention of the
+// agent, a keyword anywhere in it (ignoring case) or a regular expression
+// matching it.
+type Trigger struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+// Budget limits what the workspace's agents spend on the LLM.
+type Budget struct {
+	// DailyRequests caps the LLM calls of all agents together per UTC day;
+	// 0 is unlimited.
+	DailyRequests int `json:"daily_requests,omitempty"`
+	// MaxTokens caps each reply; 0 uses LLM_MAX_TOKENS.
+	MaxTokens int `json:"max_tokens,omitempty"`
+}
+
+// QuietHours is a daily period in a time zone, "HH:MM" to "HH:MM". An End
+// before Start runs past midnight.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+// parseClock returns the minutes since midnight of an "HH:MM" time.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as 22:30", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether now falls within the quiet hours.
+func (q *QuietHours) active(now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	loc, err := time.LoadLocation(q.Timezone)
+	start, err1 := parseClock(q.Start)
+	end, err2 := parseClock(q.End)
+	if err != nil || err1 != nil || err2 != nil {
+		return false
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return start <= minute && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// validate normalises the config and returns one line for each setting that
+// is invalid.
+func (c *WorkspaceConfig) validate() []string {
+	var problems []string
+	invalid := func(field string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("Invalid '%s': %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	c.WelcomeChannel = strings.TrimPrefix(strings.TrimSpace(c.WelcomeChannel), "#")
+	if err := validateWelcome(c.WelcomeMessage); err != nil {
+		invalid("welcome_message", "%v", err)
+	}
+	if c.OwnerField != "" && !profileFieldIDPattern.MatchString(c.OwnerField) {
+		invalid("owner_field", "expected a profile field ID such as Xf01ABCDEF")
+	}
+	if c.NameTemplate != "" {
+		if _, err := renderName(c.NameTemplate, NameData{Owner: "owner", Workspace: "workspace", Number: 1}); err != nil {
+			invalid("name_template", "%v", err)
+		}
+	}
+	for _, channel := range c.AllowedChannels {
+		if err := expectSlackID(channel, slackIDChannel); err != nil {
+			invalid("allowed_channels", "%v", err)
+		}
+	}
+	for i := range c.Triggers {
+		trigger := &c.Triggers[i]
+		trigger.Type = strings.ToLower(strings.TrimSpace(trigger.Type))
+		switch trigger.Type {
+		case triggerMention:
+			if trigger.Value != "" {
+				invalid("triggers", "a mention trigger takes no value")
+			}
+		case triggerKeyword:
+			trigger.Value = strings.TrimSpace(trigger.Value)
+			if trigger.Value == "" {
+				invalid("triggers", "a keyword trigger needs a value")
+			}
+		case triggerRegex:
+			if _, err := regexp.Compile(trigger.Value); err != nil || trigger.Value == "" {
+				invalid("triggers", "%q is not a regular expression", trigger.Value)
+			}
+		default:
+			invalid("triggers", "unknown type %q, expected %s, %s or %s", trigger.Type, triggerMention, triggerKeyword, triggerRegex)
+		}
+	}
+	if c.Model != "" && !modelPattern.MatchString(c.Model) {
+		invalid("model", "%q is not a model name", c.Model)
+	}
+	if c.Budget.DailyRequests < 0 {
+		invalid("budget.daily_requests", "cannot be negative")
+	}
+	if c.Budget.MaxTokens < 0 || c.Budget.MaxTokens > 32768 {
+		invalid("budget.max_tokens", "must be between 0 and 32768")
+	}
+	if c.History.Messages < 0 || c.History.Messages > maxHistoryMessages {
+		invalid("history.messages", "must be between 0 and %d", maxHistoryMessages)
+	}
+	if c.History.MaxChars < 0 || c.History.MaxChars > maxHistoryChars {
+		invalid("history.max_chars", "must be between 0 and %d", maxHistoryChars)
+	}
+	if c.Knowledge.Results < 0 || c.Knowledge.Results > maxKnowledgeResults {
+		invalid("knowledge.results", "must be between 0 and %d", maxKnowledgeResults)
+	}
+	if q := c.QuietHours; q != nil {
+		start, err1 := parseClock(q.Start)
+		end, err2 := parseClock(q.End)
+		switch {
+		case err1 != nil:
+			invalid("quiet_hours.start", "%v", err1)
+		case err2 != nil:
+			invalid("quiet_hours.end", "%v", err2)
+		case start == end:
+			invalid("quiet_hours", "start and end are the same")
+		}
+		if _, err := time.LoadLocation(q.Timezone); err != nil || q.Timezone == "" {
+			invalid("quiet_hours.timezone", "%q is not a time zone such as Europe/Berlin", q.Timezone)
+		}
+	}
+	return problems
+}
+
+func (c *WorkspaceConfig) model() string {
+	if c.Model != "" {
+		return c.Model
+	}
+	return cfg.LLMModel
+}
+
+func (c *WorkspaceConfig) maxTokens() int {
+	if c.Budget.MaxTokens > 0 {
+		return c.Budget.MaxTokens
+	}
+	return cfg.LLMMaxTokens
+}
+
+// triggered reports whether a channel message with text should be answered
+// by the agent with user ID selfID.
+func (c *WorkspaceConfig) triggered(selfID, text string) bool {
+	triggers := c.Triggers
+	if len(triggers) == 0 {
+		triggers = []Trigger{{Type: triggerMention}}
+	}
+	for _, trigger := range triggers {
+		switch trigger.Type {
+		case triggerMention:
+			if selfID != "" && strings.Contains(text, "<@"+selfID+">") {
+				return true
+			}
+		case triggerKeyword:
+			if strings.Contains(strings.ToLower(text), strings.ToLower(trigger.Value)) {
+				return true
+			}
+		case triggerRegex:
+			if re, err := regexp.Compile(trigger.Value); err == nil && re.MatchString(text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answers reports whether the agent with user ID selfID answers a message
+// with text posted in channel at now: every DM, and channel messages that
+// match a trigger in an allowed channel outside quiet hours.
+func (c *WorkspaceConfig) answers(selfID, channel, text string, now time.Time) bool {
+	if strings.HasPrefix(channel, "D") {
+		return true
+	}
+	allowed := false
+	for _, id := range c.AllowedChannels {
+		allowed = allowed || id == channel
+	}
+	return allowed && !c.QuietHours.active(now) && c.triggered(selfID, text)
+}
+
+// workspaceConfig returns the config of workspace, the zero config if it is
+// not known.
+func workspaceConfig(db Store, workspace string) (*WorkspaceConfig, error) {
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadWorkspace(tr, workspace)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ws := result.(*Workspace); ws != nil {
+		return &ws.WorkspaceConfig, nil
+	}
+	return &WorkspaceConfig{}, nil
+}
+
+// usedBudget returns how many LLM requests the workspace's agents made on
+// the UTC day of now.
+func usedBudget(tr ReadTx, workspace string, now time.Time) (int64, error) {
+	value, err := tr.Get(ks.usage.Pack(tuple.Tuple{workspace, now.UTC().Format(time.DateOnly)}))
+	if err != nil || value == nil {
+		return 0, err
+	}
+	t, err := tuple.Unpack(value)
+	if err != nil || len(t) != 1 {
+		return 0, fmt.Errorf("invalid usage counter %q", value)
+	}
+	used, _ := t[0].(int64)
+	return used, nil
+}
+
+// withinBudget reports whether the workspace's agents may make another LLM
+// request today. Only requests that were answered are counted, by
+// spendBudget, so agents answering at the same moment can go a few over.
+func withinBudget(db Store, workspace string, budget Budget, now time.Time) (bool, error) {
+	if budget.DailyRequests == 0 {
+		return true, nil
+	}
+	result, err := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return usedBudget(tr, workspace, now)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error reading usage of workspace %s: %v", workspace, err)
+	}
+	return result.(int64) < int64(budget.DailyRequests), nil
+}
+
+// spendBudget counts an LLM request that was answered against the
+// workspace's daily budget.
+func spendBudget(db Store, workspace string, budget Budget, now time.Time) error {
+	if budget.DailyRequests == 0 {
+		return nil
+	}
+	_, err := db.Transact(func(tr Tx) (interface{}, error) {
+		used, err := usedBudget(tr, workspace, now)
+		if err != nil {
+			return nil, err
+		}
+		tr.Set(ks.usage.Pack(tuple.Tuple{workspace, now.UTC().Format(time.DateOnly)}), tuple.Tuple{used + 1}.Pack())
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error counting usage of workspace %s: %v", workspace, err)
+	}
+	return nil
+}
+
+// firstLimitNotice reports whether channel has not yet been told today that
+// the workspace's budget is used up, and records that it now has been.
+func firstLimitNotice(db Store, workspace, channel string, now time.Time) (bool, error) {
+	key := ks.usage.Pack(tuple.Tuple{workspace, now.UTC().Format(time.DateOnly), "notice", channel})
+	result, err := db.Transact(func(tr Tx) (interface{}, error) {
+		if value, err := tr.Get(key); err != nil || value != nil {
+			return false, err
+		}
+		tr.Set(key, []byte{})
+		return true, nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("error recording limit notice in %s: %v", channel, err)
+	}
+	return result.(bool), nil
+}
+
+// getConfigHandler returns the config of a workspace the account can see.
+func getConfigHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name := r.PathValue("name")
+		var ws interface{}
+		var err error
+		if account.canView(name) {
+			ws, err = db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+				return loadWorkspace(tr, name)
+			})
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading workspace: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if ws == nil || ws.(*Workspace) == nil {
+			http.Error(w, fmt.Sprintf("Workspace '%s' not found", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, ws.(*Workspace).WorkspaceConfig)
+	})
+}
+
+// putConfigHandler replaces the config of a workspace with the document in
+// the body, after validating all of it. Unknown settings are rejected so
+// that typos do not go unnoticed.
+func putConfigHandler(db Store) http.HandlerFunc {
+	return withAccount(db, func(w http.ResponseWriter, r *http.Request, account *Account) {
+		name := r.PathValue("name")
+		if !account.canManage(name) {
+			http.Error(w, fmt.Sprintf("Account '%s' cannot configure workspace '%s'", account.Name, name), http.StatusForbidden)
+			return
+		}
+		if err := validateWorkspaceName(name); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid workspace: %v", err), http.StatusBadRequest)
+			return
+		}
+		var config WorkspaceConfig
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if problems := config.validate(); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusBadRequest)
+			return
+		}
+		_, err := db.Transact(func(tr Tx) (interface{}, error) {
+			ws, err := upsertWorkspace(tr, name, "", "", "")
+			if err != nil {
+				return nil, err
+			}
+			ws.WorkspaceConfig = config
+			return nil, saveWorkspace(tr, ws)
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error storing config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		recordAudit(db, AuditEntry{Actor: account.actor(), Action: auditConfigUpdate, Workspace: name, Target: name})
+		writeJSON(w, config)
+	})
+}
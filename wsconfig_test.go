@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkspaceConfigValidate(t *testing.T) {
+	valid := WorkspaceConfig{
+		WelcomeChannel:  "#general",
+		AllowedChannels: []string{"C0000CATS"},
+		Triggers:        []Trigger{{Type: " Mention "}, {Type: "keyword", Value: " help "}, {Type: "regex", Value: `(?i)\bbug\b`}},
+		Model:           "llama-3.1-8b-instant",
+		Budget:          Budget{DailyRequests: 100, MaxTokens: 512},
+		QuietHours:      &QuietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Berlin"},
+	}
+	if problems := valid.validate(); len(problems) != 0 {
+		t.Fatalf("validate(valid) = %q", problems)
+	}
+	if valid.WelcomeChannel != "general" || valid.Triggers[0].Type != triggerMention || valid.Triggers[1].Value != "help" {
+		t.Errorf("config not normalised: %+v", valid)
+	}
+
+	tests := []struct {
+		config WorkspaceConfig
+		want   string
+	}{
+		{WorkspaceConfig{WelcomeMessage: "{{.Nope"}, "'welcome_message'"},
+		{WorkspaceConfig{OwnerField: "owner"}, "'owner_field'"},
+		{WorkspaceConfig{NameTemplate: "{{.Unknown}}"}, "'name_template'"},
+		{WorkspaceConfig{AllowedChannels: []string{"D07PS6JMF8B"}}, `'allowed_channels': "D07PS6JMF8B" is a DM channel ID`},
+		{WorkspaceConfig{Triggers: []Trigger{{Type: "mention", Value: "x"}}}, "takes no value"},
+		{WorkspaceConfig{Triggers: []Trigger{{Type: "keyword"}}}, "needs a value"},
+		{WorkspaceConfig{Triggers: []Trigger{{Type: "regex", Value: "("}}}, "not a regular expression"},
+		{WorkspaceConfig{Triggers: []Trigger{{Type: "always"}}}, `unknown type "always"`},
+		{WorkspaceConfig{Model: "gpt 4"}, "'model'"},
+		{WorkspaceConfig{Budget: Budget{DailyRequests: -1}}, "'budget.daily_requests'"},
+		{WorkspaceConfig{Budget: Budget{MaxTokens: 1 << 20}}, "'budget.max_tokens'"},
+		{WorkspaceConfig{QuietHours: &QuietHours{Start: "25:00", End: "07:00", Timezone: "UTC"}}, "'quiet_hours.start'"},
+		{WorkspaceConfig{QuietHours: &QuietHours{Start: "07:00", End: "07:00", Timezone: "UTC"}}, "start and end are the same"},
+		{WorkspaceConfig{QuietHours: &QuietHours{Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"}}, "'quiet_hours.timezone'"},
+		{WorkspaceConfig{History: History{Messages: maxHistoryMessages + 1}}, "'history.messages'"},
+		{WorkspaceConfig{History: History{MaxChars: -1}}, "'history.max_chars'"},
+		{WorkspaceConfig{Knowledge: Knowledge{Results: maxKnowledgeResults + 1}}, "'knowledge.results'"},
+	}
+	for _, test := range tests {
+		problems := test.config.validate()
+		if len(problems) != 1 || !strings.Contains(problems[0], test.want) {
+			t.Errorf("validate(%+v) = %q, want one problem mentioning %q", test.config, problems, test.want)
+		}
+	}
+}
+
+func TestWorkspaceConfigAnswers(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	day := time.Date(2024, 6, 3, 12, 0, 0, 0, berlin)
+	night := time.Date(2024, 6, 3, 23, 30, 0, 0, berlin)
+	config := WorkspaceConfig{
+		AllowedChannels: []string{"C0000CATS"},
+		QuietHours:      &QuietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Berlin"},
+	}
+
+	tests := []struct {
+		triggers      []Trigger
+		channel, text string
+		now           time.Time
+		want          bool
+	}{
+		{nil, "D0001", "hi", night, true},
+		{nil, "C0000CATS", "hi <@U0AGENT00>", day, true},
+		{nil, "C0000CATS", "hi <@U0OTHER00>", day, false},
+		{nil, "C0000CATS", "hi <@U0AGENT00>", night, false},
+		{nil, "C0000DOGS", "hi <@U0AGENT00>", day, false},
+		{[]Trigger{{Type: triggerKeyword, Value: "Help"}}, "C0000CATS", "can someone HELP me", day, true},
+		{[]Trigger{{Type: triggerKeyword, Value: "Help"}}, "C0000CATS", "hi <@U0AGENT00>", day, false},
+		{[]Trigger{{Type: triggerRegex, Value: `^!ask\b`}}, "C0000CATS", "!ask what time is it", day, true},
+	}
+	for _, test := range tests {
+		config.Triggers = test.triggers
+		if got := config.answers("U0AGENT00", test.channel, test.text, test.now); got != test.want {
+			t.Errorf("answers(triggers %v, %s, %q, %s) = %v, want %v", test.triggers, test.channel, test.text, test.now.Format(time.Kitchen), got, test.want)
+		}
+	}
+}
+
+func TestSpendBudget(t *testing.T) {
+	db := newTestStore(t)
+	now := time.Date(2024, 6, 3, 23, 0, 0, 0, time.UTC)
+	budget := Budget{DailyRequests: 2}
+
+	for i, want := range []bool{true, true, false} {
+		ok, err := withinBudget(db, "cats", budget, now)
+		if err != nil || ok != want {
+			t.Errorf("request %d: withinBudget = %v, %v, want %v", i+1, ok, err, want)
+		}
+		if ok {
+			spendBudget(db, "cats", budget, now)
+		}
+	}
+	if ok, _ := withinBudget(db, "dogs", budget, now); !ok {
+		t.Errorf("another workspace shares the budget")
+	}
+	if ok, _ := withinBudget(db, "cats", budget, now.Add(time.Hour)); !ok {
+		t.Errorf("budget not renewed the next day")
+	}
+
+	// The limit is announced once a day in each channel
+	for _, test := range []struct {
+		channel string
+		now     time.Time
+		want    bool
+	}{
+		{"C0000CATS", now, true},
+		{"C0000CATS", now, false},
+		{"D0000CATS", now, true},
+		{"C0000CATS", now.Add(time.Hour), true},
+	} {
+		if first, err := firstLimitNotice(db, "cats", test.channel, test.now); err != nil || first != test.want {
+			t.Errorf("firstLimitNotice(%s, %s) = %v, %v, want %v", test.channel, test.now.Format(time.DateOnly), first, err, test.want)
+		}
+	}
+}
+
+func TestBudgetReplies(t *testing.T) {
+	db := newTestStore(t)
+	fake := newFakeSlack(t)
+	useFakeSlack(t, fake)
+	fake.tokens["xoxp-U0001"] = "U0001"
+	user := &UserCredential{Email: "marvin@example.com", APIToken: "xoxp-U0001", Workspace: "cats", Name: "Marvin"}
+	storeUserCredentials(db, *user, "T07Q4VBFFHP")
+	db.Transact(func(tr Tx) (interface{}, error) {
+		ws, err := upsertWorkspace(tr, "cats", "T07Q4VBFFHP", "", "")
+		if err != nil {
+			return nil, err
+		}
+		ws.Budget.DailyRequests = 1
+		return nil, saveWorkspace(tr, ws)
+	})
+	session := newSlackSession("cats")
+	answer := func(channel string) error {
+		return answerMessage(context.Background(), db, session, user, QueuedMessage{Channel: channel, Text: "Hello?"})
+	}
+
+	// A failed LLM call costs nothing
+	t.Setenv("GROQ_API_KEY", "wrong-key")
+	if err := answer("D0000CATS"); err == nil {
+		t.Fatal("answerMessage succeeded without the LLM")
+	}
+	t.Setenv("GROQ_API_KEY", "test-key")
+	if err := answer("D0000CATS"); err != nil {
+		t.Fatalf("answerMessage: %v", err)
+	}
+
+	// Once it is spent, each channel hears about it once
+	for _, channel := range []string{"D0000CATS", "D0000CATS", "C0000CATS", "D0000CATS"} {
+		if err := answer(channel); err != nil {
+			t.Fatalf("answerMessage over budget: %v", err)
+		}
+	}
+	var replies []string
+	for _, posted := range fake.postedMessages() {
+		replies = append(replies, posted.Get("channel")+": "+posted.Get("text"))
+	}
+	limit := "I've reached today's limit for this workspace, please try again tomorrow."
+	if want := []string{"D0000CATS: Don't panic.", "D0000CATS: " + limit, "C0000CATS: " + limit}; strings.Join(replies, "\n") != strings.Join(want, "\n") {
+		t.Errorf("replies = %q, want %q", replies, want)
+	}
+	if got := len(fake.llmRequests()); got != 1 {
+		t.Errorf("LLM answered %d times, want once", got)
+	}
+}
+
+func TestWorkspaceConfigAPI(t *testing.T) {
+	db := newTestStore(t)
+	owner := newTestAccount(t, db, "olive", roleOwner, "cats")
+	viewer := newTestAccount(t, db, "vera", roleViewer, "cats")
+	db.Transact(func(tr Tx) (interface{}, error) {
+		return upsertWorkspace(tr, "cats", "T07Q4VBFFHP", "zt-1", "U07PRIMARY")
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /workspaces/{name}/config", getConfigHandler(db))
+	mux.HandleFunc("PUT /workspaces/{name}/config", putConfigHandler(db))
+	do := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(owner, http.MethodPut, "/workspaces/cats/config", `{"model": "llama-3.1-8b-instant", "budget": {"daily_requests": 50}}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT config = %d %s", rec.Code, rec.Body)
+	}
+	rec := do(viewer, http.MethodGet, "/workspaces/cats/config", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"model":"llama-3.1-8b-instant"`) || !strings.Contains(rec.Body.String(), `"daily_requests":50`) {
+		t.Errorf("GET config = %d %s", rec.Code, rec.Body)
+	}
+	config, _ := workspaceConfig(db, "cats")
+	if config.model() != "llama-3.1-8b-instant" || config.maxTokens() != cfg.LLMMaxTokens {
+		t.Errorf("runtime config = %+v", config)
+	}
+	result, _ := db.ReadTransact(func(tr ReadTx) (interface{}, error) {
+		return loadWorkspace(tr, "cats")
+	})
+	if ws := result.(*Workspace); ws.TeamID != "T07Q4VBFFHP" || ws.InviteCode != "zt-1" {
+		t.Errorf("PUT config lost the invite: %+v", ws)
+	}
+
+	tests := []struct {
+		token, method, path, body string
+		want                      int
+	}{
+		{viewer, http.MethodPut, "/workspaces/cats/config", `{}`, http.StatusForbidden},
+		{owner, http.MethodPut, "/workspaces/cats/config", `{"modle": "typo"}`, http.StatusBadRequest},
+		{owner, http.MethodPut, "/workspaces/cats/config", `{"model": "bad model", "allowed_channels": ["general"]}`, http.StatusBadRequest},
+		{owner, http.MethodGet, "/workspaces/dogs/config", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if rec := do(test.token, test.method, test.path, test.body); rec.Code != test.want {
+			t.Errorf("%s %s %s = %d %s, want %d", test.method, test.path, test.body, rec.Code, rec.Body, test.want)
+		}
+	}
+	if rec := do(owner, http.MethodPut, "/workspaces/cats/config", `{"model": "bad model", "allowed_channels": ["general"]}`); strings.Count(rec.Body.String(), "Invalid") != 2 {
+		t.Errorf("PUT invalid config = %q, want both problems", rec.Body)
+	}
+}